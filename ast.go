@@ -1,20 +1,167 @@
 package luar
 
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Node is implemented by every AST node. Pos and End report the source range
+// the node was parsed from; nodes built by hand have invalid positions.
 type Node interface {
 	NodeType() string
+	Pos() Position
+	End() Position
 }
 
+// Position is a location in the source: a byte offset and a 1-based line and
+// column, with columns counted in characters. Filename is set for positions
+// in errors from chunks loaded from files.
+type Position struct {
+	Filename string
+	Offset   int
+	Line     int
+	Column   int
+}
+
+// IsValid reports whether the position was set by a parser.
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+func (p Position) String() string {
+	if !p.IsValid() {
+		if p.Filename != "" {
+			return p.Filename
+		}
+		return "-"
+	}
+	if p.Filename != "" {
+		return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// nodeSpan is embedded in every node to hold its source range: pos is the
+// first character of its first token and end is just past its last one.
+type nodeSpan struct {
+	pos, end Position
+}
+
+func (s nodeSpan) Pos() Position { return s.pos }
+func (s nodeSpan) End() Position { return s.end }
+
+func (s *nodeSpan) setSpan(first, last Token) {
+	s.pos = Position{Offset: first.Offset, Line: first.Line, Column: first.Column}
+	s.end = Position{Offset: last.Offset + len(last.Raw), Line: last.Line, Column: last.Column}
+	if i := strings.LastIndexByte(last.Raw, '\n'); i >= 0 {
+		s.end.Line += strings.Count(last.Raw, "\n")
+		s.end.Column = 1 + utf8.RuneCountInString(last.Raw[i+1:])
+	} else {
+		s.end.Column += utf8.RuneCountInString(last.Raw)
+	}
+}
+
+func (s *nodeSpan) hasSpan() bool { return s.pos.IsValid() }
+
+// Program is a parsed chunk. Its statements are held in the embedded Block.
 type Program struct {
-	Statements []Statement
+	nodeSpan
+	Block
+
+	// Tokens holds every token of the source with its trivia. It is only set
+	// by a lossless parser.
+	Tokens []Token
+	spans  map[interface{}]tokenSpan
 }
 
 func (p *Program) NodeType() string { return "Program" }
 
+// Block is a sequence of statements forming a scope: a chunk or the body of
+// a function, loop or branch. Lua only allows return as the last statement
+// of a block, so a trailing return is held in Return rather than in
+// Statements.
+//
+// Locals lists the local variables declared directly in the block, in order
+// of declaration: the parameters of a function body, the control variables
+// of a loop body and the names of local statements. Parent is the enclosing
+// block, or nil for a chunk.
+type Block struct {
+	nodeSpan
+	Statements []Statement
+	Return     *ReturnStatement
+	Locals     []*Identifier
+	Parent     *Block
+}
+
+func (b *Block) NodeType() string { return "Block" }
+
+// Len returns the number of statements, including a trailing return.
+func (b *Block) Len() int {
+	if b == nil {
+		return 0
+	}
+	if b.Return != nil {
+		return len(b.Statements) + 1
+	}
+	return len(b.Statements)
+}
+
+// Declares reports whether name is declared as a local of the block itself,
+// not counting enclosing blocks.
+func (b *Block) Declares(name string) bool {
+	for _, local := range b.Locals {
+		if local.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLocal reports whether name refers to a local variable of the block or
+// of an enclosing block, rather than to a global.
+func (b *Block) IsLocal(name string) bool {
+	for ; b != nil; b = b.Parent {
+		if b.Declares(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenSpan is the half-open range of Program.Tokens a node was parsed from.
+type tokenSpan struct {
+	start, end int
+}
+
+// Source reproduces the source text of a Program built by a lossless parser.
+// It returns nil for other programs.
+func (p *Program) Source() []byte {
+	if p.Tokens == nil {
+		return nil
+	}
+	var sb strings.Builder
+	for _, tok := range p.Tokens {
+		writeToken(&sb, tok)
+	}
+	return []byte(sb.String())
+}
+
+func writeToken(sb *strings.Builder, tok Token) {
+	for _, t := range tok.Leading {
+		sb.WriteString(t.Text)
+	}
+	sb.WriteString(tok.Raw)
+	for _, t := range tok.Trailing {
+		sb.WriteString(t.Text)
+	}
+}
+
 type Statement interface {
+	Node
 	StatementNode()
 }
 
 type Expression interface {
+	Node
 	ExpressionNode()
 }
 
@@ -23,7 +170,7 @@ func (s *FunctionCallStatement) StatementNode()    {}
 func (s *IfStatement) StatementNode()              {}
 func (s *WhileStatement) StatementNode()           {}
 func (s *RepeatStatement) StatementNode()          {}
-func (s *ForStatement) StatementNode()             {}
+func (s *ForNumericStatement) StatementNode()      {}
 func (s *ForInStatement) StatementNode()           {}
 func (s *FunctionStatement) StatementNode()        {}
 func (s *LocalAssignmentStatement) StatementNode() {}
@@ -48,119 +195,223 @@ func (e *MemberExpression) ExpressionNode() {}
 func (e *FunctionCall) ExpressionNode()     {}
 func (e *TableIndex) ExpressionNode()       {}
 
+func (n *AssignmentStatement) NodeType() string      { return "AssignmentStatement" }
+func (n *FunctionCallStatement) NodeType() string    { return "FunctionCallStatement" }
+func (n *IfStatement) NodeType() string              { return "IfStatement" }
+func (n *ElseIfClause) NodeType() string             { return "ElseIfClause" }
+func (n *WhileStatement) NodeType() string           { return "WhileStatement" }
+func (n *RepeatStatement) NodeType() string          { return "RepeatStatement" }
+func (n *ForNumericStatement) NodeType() string      { return "ForNumericStatement" }
+func (n *ForInStatement) NodeType() string           { return "ForInStatement" }
+func (n *FunctionStatement) NodeType() string        { return "FunctionStatement" }
+func (n *FunctionName) NodeType() string             { return "FunctionName" }
+func (n *LocalAssignmentStatement) NodeType() string { return "LocalAssignmentStatement" }
+func (n *LocalFunctionStatement) NodeType() string   { return "LocalFunctionStatement" }
+func (n *ReturnStatement) NodeType() string          { return "ReturnStatement" }
+func (n *BreakStatement) NodeType() string           { return "BreakStatement" }
+func (n *LabelStatement) NodeType() string           { return "LabelStatement" }
+func (n *GotoStatement) NodeType() string            { return "GotoStatement" }
+func (n *SemicolonStatement) NodeType() string       { return "SemicolonStatement" }
+func (n *Identifier) NodeType() string               { return "Identifier" }
+func (n *NumberLiteral) NodeType() string            { return "NumberLiteral" }
+func (n *StringLiteral) NodeType() string            { return "StringLiteral" }
+func (n *BooleanLiteral) NodeType() string           { return "BooleanLiteral" }
+func (n *NilLiteral) NodeType() string               { return "NilLiteral" }
+func (n *TableLiteral) NodeType() string             { return "TableLiteral" }
+func (n *TableField) NodeType() string               { return "TableField" }
+func (n *FunctionLiteral) NodeType() string          { return "FunctionLiteral" }
+func (n *BinaryExpression) NodeType() string         { return "BinaryExpression" }
+func (n *UnaryExpression) NodeType() string          { return "UnaryExpression" }
+func (n *IndexExpression) NodeType() string          { return "IndexExpression" }
+func (n *MemberExpression) NodeType() string         { return "MemberExpression" }
+func (n *FunctionCall) NodeType() string             { return "FunctionCall" }
+func (n *TableIndex) NodeType() string               { return "TableIndex" }
+func (n *ErrorNode) NodeType() string                { return "ErrorNode" }
+
+// String renders a node as Lua source, for debugging.
+func (n *Program) String() string                  { return nodeString(n) }
+func (n *Block) String() string                    { return nodeString(n) }
+func (n *AssignmentStatement) String() string      { return nodeString(n) }
+func (n *FunctionCallStatement) String() string    { return nodeString(n) }
+func (n *IfStatement) String() string              { return nodeString(n) }
+func (n *ElseIfClause) String() string             { return nodeString(n) }
+func (n *WhileStatement) String() string           { return nodeString(n) }
+func (n *RepeatStatement) String() string          { return nodeString(n) }
+func (n *ForNumericStatement) String() string      { return nodeString(n) }
+func (n *ForInStatement) String() string           { return nodeString(n) }
+func (n *FunctionStatement) String() string        { return nodeString(n) }
+func (n *FunctionName) String() string             { return nodeString(n) }
+func (n *LocalAssignmentStatement) String() string { return nodeString(n) }
+func (n *LocalFunctionStatement) String() string   { return nodeString(n) }
+func (n *ReturnStatement) String() string          { return nodeString(n) }
+func (n *BreakStatement) String() string           { return nodeString(n) }
+func (n *LabelStatement) String() string           { return nodeString(n) }
+func (n *GotoStatement) String() string            { return nodeString(n) }
+func (n *SemicolonStatement) String() string       { return nodeString(n) }
+func (n *Identifier) String() string               { return nodeString(n) }
+func (n *NumberLiteral) String() string            { return nodeString(n) }
+func (n *StringLiteral) String() string            { return nodeString(n) }
+func (n *BooleanLiteral) String() string           { return nodeString(n) }
+func (n *NilLiteral) String() string               { return nodeString(n) }
+func (n *TableLiteral) String() string             { return nodeString(n) }
+func (n *TableField) String() string               { return nodeString(n) }
+func (n *FunctionLiteral) String() string          { return nodeString(n) }
+func (n *BinaryExpression) String() string         { return nodeString(n) }
+func (n *UnaryExpression) String() string          { return nodeString(n) }
+func (n *IndexExpression) String() string          { return nodeString(n) }
+func (n *MemberExpression) String() string         { return nodeString(n) }
+func (n *FunctionCall) String() string             { return nodeString(n) }
+func (n *TableIndex) String() string               { return nodeString(n) }
+func (n *ErrorNode) String() string                { return nodeString(n) }
+
+// AssignmentStatement assigns Values to Targets, which are identifiers,
+// member or index expressions. Names holds the dotted name of each target
+// (`a.b` for a.b) or "" when the target is not a plain name. A bare
+// expression that is not a call is parsed as an AssignmentStatement with
+// only Values set.
 type AssignmentStatement struct {
+	nodeSpan
 	Names     []*Identifier
+	Targets   []Expression
 	Values    []Expression
 	TokenLine int
 }
 
 type LocalAssignmentStatement struct {
+	nodeSpan
 	Names     []*Identifier
 	Values    []Expression
 	TokenLine int
 }
 
 type FunctionCallStatement struct {
+	nodeSpan
 	Function *FunctionCall
 }
 
+// FunctionCall is a call. Parenthesized is set for a call in parentheses,
+// such as (f()), which gives only its first result.
 type FunctionCall struct {
-	Function  Expression
-	Arguments []Expression
-	Method    string
-	TokenLine int
+	nodeSpan
+	Function      Expression
+	Arguments     []Expression
+	Method        string
+	Parenthesized bool
+	TokenLine     int
 }
 
 type IfStatement struct {
+	nodeSpan
 	Condition Expression
-	Then      []Statement
+	Then      *Block
 	ElseIfs   []ElseIfClause
-	Else      []Statement
+	Else      *Block
 	TokenLine int
 }
 
 type ElseIfClause struct {
+	nodeSpan
 	Condition Expression
-	Then      []Statement
+	Then      *Block
 	TokenLine int
 }
 
 type WhileStatement struct {
+	nodeSpan
 	Condition Expression
-	Body      []Statement
+	Body      *Block
 	TokenLine int
 }
 
 type RepeatStatement struct {
-	Body      []Statement
+	nodeSpan
+	Body      *Block
 	Condition Expression
 	TokenLine int
 }
 
-type ForStatement struct {
-	Init      *AssignmentStatement
-	Condition Expression
-	Post      *AssignmentStatement
-	Body      []Statement
+// ForNumericStatement is a numeric for loop,
+// `for Var = Start, Limit, Step do Body end`. Step is nil when omitted.
+type ForNumericStatement struct {
+	nodeSpan
+	Var       *Identifier
+	Start     Expression
+	Limit     Expression
+	Step      Expression
+	Body      *Block
 	TokenLine int
 }
 
 type ForInStatement struct {
+	nodeSpan
 	Names     []*Identifier
 	Values    []Expression
-	Body      []Statement
+	Body      *Block
 	TokenLine int
 }
 
 type FunctionStatement struct {
+	nodeSpan
 	Name       *FunctionName
 	Parameters []*Identifier
-	Body       []Statement
+	Body       *Block
 	TokenLine  int
 }
 
 type LocalFunctionStatement struct {
+	nodeSpan
 	Name       *Identifier
 	Parameters []*Identifier
-	Body       []Statement
+	Body       *Block
 	TokenLine  int
 }
 
 type ReturnStatement struct {
+	nodeSpan
 	Results   []Expression
 	TokenLine int
 }
 
 type BreakStatement struct {
+	nodeSpan
 	TokenLine int
 }
 
 type LabelStatement struct {
+	nodeSpan
 	Name      string
 	TokenLine int
 }
 
 type GotoStatement struct {
+	nodeSpan
 	Name      string
 	TokenLine int
 }
 
 type SemicolonStatement struct {
+	nodeSpan
 	TokenLine int
 }
 
+// Identifier is a name, or "..." for the extra arguments of a function.
+// Parenthesized is set for (...), which gives only the first of them.
 type Identifier struct {
-	Name      string
-	TokenLine int
+	nodeSpan
+	Name          string
+	Parenthesized bool
+	TokenLine     int
 }
 
 type FunctionName struct {
+	nodeSpan
 	Method string
 	Table  *IndexExpression
 	Name   *Identifier
 }
 
 type NumberLiteral struct {
+	nodeSpan
 	Value     float64
 	IntValue  int64
 	IsInt     bool
@@ -168,37 +419,44 @@ type NumberLiteral struct {
 }
 
 type StringLiteral struct {
+	nodeSpan
 	Value     string
 	TokenLine int
 }
 
 type BooleanLiteral struct {
+	nodeSpan
 	Value     bool
 	TokenLine int
 }
 
 type NilLiteral struct {
+	nodeSpan
 	TokenLine int
 }
 
 type TableLiteral struct {
+	nodeSpan
 	Fields    []*TableField
 	TokenLine int
 }
 
 type TableField struct {
+	nodeSpan
 	Key       Expression
 	Value     Expression
 	TokenLine int
 }
 
 type FunctionLiteral struct {
+	nodeSpan
 	Parameters []*Identifier
-	Body       []Statement
+	Body       *Block
 	TokenLine  int
 }
 
 type BinaryExpression struct {
+	nodeSpan
 	Operator  TokenType
 	Left      Expression
 	Right     Expression
@@ -206,31 +464,39 @@ type BinaryExpression struct {
 }
 
 type UnaryExpression struct {
+	nodeSpan
 	Operator  TokenType
 	Right     Expression
 	TokenLine int
 }
 
 type IndexExpression struct {
+	nodeSpan
 	Object    Expression
 	Index     Expression
 	TokenLine int
 }
 
 type MemberExpression struct {
+	nodeSpan
 	Object    Expression
 	Member    string
 	TokenLine int
 }
 
 type TableIndex struct {
+	nodeSpan
 	Key       Expression
 	TokenLine int
 }
 
+// ErrorNode stands in for a statement that failed to parse. Message holds
+// the syntax error reported for it.
 type ErrorNode struct {
+	nodeSpan
 	Message   string
 	TokenLine int
 }
 
 func (e *ErrorNode) ExpressionNode() {}
+func (e *ErrorNode) StatementNode()  {}
@@ -1,17 +1,19 @@
 package luar
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 )
 
 func TestAST_NodeTypes(t *testing.T) {
 	program := &Program{
-		Statements: []Statement{
+		Block: Block{Statements: []Statement{
 			&AssignmentStatement{
 				Names:  []*Identifier{{Name: "x"}},
 				Values: []Expression{&NumberLiteral{Value: 10}},
 			},
-		},
+		}},
 	}
 
 	if program.NodeType() != "Program" {
@@ -186,8 +188,8 @@ func TestAST_FunctionLiteral(t *testing.T) {
 			{Name: "a"},
 			{Name: "b"},
 		},
-		Body: []Statement{
-			&ReturnStatement{
+		Body: &Block{
+			Return: &ReturnStatement{
 				Results: []Expression{
 					&BinaryExpression{
 						Operator: PLUS,
@@ -204,8 +206,8 @@ func TestAST_FunctionLiteral(t *testing.T) {
 		t.Errorf("expected 2 parameters, got %d", len(fn.Parameters))
 	}
 
-	if len(fn.Body) != 1 {
-		t.Errorf("expected 1 statement in body, got %d", len(fn.Body))
+	if fn.Body.Len() != 1 {
+		t.Errorf("expected 1 statement in body, got %d", fn.Body.Len())
 	}
 
 	fn.ExpressionNode()
@@ -226,25 +228,25 @@ func TestAST_Statements(t *testing.T) {
 
 	ifStmt := &IfStatement{
 		Condition: &BooleanLiteral{Value: true},
-		Then:      []Statement{},
+		Then:      &Block{},
 	}
 	ifStmt.StatementNode()
 
 	whileStmt := &WhileStatement{
 		Condition: &BooleanLiteral{Value: true},
-		Body:      []Statement{},
+		Body:      &Block{},
 	}
 	whileStmt.StatementNode()
 
-	forStmt := &ForStatement{
-		Body: []Statement{},
+	forStmt := &ForNumericStatement{
+		Body: &Block{},
 	}
 	forStmt.StatementNode()
 
 	fnStmt := &FunctionStatement{
 		Name:       &FunctionName{Name: &Identifier{Name: "foo"}},
 		Parameters: []*Identifier{},
-		Body:       []Statement{},
+		Body:       &Block{},
 	}
 	fnStmt.StatementNode()
 
@@ -317,3 +319,97 @@ func TestAST_ErrorNode(t *testing.T) {
 
 	err.ExpressionNode()
 }
+
+func TestAST_Block(t *testing.T) {
+	program, err := NewParser(`
+local a, b = 1, 2
+local function f(x, ...)
+    local y = x
+    for i = 1, 3 do end
+    return y
+end
+g = 1
+return a
+`).Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if len(program.Statements) != 3 || program.Return == nil || program.Len() != 4 {
+		t.Fatalf("expected 3 statements and a return, got %d and %v", len(program.Statements), program.Return)
+	}
+	var locals []string
+	for _, local := range program.Locals {
+		locals = append(locals, local.Name)
+	}
+	if strings.Join(locals, ",") != "a,b,f" {
+		t.Errorf("expected chunk locals a,b,f, got %v", locals)
+	}
+
+	body := program.Statements[1].(*LocalFunctionStatement).Body
+	if body.Parent != &program.Block {
+		t.Error("expected function body to be nested in the chunk")
+	}
+	if len(body.Locals) != 2 || body.Locals[0].Name != "x" || body.Locals[1].Name != "y" {
+		t.Errorf("expected function locals x,y, got %v", body.Locals)
+	}
+	if body.Return == nil || len(body.Statements) != 2 {
+		t.Errorf("expected 2 statements and a return in the function body")
+	}
+
+	loop := body.Statements[1].(*ForNumericStatement).Body
+	for _, tt := range []struct {
+		name  string
+		local bool
+	}{{"i", true}, {"x", true}, {"a", true}, {"f", true}, {"g", false}} {
+		if got := loop.IsLocal(tt.name); got != tt.local {
+			t.Errorf("IsLocal(%q) = %v, want %v", tt.name, got, tt.local)
+		}
+	}
+	if loop.Declares("x") {
+		t.Error("expected x to be declared in an enclosing block")
+	}
+
+	method, err := NewParser("function obj:m(a) end").Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if body := method.Statements[0].(*FunctionStatement).Body; !body.Declares("self") || !body.Declares("a") {
+		t.Errorf("expected method locals self,a, got %v", body.Locals)
+	}
+}
+
+func TestAST_ReturnMustBeLast(t *testing.T) {
+	if _, err := NewParser("return 1\nx = 2").Parse(); err == nil {
+		t.Error("expected an error for a statement after return")
+	}
+	if _, err := NewParser("do_it = function() return end").Parse(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAST_String(t *testing.T) {
+	program, err := NewParser("if x>1 then y = {a=1, 'b'} elseif z then f(x) end\nreturn -x^2").Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	ifStmt := program.Statements[0].(*IfStatement)
+
+	tests := []struct {
+		node Node
+		want string
+	}{
+		{ifStmt.Condition, "x > 1"},
+		{ifStmt.Then.Statements[0], `y = {a = 1, "b"}`},
+		{ifStmt.Then.Statements[0].(*AssignmentStatement).Values[0].(*TableLiteral).Fields[0], "a = 1"},
+		{&ifStmt.ElseIfs[0], "elseif z then\n    f(x)"},
+		{program.Return, "return -x ^ 2"},
+		{&ErrorNode{Message: "oops"}, "<error: oops>"},
+		{program, "if x > 1 then\n    y = {a = 1, \"b\"}\nelseif z then\n    f(x)\nend\nreturn -x ^ 2"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tt.node); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.node.NodeType(), tt.want, got)
+		}
+	}
+}
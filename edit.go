@@ -0,0 +1,451 @@
+package luar
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Editor changes values in existing Lua source while leaving every other byte,
+// including comments and formatting, untouched. Keys are addressed by dotted
+// paths such as "database.port". Errors are sticky: once an operation fails
+// the remaining ones are skipped and Bytes reports the first error.
+//
+//	out, err := luar.Edit(src).Set("database.port", 5433).Delete("legacy").Bytes()
+//
+// For chunks that end in `return { ... }` or `local M = { ... } return M` the
+// paths are resolved inside the returned table, otherwise against the global
+// assignments of the chunk.
+type Editor struct {
+	src string
+	err error
+}
+
+func Edit(src []byte) *Editor {
+	return &Editor{src: string(src)}
+}
+
+// Bytes returns the edited source.
+func (e *Editor) Bytes() ([]byte, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return []byte(e.src), nil
+}
+
+func (e *Editor) Err() error {
+	return e.err
+}
+
+// Set replaces the value at path with the Lua encoding of value. Missing keys
+// are added after the last field of the enclosing table, or at the end of the
+// chunk for new globals; missing intermediate tables are created.
+func (e *Editor) Set(path string, value interface{}) *Editor {
+	if e.err != nil {
+		return e
+	}
+	expr, err := encodeExpression(value)
+	if err != nil {
+		e.err = err
+		return e
+	}
+	doc, err := e.parse(path)
+	if err != nil {
+		e.err = err
+		return e
+	}
+	e.err = doc.set(splitPath(path), expr)
+	return e
+}
+
+// Delete removes the assignment or table field at path. Deleting a key that
+// does not exist is not an error.
+func (e *Editor) Delete(path string) *Editor {
+	if e.err != nil {
+		return e
+	}
+	doc, err := e.parse(path)
+	if err != nil {
+		e.err = err
+		return e
+	}
+	e.err = doc.delete(splitPath(path))
+	return e
+}
+
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+func encodeExpression(v interface{}) (string, error) {
+	enc := NewEncoder(nil)
+	enc.seen = make(map[seenKey]struct{})
+	if err := enc.encodeValue(reflect.ValueOf(v), false); err != nil {
+		return "", err
+	}
+	return enc.buf.String(), nil
+}
+
+// editDoc is a parsed snapshot of the editor's source. Every operation
+// reparses the source, so offsets are always current.
+type editDoc struct {
+	editor  *Editor
+	program *Program
+	src     string
+	root    *TableLiteral
+}
+
+func (e *Editor) parse(path string) (*editDoc, error) {
+	for _, seg := range splitPath(path) {
+		if seg == "" {
+			return nil, fmt.Errorf("luar: invalid path %q", path)
+		}
+	}
+	program, err := NewLosslessParser(e.src).Parse()
+	if err != nil {
+		return nil, fmt.Errorf("luar: cannot edit invalid source: %w", err)
+	}
+	doc := &editDoc{editor: e, program: program, src: e.src}
+	doc.root = doc.returnedTable()
+	return doc, nil
+}
+
+// returnedTable finds the table constructor returned by the chunk, if any.
+func (d *editDoc) returnedTable() *TableLiteral {
+	stmts := d.program.Statements
+	ret := d.program.Return
+	if ret == nil || len(ret.Results) == 0 {
+		return nil
+	}
+	switch r := ret.Results[0].(type) {
+	case *TableLiteral:
+		return r
+	case *Identifier:
+		for i := len(stmts) - 1; i >= 0; i-- {
+			local, ok := stmts[i].(*LocalAssignmentStatement)
+			if !ok {
+				continue
+			}
+			for j, name := range local.Names {
+				if name.Name == r.Name && j < len(local.Values) {
+					tbl, _ := local.Values[j].(*TableLiteral)
+					return tbl
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (d *editDoc) span(node interface{}) tokenSpan {
+	return d.program.spans[node]
+}
+
+func (d *editDoc) tokenEnd(i int) int {
+	tok := d.program.Tokens[i]
+	return tok.Offset + len(tok.Raw)
+}
+
+// lineEnd returns the offset just past the trailing trivia of token i, which
+// is either the end of its line or the start of the next token.
+func (d *editDoc) lineEnd(i int) int {
+	end := d.tokenEnd(i)
+	for _, t := range d.program.Tokens[i].Trailing {
+		end += len(t.Text)
+	}
+	return end
+}
+
+func (d *editDoc) lineStart(offset int) int {
+	return strings.LastIndexByte(d.src[:offset], '\n') + 1
+}
+
+// startsLine reports whether only indentation precedes offset on its line.
+func (d *editDoc) startsLine(offset int) bool {
+	return strings.TrimLeft(d.src[d.lineStart(offset):offset], " \t") == ""
+}
+
+// endsLine reports whether token i is the last token on its line.
+func (d *editDoc) endsLine(i int) bool {
+	end := d.lineEnd(i)
+	return end == len(d.src) || d.src[end] == '\n' || d.src[end] == '\r'
+}
+
+func (d *editDoc) newlineAt(offset int) int {
+	switch {
+	case strings.HasPrefix(d.src[offset:], "\r\n"):
+		return 2
+	case strings.HasPrefix(d.src[offset:], "\n"):
+		return 1
+	}
+	return 0
+}
+
+// newline returns the line ending the source uses, "\r\n" or "\n".
+func (d *editDoc) newline() string {
+	if i := strings.IndexByte(d.src, '\n'); i > 0 && d.src[i-1] == '\r' {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+func (d *editDoc) splice(start, end int, text string) {
+	d.editor.src = d.src[:start] + text + d.src[end:]
+}
+
+// globalPath returns the dotted target of a top-level assignment such as
+// `a.b.c = v`, or "" for other targets.
+func (d *editDoc) globalPath(stmt *AssignmentStatement) string {
+	span := d.span(stmt)
+	var parts []string
+	for i := span.start; i < span.end; i++ {
+		tok := d.program.Tokens[i]
+		if tok.Type == ASSIGN {
+			return strings.Join(parts, ".")
+		}
+		wantIdent := (i-span.start)%2 == 0
+		if wantIdent && tok.Type == IDENT {
+			parts = append(parts, tok.Literal)
+		} else if wantIdent || tok.Type != DOT {
+			return ""
+		}
+	}
+	return ""
+}
+
+func fieldKey(field *TableField) (string, bool) {
+	switch k := field.Key.(type) {
+	case *Identifier:
+		return k.Name, true
+	case *TableIndex:
+		if str, ok := k.Key.(*StringLiteral); ok {
+			return str.Value, true
+		}
+	}
+	return "", false
+}
+
+// lookup finds the last field of tbl with the given key.
+func lookup(tbl *TableLiteral, key string) *TableField {
+	for i := len(tbl.Fields) - 1; i >= 0; i-- {
+		if k, ok := fieldKey(tbl.Fields[i]); ok && k == key {
+			return tbl.Fields[i]
+		}
+	}
+	return nil
+}
+
+// nestedValue renders path = expr as the value of a new key, wrapping it in
+// table constructors for every segment after the first.
+func nestedValue(path []string, expr string) string {
+	for i := len(path) - 1; i > 0; i-- {
+		expr = "{" + tableKey(path[i]) + " = " + expr + "}"
+	}
+	return expr
+}
+
+func (d *editDoc) set(path []string, expr string) error {
+	if d.root != nil {
+		return d.setInTable(d.root, path, path, expr)
+	}
+
+	stmts := d.program.Statements
+	for i := len(stmts) - 1; i >= 0; i-- {
+		assign, ok := stmts[i].(*AssignmentStatement)
+		if !ok || len(assign.Values) != 1 {
+			continue
+		}
+		target := d.globalPath(assign)
+		if target == "" {
+			continue
+		}
+		targetPath := splitPath(target)
+		if len(targetPath) > len(path) || strings.Join(path[:len(targetPath)], ".") != target {
+			continue
+		}
+		value := assign.Values[0]
+		if len(targetPath) == len(path) {
+			d.replace(value, expr)
+			return nil
+		}
+		tbl, ok := value.(*TableLiteral)
+		if !ok {
+			return fmt.Errorf("luar: cannot set %s: %s is not a table", strings.Join(path, "."), target)
+		}
+		return d.setInTable(tbl, path[len(targetPath):], path, expr)
+	}
+
+	if !isIdentifier(path[0]) {
+		return fmt.Errorf("luar: cannot set %s: %q is not a valid global name", strings.Join(path, "."), path[0])
+	}
+	nl := d.newline()
+	text := path[0] + " = " + nestedValue(path, expr) + nl
+	if d.src != "" && !strings.HasSuffix(d.src, "\n") {
+		text = nl + text
+	}
+	d.splice(len(d.src), len(d.src), text)
+	return nil
+}
+
+func (d *editDoc) replace(value Expression, expr string) {
+	span := d.span(value)
+	d.splice(d.program.Tokens[span.start].Offset, d.tokenEnd(span.end-1), expr)
+}
+
+func (d *editDoc) setInTable(tbl *TableLiteral, path, full []string, expr string) error {
+	field := lookup(tbl, path[0])
+	if field == nil {
+		d.insertField(tbl, tableKey(path[0])+" = "+nestedValue(path, expr))
+		return nil
+	}
+	if len(path) == 1 {
+		d.replace(field.Value, expr)
+		return nil
+	}
+	inner, ok := field.Value.(*TableLiteral)
+	if !ok {
+		return fmt.Errorf("luar: cannot set %s: %s is not a table", strings.Join(full, "."), path[0])
+	}
+	return d.setInTable(inner, path[1:], full, expr)
+}
+
+func (d *editDoc) isSeparator(i int) bool {
+	typ := d.program.Tokens[i].Type
+	return typ == COMMA || typ == SEMICOLON
+}
+
+// insertField adds text as the last field of tbl, following the layout of the
+// existing fields: on its own line with the same indentation when the last
+// field starts a line, inline otherwise.
+func (d *editDoc) insertField(tbl *TableLiteral, text string) {
+	tblSpan := d.span(tbl)
+	open, closing := tblSpan.start, tblSpan.end-1
+
+	if len(tbl.Fields) == 0 {
+		if d.endsLine(open) {
+			indent := d.src[d.lineStart(d.program.Tokens[open].Offset):d.program.Tokens[open].Offset]
+			indent = indent[:len(indent)-len(strings.TrimLeft(indent, " \t"))]
+			end := d.lineEnd(open)
+			d.splice(end, end, d.newline()+indent+"    "+text+",")
+			return
+		}
+		end := d.tokenEnd(open)
+		d.splice(end, end, text)
+		return
+	}
+
+	last := tbl.Fields[len(tbl.Fields)-1]
+	lastSpan := d.span(last)
+	lastTok := lastSpan.end - 1
+	hasSep := lastTok+1 < closing && d.isSeparator(lastTok+1)
+	fieldStart := d.program.Tokens[lastSpan.start].Offset
+
+	if d.startsLine(fieldStart) {
+		indent := d.src[d.lineStart(fieldStart):fieldStart]
+		if hasSep {
+			end := d.lineEnd(lastTok + 1)
+			d.splice(end, end, d.newline()+indent+text+",")
+			return
+		}
+		sepAt, end := d.tokenEnd(lastTok), d.lineEnd(lastTok)
+		d.editor.src = d.src[:sepAt] + "," + d.src[sepAt:end] + d.newline() + indent + text + d.src[end:]
+		return
+	}
+
+	if hasSep {
+		end := d.tokenEnd(lastTok + 1)
+		d.splice(end, end, " "+text)
+		return
+	}
+	end := d.tokenEnd(lastTok)
+	d.splice(end, end, ", "+text)
+}
+
+func (d *editDoc) delete(path []string) error {
+	if d.root != nil {
+		return d.deleteInTable(d.root, path)
+	}
+
+	// Remove every matching global assignment, last first so that earlier
+	// offsets stay valid.
+	stmts := d.program.Statements
+	full := strings.Join(path, ".")
+	for i := len(stmts) - 1; i >= 0; i-- {
+		assign, ok := stmts[i].(*AssignmentStatement)
+		if !ok || len(assign.Values) != 1 {
+			continue
+		}
+		target := d.globalPath(assign)
+		switch {
+		case target == full:
+			span := d.span(assign)
+			last, prevSep := span.end-1, -1
+			if span.start > 0 && d.program.Tokens[span.start-1].Type == SEMICOLON {
+				prevSep = span.start - 1
+			}
+			if last+1 < len(d.program.Tokens) && d.program.Tokens[last+1].Type == SEMICOLON {
+				last++
+			}
+			d.remove(span.start, last, prevSep)
+			d.src = d.editor.src
+		case target != "" && strings.HasPrefix(full, target+"."):
+			if tbl, ok := assign.Values[0].(*TableLiteral); ok {
+				if err := d.deleteInTable(tbl, path[len(splitPath(target)):]); err != nil {
+					return err
+				}
+				d.src = d.editor.src
+			}
+		}
+	}
+	return nil
+}
+
+func (d *editDoc) deleteInTable(tbl *TableLiteral, path []string) error {
+	field := lookup(tbl, path[0])
+	if field == nil {
+		return nil
+	}
+	if len(path) > 1 {
+		inner, ok := field.Value.(*TableLiteral)
+		if !ok {
+			return nil
+		}
+		return d.deleteInTable(inner, path[1:])
+	}
+
+	span := d.span(field)
+	last := span.end - 1
+	closing := d.span(tbl).end - 1
+	prevSep := -1
+	if span.start > 0 && d.isSeparator(span.start-1) {
+		prevSep = span.start - 1
+	}
+	if last+1 < closing && d.isSeparator(last+1) {
+		last++
+	}
+	d.remove(span.start, last, prevSep)
+	return nil
+}
+
+// remove deletes tokens first..last. When they occupy whole lines the lines
+// are removed; otherwise only the tokens go, together with the preceding
+// separator prevSep if they end without one of their own.
+func (d *editDoc) remove(first, last, prevSep int) {
+	start := d.program.Tokens[first].Offset
+	if d.startsLine(start) && d.endsLine(last) {
+		end := d.lineEnd(last)
+		d.splice(d.lineStart(start), end+d.newlineAt(end), "")
+		return
+	}
+
+	end := d.tokenEnd(last)
+	if d.isSeparator(last) {
+		next := d.lineEnd(last)
+		if next < len(d.src) && d.newlineAt(next) == 0 {
+			end = next
+		}
+	} else if prevSep > 0 {
+		start = d.tokenEnd(prevSep - 1)
+	}
+	d.splice(start, end, "")
+}
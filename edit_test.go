@@ -0,0 +1,212 @@
+package luar
+
+import (
+	"bytes"
+	"testing"
+)
+
+const editSource = `-- Application settings
+app_name = "MyApp"   -- shown in logs
+legacy = true
+
+database = {
+    host = "localhost", -- primary
+    port = 5432,
+}
+
+tags = {"a", "b"}
+`
+
+func TestEdit_Set(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		value interface{}
+		want  string
+	}{
+		{
+			name:  "replace nested field",
+			path:  "database.port",
+			value: 5433,
+			want: `-- Application settings
+app_name = "MyApp"   -- shown in logs
+legacy = true
+
+database = {
+    host = "localhost", -- primary
+    port = 5433,
+}
+
+tags = {"a", "b"}
+`,
+		},
+		{
+			name:  "replace global",
+			path:  "app_name",
+			value: "Other",
+			want: `-- Application settings
+app_name = "Other"   -- shown in logs
+legacy = true
+
+database = {
+    host = "localhost", -- primary
+    port = 5432,
+}
+
+tags = {"a", "b"}
+`,
+		},
+		{
+			name:  "insert into multi-line table",
+			path:  "database.user",
+			value: "admin",
+			want: `-- Application settings
+app_name = "MyApp"   -- shown in logs
+legacy = true
+
+database = {
+    host = "localhost", -- primary
+    port = 5432,
+    user = "admin",
+}
+
+tags = {"a", "b"}
+`,
+		},
+		{
+			name:  "insert new global with nested tables",
+			path:  "cache.redis.port",
+			value: 6379,
+			want:  editSource + "cache = {redis = {port = 6379}}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Edit([]byte(editSource)).Set(tt.path, tt.value).Bytes()
+			if err != nil {
+				t.Fatalf("Edit failed: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expected:\n%s\ngot:\n%s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEdit_Delete(t *testing.T) {
+	got, err := Edit([]byte(editSource)).Delete("legacy").Delete("database.host").Delete("missing").Bytes()
+	if err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+
+	want := `-- Application settings
+app_name = "MyApp"   -- shown in logs
+
+database = {
+    port = 5432,
+}
+
+tags = {"a", "b"}
+`
+	if string(got) != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestEdit_DeleteStatement(t *testing.T) {
+	tests := []struct{ src, path, want string }{
+		{"a = 1; b = 2\n", "a", "b = 2\n"},
+		{"b = 2; a = 1\n", "a", "b = 2\n"},
+		{"b = 2; a = 1; c = 3\n", "a", "b = 2; c = 3\n"},
+		{"a = 1;\nb = 2\n", "a", "b = 2\n"},
+	}
+	for _, tt := range tests {
+		got, err := Edit([]byte(tt.src)).Delete(tt.path).Bytes()
+		if err != nil || string(got) != tt.want {
+			t.Errorf("Delete(%q) in %q: got %q, %v, want %q", tt.path, tt.src, got, err, tt.want)
+		}
+	}
+}
+
+func TestEdit_CRLF(t *testing.T) {
+	src := "db = {\r\n    host = \"h\",\r\n}\r\nempty = {\r\n}\r\nlist = {\r\n    1\r\n}\r\n"
+	got, err := Edit([]byte(src)).Set("db.port", 1).Set("empty.x", 2).Set("list.y", 3).Set("name", "n").Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "db = {\r\n    host = \"h\",\r\n    port = 1,\r\n}\r\nempty = {\r\n    x = 2,\r\n}\r\n" +
+		"list = {\r\n    1,\r\n    y = 3\r\n}\r\nname = \"n\"\r\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEdit_Inline(t *testing.T) {
+	src := "db = {host = \"h\", port = 1}\nempty = {}\n"
+	got, err := Edit([]byte(src)).
+		Set("db.user", "u").
+		Delete("db.host").
+		Set("empty.x", 1).
+		Delete("db.user").
+		Bytes()
+	if err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+
+	want := "db = {port = 1}\nempty = {x = 1}\n"
+	if string(got) != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestEdit_ReturnChunk(t *testing.T) {
+	src := `local M = {
+    name = "app", -- the name
+    ["http-port"] = 80
+}
+
+return M
+`
+	got, err := Edit([]byte(src)).Set("http-port", 8080).Set("debug", true).Bytes()
+	if err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+
+	want := `local M = {
+    name = "app", -- the name
+    ["http-port"] = 8080,
+    debug = true
+}
+
+return M
+`
+	if string(got) != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+
+	var config struct {
+		Port  int  `lua:"http-port"`
+		Debug bool `lua:"debug"`
+	}
+	dec := NewDecoder(bytes.NewReader(got))
+	dec.SetMode(ModeModule)
+	if err := dec.Decode(&config); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if config.Port != 8080 || !config.Debug {
+		t.Errorf("unexpected config %+v", config)
+	}
+}
+
+func TestEdit_Errors(t *testing.T) {
+	if _, err := Edit([]byte(`name = "x"`)).Set("name.first", "y").Bytes(); err == nil {
+		t.Error("expected error when descending into a non-table")
+	}
+	if _, err := Edit([]byte(`x = {`)).Set("x.y", 1).Bytes(); err == nil {
+		t.Error("expected error for invalid source")
+	}
+	if _, err := Edit([]byte(`x = 1`)).Set("a..b", 1).Bytes(); err == nil {
+		t.Error("expected error for invalid path")
+	}
+}
@@ -0,0 +1,120 @@
+package luar
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Env gives a config read access to environment variables through
+// env(name [, default]) and os.getenv(name).
+type Env struct {
+	// Lookup returns the value of a variable and whether it is set. It
+	// defaults to os.LookupEnv; tests can inject a fake environment with
+	// MapLookup.
+	Lookup func(name string) (string, bool)
+
+	// Allow lists the variables the config may read.
+	Allow []string
+
+	// Prefixes allows every variable whose name starts with one of them,
+	// such as "APP_". The empty prefix allows every variable.
+	Prefixes []string
+}
+
+// MapLookup returns a Lookup function that reads variables from m.
+func MapLookup(m map[string]string) func(name string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := m[name]
+		return v, ok
+	}
+}
+
+// SetEnv makes the environment variables allowed by env readable from the
+// config. Without it configs cannot read the environment, and reading a
+// variable that env does not allow is an error.
+func (d *Decoder) SetEnv(env Env) {
+	d.env = &env
+}
+
+// allows reports whether the config may read the variable name.
+func (e *Env) allows(name string) bool {
+	for _, allowed := range e.Allow {
+		if name == allowed {
+			return true
+		}
+	}
+	for _, prefix := range e.Prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the value of the variable named by argument 0 of a.
+func (e *Env) lookup(a *libArgs) (string, bool, error) {
+	name, err := a.str(0)
+	if err != nil {
+		return "", false, err
+	}
+	if !e.allows(name) {
+		return "", false, fmt.Errorf("environment variable '%s' is not allowed", name)
+	}
+	lookup := e.Lookup
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	v, ok := lookup(name)
+	return v, ok, nil
+}
+
+// openEnv stores env and os.getenv in the globals of in.
+func (in *interpreter) openEnv(e *Env) {
+	in.setFuncs(in.globals, map[string]libFunc{
+		"env": func(a *libArgs) ([]Value, error) {
+			v, ok, err := e.lookup(a)
+			if err != nil || !ok {
+				return one(a.get(1)), err
+			}
+			value, err := envValue(a, v)
+			return one(value), err
+		},
+	}, false)
+
+	t, ok := in.globals.Get("os").(*Table)
+	if !ok {
+		t = NewTable()
+		in.globals.Set("os", t)
+	}
+	in.setFuncs(t, map[string]libFunc{
+		"getenv": func(a *libArgs) ([]Value, error) {
+			v, ok, err := e.lookup(a)
+			if err != nil || !ok {
+				return one(nil), err
+			}
+			return one(v), nil
+		},
+	}, false)
+}
+
+// envValue converts the value v of a variable to the type of the default
+// passed to env, so that env("PORT", 8080) returns a number.
+func envValue(a *libArgs, v string) (Value, error) {
+	name, _ := a.str(0)
+	switch a.get(1).(type) {
+	case int64, float64:
+		if n, ok := parseNumber(v); ok {
+			return n, nil
+		}
+		return nil, fmt.Errorf("environment variable '%s' is not a number: %q", name, v)
+	case bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("environment variable '%s' is not a boolean: %q", name, v)
+		}
+		return b, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,89 @@
+package luar
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoder_SetEnv(t *testing.T) {
+	type config struct {
+		Port    int     `lua:"port"`
+		Host    string  `lua:"host"`
+		Debug   bool    `lua:"debug"`
+		Ratio   float64 `lua:"ratio"`
+		Region  string  `lua:"region"`
+		Missing string  `lua:"missing"`
+		Raw     string  `lua:"raw"`
+	}
+	src := `
+port = env("PORT", 8080)
+host = env("APP_HOST", "localhost")
+debug = env("APP_DEBUG", false)
+ratio = env("APP_RATIO", 0.5)
+region = os.getenv("REGION") or "eu"
+missing = os.getenv("APP_MISSING") == nil and "unset" or "set"
+raw = env("PORT")
+`
+	d := NewDecoder(strings.NewReader(src))
+	d.SetEnv(Env{
+		Lookup:   MapLookup(map[string]string{"PORT": "9090", "APP_DEBUG": "true", "APP_RATIO": "0.25", "SECRET": "x"}),
+		Allow:    []string{"PORT", "REGION"},
+		Prefixes: []string{"APP_"},
+	})
+	var got config
+	if err := d.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := config{Port: 9090, Host: "localhost", Debug: true, Ratio: 0.25, Region: "eu", Missing: "unset", Raw: "9090"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecoder_SetEnvErrors(t *testing.T) {
+	env := Env{
+		Lookup: MapLookup(map[string]string{"PORT": "eighty", "DEBUG": "maybe", "SECRET": "hunter2"}),
+		Allow:  []string{"PORT", "DEBUG"},
+	}
+	tests := map[string]string{
+		`x = env("SECRET")`:       "luar: line 1: environment variable 'SECRET' is not allowed",
+		`x = os.getenv("SECRET")`: "luar: line 1: environment variable 'SECRET' is not allowed",
+		`x = env("PORT", 80)`:     `luar: line 1: environment variable 'PORT' is not a number: "eighty"`,
+		`x = env("DEBUG", true)`:  `luar: line 1: environment variable 'DEBUG' is not a boolean: "maybe"`,
+		`x = env()`:               "bad argument #1 to 'env' (string expected, got no value)",
+		`x = ok`:                  "",
+	}
+	for src, want := range tests {
+		d := NewDecoder(strings.NewReader(src))
+		d.SetEnv(env)
+		var v map[string]interface{}
+		err := d.Decode(&v)
+		if want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", src, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", src, err, want)
+		}
+	}
+
+	// Without SetEnv there is no env function.
+	var v map[string]interface{}
+	if err := Unmarshal([]byte(`x = env("HOME")`), &v); err == nil || !strings.Contains(err.Error(), "attempt to call a nil value (global 'env')") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDecoder_SetEnvDefaultLookup(t *testing.T) {
+	t.Setenv("LUAR_TEST_VALUE", "from the environment")
+	d := NewDecoder(strings.NewReader(`x = env("LUAR_TEST_VALUE")`))
+	d.SetEnv(Env{Prefixes: []string{"LUAR_TEST_"}})
+	var v struct{ X string }
+	if err := d.Decode(&v); err != nil || v.X != os.Getenv("LUAR_TEST_VALUE") {
+		t.Errorf("got %q, %v", v.X, err)
+	}
+}
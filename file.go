@@ -0,0 +1,108 @@
+package luar
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// FileError records the file an error without a position of its own
+// occurred in, such as a syntax error or a failure to decode a value.
+type FileError struct {
+	Filename string
+	Err      error
+}
+
+func (e *FileError) Error() string {
+	return limitMessage(Position{Filename: e.Filename}, strings.TrimPrefix(e.Err.Error(), "luar: "))
+}
+
+func (e *FileError) Unwrap() error { return e.Err }
+
+// fileError wraps err in a *FileError for file, unless file is empty.
+func fileError(file string, err error) error {
+	if err == nil || file == "" {
+		return err
+	}
+	return &FileError{Filename: file, Err: err}
+}
+
+// DecodeFile reads the chunk in the named file and decodes it into v like
+// Decode. Positions in runtime errors carry the file name and other errors
+// are wrapped in a *FileError. The file is read from the file system set
+// with SetFS if there is one, so that includes are relative to it, and from
+// the operating system otherwise.
+func (d *Decoder) DecodeFile(name string, v interface{}) error {
+	return d.LoadFiles(v, name)
+}
+
+// LoadFiles reads the named files and runs them in order with the same
+// globals, so that each file can use and override the values set by the
+// files before it. The globals are decoded into v once all files have run;
+// in ModeReturn and ModeModule the value each file returns is decoded into v
+// in turn. No file runs if any of them cannot be read or parsed.
+func (d *Decoder) LoadFiles(v interface{}, names ...string) error {
+	return d.loadFiles(context.Background(), v, names, nil)
+}
+
+// loadFiles is LoadFiles, stopping when ctx is done and recording the files
+// read in src unless it is nil.
+func (d *Decoder) loadFiles(ctx context.Context, v interface{}, names []string, src *sources) error {
+	chunks := make([]chunk, len(names))
+	for i, name := range names {
+		c, err := d.readFile(name, src)
+		if err != nil {
+			return err
+		}
+		chunks[i] = c
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	return d.exec(ctx, v, src, chunks...)
+}
+
+// readFile reads and parses the chunk in the named file, recording it in src.
+func (d *Decoder) readFile(name string, src *sources) (chunk, error) {
+	data, err := d.readData(name)
+	src.addFile(name, data, err)
+	if err != nil {
+		return chunk{}, err
+	}
+	p := NewParser(string(data))
+	p.SetMaxDepth(d.opts.maxParseDepth())
+	program, err := p.Parse()
+	if err != nil {
+		return chunk{}, &FileError{Filename: name, Err: err}
+	}
+	return chunk{file: name, program: program}, nil
+}
+
+// readData reads the named file from the file system set with SetFS, or
+// from the operating system.
+func (d *Decoder) readData(name string) ([]byte, error) {
+	if d.fsys != nil {
+		return fs.ReadFile(d.fsys, name)
+	}
+	return os.ReadFile(name)
+}
+
+// DecodeFile decodes the chunk in the named file into v.
+func DecodeFile(name string, v interface{}) error {
+	return NewDecoder(nil).DecodeFile(name, v)
+}
+
+// DecodeFS decodes the chunk in the named file of fsys into v. The chunk can
+// load the other files in fsys with require, dofile and include.
+func DecodeFS(fsys fs.FS, name string, v interface{}) error {
+	d := NewDecoder(nil)
+	d.SetFS(fsys)
+	return d.DecodeFile(name, v)
+}
+
+// LoadFiles runs the named files in order with the same globals and decodes
+// them into v.
+func LoadFiles(v interface{}, names ...string) error {
+	return NewDecoder(nil).LoadFiles(v, names...)
+}
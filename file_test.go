@@ -0,0 +1,138 @@
+package luar
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+type fileConfig struct {
+	Name    string        `lua:"name"`
+	Port    int           `lua:"port"`
+	Timeout time.Duration `lua:"timeout"`
+}
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDecodeFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"app.lua":      "name = 'web'\nport = 8080\n",
+		"runtime.lua":  "name = 'web'\nport = name + 1\n",
+		"syntax.lua":   "name = = 1\n",
+		"duration.lua": "timeout = 'soon'\n",
+	})
+
+	var cfg fileConfig
+	if err := DecodeFile(filepath.Join(dir, "app.lua"), &cfg); err != nil || cfg != (fileConfig{Name: "web", Port: 8080}) {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+
+	file := filepath.Join(dir, "runtime.lua")
+	err := DecodeFile(file, &cfg)
+	var rerr *RuntimeError
+	if !errors.As(err, &rerr) || rerr.Pos.Filename != file || rerr.Pos.Line != 2 {
+		t.Errorf("got %v, want a runtime error at %s:2", err, file)
+	} else if want := "luar: " + file + ":2: attempt to perform arithmetic"; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("got %q, want prefix %q", err, want)
+	}
+
+	file = filepath.Join(dir, "syntax.lua")
+	err = DecodeFile(file, &cfg)
+	var ferr *FileError
+	if !errors.As(err, &ferr) || ferr.Filename != file || err.Error() != "luar: "+file+": unexpected token: = at line 1" {
+		t.Errorf("got %v", err)
+	}
+
+	file = filepath.Join(dir, "duration.lua")
+	if err := DecodeFile(file, &cfg); err == nil || err.Error() != "luar: "+file+`: time: invalid duration "soon"` {
+		t.Errorf("got %v", err)
+	}
+
+	if err := DecodeFile(filepath.Join(dir, "missing.lua"), &cfg); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestDecodeFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app/main.lua":   {Data: []byte("include('common.lua')\nport = port + 1\n")},
+		"app/common.lua": {Data: []byte("name = 'web'\nport = 8080\n")},
+		"app/self.lua":   {Data: []byte("include('self.lua')\n")},
+	}
+	var cfg fileConfig
+	if err := DecodeFS(fsys, "app/main.lua", &cfg); err != nil || cfg != (fileConfig{Name: "web", Port: 8081}) {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+
+	err := DecodeFS(fsys, "app/self.lua", &cfg)
+	if err == nil || err.Error() != "luar: app/self.lua:1: cycle loading 'app/self.lua': app/self.lua -> app/self.lua" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLoadFiles(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.lua":   "name = 'web'\nport = 8080\ntimeout = '5s'\n",
+		"prod.lua":   "port = port + 1\n",
+		"error.lua":  "\nport = nil .. 'x'\n",
+		"syntax.lua": "port = =\n",
+		"fail.lua":   "fail()\n",
+	})
+	base, prod := filepath.Join(dir, "base.lua"), filepath.Join(dir, "prod.lua")
+
+	var cfg fileConfig
+	if err := LoadFiles(&cfg, base, prod); err != nil || cfg != (fileConfig{Name: "web", Port: 8081, Timeout: 5 * time.Second}) {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+
+	file := filepath.Join(dir, "error.lua")
+	if err := LoadFiles(&cfg, base, file); err == nil || !strings.HasPrefix(err.Error(), "luar: "+file+":2: attempt to concatenate") {
+		t.Errorf("got %v", err)
+	}
+
+	// No file runs when a later one does not parse.
+	d := NewDecoder(nil)
+	d.RegisterFunc("fail", func() error { return errors.New("ran") })
+	var ferr *FileError
+	err := d.LoadFiles(&cfg, filepath.Join(dir, "fail.lua"), filepath.Join(dir, "syntax.lua"))
+	if !errors.As(err, &ferr) || ferr.Filename != filepath.Join(dir, "syntax.lua") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLoadFiles_Return(t *testing.T) {
+	fsys := fstest.MapFS{
+		"base.lua":  {Data: []byte("return {name = 'web', port = 8080}\n")},
+		"prod.lua":  {Data: []byte("return {port = 443}\n")},
+		"empty.lua": {Data: []byte("x = 1\n")},
+		"none.lua":  {Data: []byte("\nreturn\n")},
+	}
+	d := NewDecoder(nil)
+	d.SetFS(fsys)
+	d.SetMode(ModeReturn)
+
+	var cfg fileConfig
+	if err := d.LoadFiles(&cfg, "base.lua", "prod.lua"); err != nil || cfg != (fileConfig{Name: "web", Port: 443}) {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+	if err := d.DecodeFile("empty.lua", &cfg); err == nil || err.Error() != "luar: empty.lua: chunk has no return statement" {
+		t.Errorf("got %v", err)
+	}
+	if err := d.DecodeFile("none.lua", &cfg); err == nil || err.Error() != "luar: none.lua:2: chunk returns no value" {
+		t.Errorf("got %v", err)
+	}
+}
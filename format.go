@@ -0,0 +1,701 @@
+package luar
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// formatWidth is the column past which the formatter breaks a table over
+// several lines.
+const formatWidth = 80
+
+// Format parses src and returns it in canonical style: four-space
+// indentation, one statement per line, normalized spacing and the minimal
+// parentheses needed to keep the meaning of expressions. Comments, single
+// blank lines and the spelling of literals are kept. Formatting is
+// idempotent.
+func Format(src []byte) ([]byte, error) {
+	program, err := NewLosslessParser(string(src)).Parse()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(FormatProgram(program)), nil
+}
+
+// FormatProgram renders program as Lua source in canonical style. Comments
+// and literal spellings are only available to programs produced by a
+// lossless parser; other programs are printed from the AST alone.
+func FormatProgram(program *Program) string {
+	p := &printer{program: program, blockStart: true}
+	p.collectComments()
+	p.statements(&program.Block)
+	p.flushComments(math.MaxInt32)
+	return p.sb.String()
+}
+
+type comment struct {
+	// pos orders comments among tokens: 2*i for the leading trivia of token
+	// i and 2*i+1 for its trailing trivia.
+	pos   int
+	text  string
+	blank bool
+}
+
+type printer struct {
+	sb         strings.Builder
+	program    *Program
+	indent     int
+	comments   []comment
+	printed    []bool
+	next       int
+	blockStart bool
+}
+
+func (p *printer) collectComments() {
+	for i, tok := range p.program.Tokens {
+		newlines := 0
+		for _, t := range tok.Leading {
+			switch t.Kind {
+			case TriviaNewline:
+				newlines++
+			case TriviaComment:
+				p.comments = append(p.comments, comment{pos: 2 * i, text: t.Text, blank: newlines > 1})
+				newlines = 0
+			}
+		}
+		for _, t := range tok.Trailing {
+			if t.Kind == TriviaComment {
+				p.comments = append(p.comments, comment{pos: 2*i + 1, text: t.Text})
+			}
+		}
+	}
+	p.printed = make([]bool, len(p.comments))
+}
+
+// blankBefore reports whether the source had a blank line right before token
+// i, after any comments leading it.
+func (p *printer) blankBefore(i int) bool {
+	if i >= len(p.program.Tokens) {
+		return false
+	}
+	newlines := 0
+	for _, t := range p.program.Tokens[i].Leading {
+		switch t.Kind {
+		case TriviaNewline:
+			newlines++
+		case TriviaComment:
+			newlines = 0
+		}
+	}
+	return newlines > 1
+}
+
+// hasComments reports whether any unprinted comment lies inside span.
+func (p *printer) hasComments(span tokenSpan) bool {
+	for i := p.next; i < len(p.comments); i++ {
+		c := p.comments[i]
+		if c.pos > 2*span.start && c.pos < 2*span.end-1 && !p.printed[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// flushComments prints every pending comment positioned before limit on its
+// own line.
+func (p *printer) flushComments(limit int) {
+	for ; p.next < len(p.comments) && p.comments[p.next].pos < limit; p.next++ {
+		if p.printed[p.next] {
+			continue
+		}
+		c := p.comments[p.next]
+		if c.blank && !p.blockStart {
+			p.sb.WriteString("\n")
+		}
+		p.line()
+		p.sb.WriteString(c.text)
+		p.sb.WriteString("\n")
+		p.printed[p.next] = true
+		p.blockStart = false
+	}
+}
+
+// trailingComment prints the comment trailing token i on the current line.
+func (p *printer) trailingComment(i int) bool {
+	for j := p.next; j < len(p.comments) && p.comments[j].pos <= 2*i+1; j++ {
+		if p.comments[j].pos == 2*i+1 && !p.printed[j] {
+			p.sb.WriteString(" ")
+			p.sb.WriteString(p.comments[j].text)
+			p.printed[j] = true
+			return true
+		}
+	}
+	return false
+}
+
+// item starts a line for the node parsed from span, first printing the
+// comments and blank line that preceded it in the source.
+func (p *printer) item(node interface{}) (tokenSpan, bool) {
+	span, ok := p.program.spans[node]
+	if ok {
+		p.flushComments(2*span.start + 1)
+		if p.blankBefore(span.start) && !p.blockStart {
+			p.sb.WriteString("\n")
+		}
+	}
+	p.blockStart = false
+	p.line()
+	return span, ok
+}
+
+func (p *printer) line() {
+	p.sb.WriteString(strings.Repeat("    ", p.indent))
+}
+
+func (p *printer) statements(block *Block) {
+	if block == nil {
+		return
+	}
+	stmts := block.Statements
+	if block.Return != nil {
+		stmts = append(stmts[:len(stmts):len(stmts)], block.Return)
+	}
+	first := true
+	for _, stmt := range stmts {
+		if _, ok := stmt.(*SemicolonStatement); ok {
+			continue
+		}
+		span, ok := p.item(stmt)
+		if !first && opensParen(stmt) {
+			// Keep the statement from being read as a call continuing
+			// the one before it.
+			p.sb.WriteString(";")
+		}
+		first = false
+		p.statement(stmt)
+		if ok {
+			p.trailingComment(span.end - 1)
+		}
+		p.sb.WriteString("\n")
+	}
+}
+
+// block prints a nested block of statements. end is the statement or
+// expression that closes with the block, so comments before its final
+// keyword stay inside the block.
+func (p *printer) block(block *Block, end interface{}) {
+	limit := -1
+	if span, ok := p.program.spans[end]; ok {
+		limit = 2*(span.end-1) + 1
+	}
+	p.nested(block, limit)
+}
+
+// nested prints a nested block of statements followed by the comments
+// before limit, unless it is negative.
+func (p *printer) nested(block *Block, limit int) {
+	p.indent++
+	p.blockStart = true
+	p.statements(block)
+	if limit >= 0 {
+		p.flushComments(limit)
+	}
+	p.indent--
+	p.blockStart = false
+}
+
+// clauseEnds returns the comment limits of the then block of s and of each
+// of its elseif blocks: the comments before the elseif, else or end keyword
+// that follows a block belong to it. A limit is -1 without positions.
+func (p *printer) clauseEnds(s *IfStatement) []int {
+	ends := make([]int, len(s.ElseIfs)+1)
+	span, ok := p.program.spans[s]
+	for i := range ends {
+		ends[i] = -1
+		if !ok {
+			continue
+		}
+		var keyword int
+		switch {
+		case i < len(s.ElseIfs):
+			cond, ok := p.program.spans[s.ElseIfs[i].Condition]
+			if !ok {
+				continue
+			}
+			keyword = cond.start - 1
+			for keyword > span.start && p.program.Tokens[keyword].Type != ELSEIF {
+				keyword--
+			}
+		case s.Else != nil:
+			// An empty else block is directly followed by end.
+			keyword = span.end - 2
+			if block, ok := p.program.spans[s.Else]; ok {
+				keyword = block.start - 1
+			}
+		default:
+			keyword = span.end - 1
+		}
+		ends[i] = 2*keyword + 1
+	}
+	return ends
+}
+
+// opensParen reports whether stmt is printed starting with a parenthesis,
+// as in (f or g)(), which would otherwise continue the statement before it.
+func opensParen(stmt Statement) bool {
+	var expr Expression
+	switch s := stmt.(type) {
+	case *FunctionCallStatement:
+		expr = s.Function
+	case *AssignmentStatement:
+		if len(s.Targets) > 0 {
+			expr = s.Targets[0]
+		}
+	}
+	for expr != nil {
+		switch e := expr.(type) {
+		case *FunctionCall:
+			expr = e.Function
+		case *IndexExpression:
+			expr = e.Object
+		case *MemberExpression:
+			expr = e.Object
+		case *Identifier:
+			return false
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func (p *printer) statement(stmt Statement) {
+	switch s := stmt.(type) {
+	case *AssignmentStatement:
+		switch {
+		case len(s.Targets) > 0:
+			p.expressions(s.Targets)
+		case len(s.Names) > 0:
+			p.names(s.Names)
+		default:
+			p.expressions(s.Values)
+			return
+		}
+		p.sb.WriteString(" = ")
+		p.expressions(s.Values)
+	case *LocalAssignmentStatement:
+		p.sb.WriteString("local ")
+		p.names(s.Names)
+		if len(s.Values) > 0 {
+			p.sb.WriteString(" = ")
+			p.expressions(s.Values)
+		}
+	case *FunctionCallStatement:
+		p.expression(s.Function)
+	case *IfStatement:
+		p.sb.WriteString("if ")
+		p.expression(s.Condition)
+		p.sb.WriteString(" then\n")
+		ends := p.clauseEnds(s)
+		p.nested(s.Then, ends[0])
+		for i, clause := range s.ElseIfs {
+			p.line()
+			p.sb.WriteString("elseif ")
+			p.expression(clause.Condition)
+			p.sb.WriteString(" then\n")
+			p.nested(clause.Then, ends[i+1])
+		}
+		if s.Else != nil {
+			p.line()
+			p.sb.WriteString("else\n")
+			p.block(s.Else, nil)
+		}
+		p.closeBlock(s)
+	case *WhileStatement:
+		p.sb.WriteString("while ")
+		p.expression(s.Condition)
+		p.doBlock(s.Body, s)
+	case *RepeatStatement:
+		p.sb.WriteString("repeat\n")
+		p.block(s.Body, nil)
+		p.line()
+		p.sb.WriteString("until ")
+		p.expression(s.Condition)
+	case *ForNumericStatement:
+		p.sb.WriteString("for " + s.Var.Name + " = ")
+		p.expression(s.Start)
+		p.sb.WriteString(", ")
+		p.expression(s.Limit)
+		if s.Step != nil {
+			p.sb.WriteString(", ")
+			p.expression(s.Step)
+		}
+		p.doBlock(s.Body, s)
+	case *ForInStatement:
+		p.sb.WriteString("for ")
+		p.names(s.Names)
+		p.sb.WriteString(" in ")
+		p.expressions(s.Values)
+		p.doBlock(s.Body, s)
+	case *FunctionStatement:
+		p.sb.WriteString("function ")
+		if s.Name.Name != nil {
+			p.sb.WriteString(s.Name.Name.Name)
+		}
+		if s.Name.Method != "" {
+			p.sb.WriteString(":" + s.Name.Method)
+		}
+		p.function(s.Parameters, s.Body, s)
+	case *LocalFunctionStatement:
+		p.sb.WriteString("local function " + s.Name.Name)
+		p.function(s.Parameters, s.Body, s)
+	case *ReturnStatement:
+		p.sb.WriteString("return")
+		if len(s.Results) > 0 {
+			p.sb.WriteString(" ")
+			p.expressions(s.Results)
+		}
+	case *BreakStatement:
+		p.sb.WriteString("break")
+	case *GotoStatement:
+		p.sb.WriteString("goto " + s.Name)
+	case *LabelStatement:
+		p.sb.WriteString("::" + s.Name + "::")
+	}
+}
+
+// closeBlock prints the end of an if statement, keeping comments written
+// before its final keyword inside the last block.
+func (p *printer) closeBlock(s *IfStatement) {
+	if span, ok := p.program.spans[s]; ok {
+		p.indent++
+		p.flushComments(2*(span.end-1) + 1)
+		p.indent--
+	}
+	p.line()
+	p.sb.WriteString("end")
+}
+
+// doBlock prints the `do ... end` body of a loop.
+func (p *printer) doBlock(body *Block, node interface{}) {
+	p.sb.WriteString(" do")
+	p.body(body, node)
+}
+
+func (p *printer) function(params []*Identifier, body *Block, node interface{}) {
+	p.sb.WriteString("(")
+	p.names(params)
+	p.sb.WriteString(")")
+	p.body(body, node)
+}
+
+// body prints a block closed by `end`, keeping empty blocks on one line.
+func (p *printer) body(body *Block, node interface{}) {
+	if body.Len() == 0 && !p.hasComments(p.program.spans[node]) {
+		p.sb.WriteString(" end")
+		return
+	}
+	p.sb.WriteString("\n")
+	p.block(body, node)
+	p.line()
+	p.sb.WriteString("end")
+}
+
+func (p *printer) names(names []*Identifier) {
+	for i, name := range names {
+		if i > 0 {
+			p.sb.WriteString(", ")
+		}
+		p.sb.WriteString(name.Name)
+	}
+}
+
+func (p *printer) expressions(exprs []Expression) {
+	for i, expr := range exprs {
+		if i > 0 {
+			p.sb.WriteString(", ")
+		}
+		p.operand(expr, i == len(exprs)-1 && truncated(expr))
+	}
+}
+
+// truncated reports whether expr is a call or `...` in parentheses, whose
+// parentheses must be kept where it would otherwise give all its values.
+func truncated(expr Expression) bool {
+	switch e := expr.(type) {
+	case *FunctionCall:
+		return e.Parenthesized
+	case *Identifier:
+		return e.Parenthesized
+	}
+	return false
+}
+
+func (p *printer) expression(expr Expression) {
+	switch e := expr.(type) {
+	case *Identifier:
+		p.sb.WriteString(e.Name)
+	case *NumberLiteral:
+		if raw, ok := p.raw(e); ok {
+			p.sb.WriteString(raw)
+		} else {
+			p.sb.WriteString(formatNumber(e))
+		}
+	case *StringLiteral:
+		if raw, ok := p.raw(e); ok {
+			p.sb.WriteString(raw)
+		} else {
+			p.sb.WriteString(Quote(e.Value))
+		}
+	case *BooleanLiteral:
+		p.sb.WriteString(strconv.FormatBool(e.Value))
+	case *NilLiteral:
+		p.sb.WriteString("nil")
+	case *TableLiteral:
+		p.table(e)
+	case *FunctionLiteral:
+		p.sb.WriteString("function")
+		p.function(e.Parameters, e.Body, e)
+	case *BinaryExpression:
+		priority := binaryPriority[e.Operator]
+		p.operand(e.Left, needsParens(e.Left, priority[0], true))
+		p.sb.WriteString(" " + string(e.Operator) + " ")
+		p.operand(e.Right, needsParens(e.Right, priority[1], false))
+	case *UnaryExpression:
+		p.sb.WriteString(string(e.Operator))
+		if e.Operator == NOT {
+			p.sb.WriteString(" ")
+		}
+		if e.Operator == MINUS && negative(e.Right) {
+			// Keep `- -x` from being read back as a comment.
+			p.sb.WriteString(" ")
+		}
+		p.operand(e.Right, needsParens(e.Right, unaryPriority, false))
+	case *IndexExpression:
+		p.prefix(e.Object)
+		p.sb.WriteString("[")
+		p.expression(e.Index)
+		p.sb.WriteString("]")
+	case *MemberExpression:
+		p.prefix(e.Object)
+		p.sb.WriteString("." + e.Member)
+	case *FunctionCall:
+		p.prefix(e.Function)
+		if e.Method != "" {
+			p.sb.WriteString(":" + e.Method)
+		}
+		p.sb.WriteString("(")
+		p.expressions(e.Arguments)
+		p.sb.WriteString(")")
+	case *TableIndex:
+		p.sb.WriteString("[")
+		p.expression(e.Key)
+		p.sb.WriteString("]")
+	}
+}
+
+func (p *printer) operand(expr Expression, parens bool) {
+	if parens {
+		p.sb.WriteString("(")
+	}
+	p.expression(expr)
+	if parens {
+		p.sb.WriteString(")")
+	}
+}
+
+// prefix prints the object of an index, member access or call, which Lua
+// only accepts unparenthesized when it is itself a name, index or call.
+func (p *printer) prefix(expr Expression) {
+	switch expr.(type) {
+	case *Identifier, *IndexExpression, *MemberExpression, *FunctionCall:
+		p.expression(expr)
+	default:
+		p.operand(expr, true)
+	}
+}
+
+// needsParens reports whether expr must be parenthesized to stay an operand
+// of an operator with the given priority. A left operand is cut short by an
+// operator binding tighter than its own right side; a right operand
+// absorbs only operators binding tighter than the parent.
+func needsParens(expr Expression, priority int, left bool) bool {
+	switch e := expr.(type) {
+	case *BinaryExpression:
+		own := binaryPriority[e.Operator]
+		if left {
+			return priority > own[1]
+		}
+		return own[0] <= priority
+	case *UnaryExpression:
+		return left && priority > unaryPriority
+	}
+	return false
+}
+
+// negative reports whether expr is printed with a leading minus sign.
+func negative(expr Expression) bool {
+	switch e := expr.(type) {
+	case *UnaryExpression:
+		return e.Operator == MINUS
+	case *NumberLiteral:
+		return e.IntValue < 0 || e.Value < 0 || math.IsInf(e.Value, -1)
+	}
+	return false
+}
+
+// raw returns the source spelling of a literal parsed by a lossless parser.
+func (p *printer) raw(node Expression) (string, bool) {
+	span, ok := p.program.spans[node]
+	if !ok || span.end-span.start != 1 {
+		return "", false
+	}
+	return p.program.Tokens[span.start].Raw, true
+}
+
+func (p *printer) table(t *TableLiteral) {
+	span, hasSpan := p.program.spans[t]
+	if len(t.Fields) == 0 && !p.hasComments(span) {
+		p.sb.WriteString("{}")
+		return
+	}
+	if !p.multiline(t, span, hasSpan) {
+		p.sb.WriteString("{")
+		for i, field := range t.Fields {
+			if i > 0 {
+				p.sb.WriteString(", ")
+			}
+			p.field(field, i == len(t.Fields)-1)
+		}
+		p.sb.WriteString("}")
+		return
+	}
+
+	p.sb.WriteString("{\n")
+	p.indent++
+	p.blockStart = true
+	for i, field := range t.Fields {
+		fieldSpan, ok := p.item(field)
+		p.field(field, i == len(t.Fields)-1)
+		p.sb.WriteString(",")
+		if ok && !p.trailingComment(fieldSpan.end-1) {
+			if sep := fieldSpan.end; sep < len(p.program.Tokens) && (p.program.Tokens[sep].Type == COMMA || p.program.Tokens[sep].Type == SEMICOLON) {
+				p.trailingComment(sep)
+			}
+		}
+		p.sb.WriteString("\n")
+	}
+	if hasSpan {
+		p.flushComments(2*(span.end-1) + 1)
+	}
+	p.indent--
+	p.blockStart = false
+	p.line()
+	p.sb.WriteString("}")
+}
+
+// multiline decides the layout of a non-empty table: nested constructors,
+// comments, tables the source already spread over several lines and tables
+// too wide for one line are written one field per line.
+func (p *printer) multiline(t *TableLiteral, span tokenSpan, hasSpan bool) bool {
+	for _, field := range t.Fields {
+		switch v := field.Value.(type) {
+		case *FunctionLiteral:
+			return true
+		case *TableLiteral:
+			if len(v.Fields) > 0 {
+				return true
+			}
+		}
+	}
+	if hasSpan {
+		if p.hasComments(span) {
+			return true
+		}
+		tokens := p.program.Tokens
+		if tokens[span.end-1].Line > tokens[span.start].Line {
+			return true
+		}
+	}
+	inline := &printer{program: p.program, indent: p.indent}
+	inline.sb.WriteString("{")
+	for i, field := range t.Fields {
+		if i > 0 {
+			inline.sb.WriteString(", ")
+		}
+		inline.field(field, i == len(t.Fields)-1)
+	}
+	inline.sb.WriteString("}")
+	text := p.sb.String()
+	column := len(text) - strings.LastIndexByte(text, '\n') - 1
+	return column+inline.sb.Len() > formatWidth
+}
+
+// field prints a table field; last is set for the last field of the table.
+func (p *printer) field(field *TableField, last bool) {
+	switch key := field.Key.(type) {
+	case nil:
+	case *Identifier:
+		p.sb.WriteString(key.Name + " = ")
+	case *TableIndex:
+		p.expression(key)
+		p.sb.WriteString(" = ")
+	default:
+		p.sb.WriteString("[")
+		p.expression(key)
+		p.sb.WriteString("] = ")
+	}
+	p.operand(field.Value, last && field.Key == nil && truncated(field.Value))
+}
+
+func formatNumber(n *NumberLiteral) string {
+	if n.IsInt {
+		return strconv.FormatInt(n.IntValue, 10)
+	}
+	switch {
+	case math.IsInf(n.Value, 1):
+		return "(1/0)"
+	case math.IsInf(n.Value, -1):
+		return "(-1/0)"
+	case math.IsNaN(n.Value):
+		return "(0/0)"
+	}
+	s := strconv.FormatFloat(n.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// nodeString renders n as Lua source without comments.
+func nodeString(n Node) string {
+	p := &printer{program: &Program{}}
+	switch n := n.(type) {
+	case *Program:
+		p.statements(&n.Block)
+	case *Block:
+		p.statements(n)
+	case *ErrorNode:
+		return "<error: " + n.Message + ">"
+	case *ElseIfClause:
+		p.sb.WriteString("elseif ")
+		p.expression(n.Condition)
+		p.sb.WriteString(" then\n")
+		p.block(n.Then, nil)
+	case *FunctionName:
+		if n.Name != nil {
+			p.sb.WriteString(n.Name.Name)
+		}
+		if n.Method != "" {
+			p.sb.WriteString(":" + n.Method)
+		}
+	case *TableField:
+		p.field(n, false)
+	case Statement:
+		p.statement(n)
+	case Expression:
+		p.expression(n)
+	}
+	return strings.TrimSuffix(p.sb.String(), "\n")
+}
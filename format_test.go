@@ -0,0 +1,98 @@
+package luar
+
+import "testing"
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "spacing and statements",
+			src:  "local x=1+2*3;y=x..'s'",
+			want: "local x = 1 + 2 * 3\ny = x .. 's'\n",
+		},
+		{
+			name: "minimal parentheses",
+			src:  "a = ((1+2))*3\nb = x-(y-z)\nc = (x-y)-z\nd = a..(b..c)\ne = (a..b)..c\nf = 2^(3^2)\ng = (2^3)^2\nh = -(-x)\ni = (-2)^2\nj = not (a and b)\nk = (f)(x).y",
+			want: "a = (1 + 2) * 3\nb = x - (y - z)\nc = x - y - z\nd = a .. b .. c\ne = (a .. b) .. c\nf = 2 ^ 3 ^ 2\ng = (2 ^ 3) ^ 2\nh = - -x\ni = (-2) ^ 2\nj = not (a and b)\nk = f(x).y\n",
+		},
+		{
+			name: "truncating parentheses",
+			src:  "function f(...) return (...) end\nx = {(f())}\ny = {(f()), (f()); n = (f())}\nlocal a, b = (f()), (f())\ng((f()))\nz = (f()) + (...)",
+			want: "function f(...)\n    return (...)\nend\nx = {(f())}\ny = {f(), f(), n = f()}\nlocal a, b = f(), (f())\ng((f()))\nz = f() + ...\n",
+		},
+		{
+			name: "tables",
+			src:  "t={1,2;3,}\ne = { }\nn={a={b=1}}\nm={x=1,\ny=2}",
+			want: "t = {1, 2, 3}\ne = {}\nn = {\n    a = {b = 1},\n}\nm = {\n    x = 1,\n    y = 2,\n}\n",
+		},
+		{
+			name: "control flow",
+			src:  "if a then b() elseif c then d() else e() end\nwhile x do x=x-1 end\nrepeat x=x+1 until x>3\nfor i=1,3 do end\nfor k,v in pairs(t) do print(k,v) end",
+			want: "if a then\n    b()\nelseif c then\n    d()\nelse\n    e()\nend\nwhile x do\n    x = x - 1\nend\nrepeat\n    x = x + 1\nuntil x > 3\nfor i = 1, 3 do end\nfor k, v in pairs(t) do\n    print(k, v)\nend\n",
+		},
+		{
+			name: "comments in else",
+			src:  "if a then -- c1\nelse -- c2\nend\nif b then\n-- c3\nelseif c then\n-- c4\nelse\n-- c5\nend\nif d then x() else end",
+			want: "if a then\n    -- c1\nelse\n    -- c2\nend\nif b then\n    -- c3\nelseif c then\n    -- c4\nelse\n    -- c5\nend\nif d then\n    x()\nelse\nend\n",
+		},
+		{
+			name: "semicolons",
+			src:  "local x = f; (g or h)()\ny = 1; (\"s\"):upper();;",
+			want: "local x = f\n;(g or h)()\ny = 1\n;(\"s\"):upper()\n",
+		},
+		{
+			name: "functions",
+			src:  "function M.a:b(x,...) return ... end\nlocal function f() end\ncb=function(x) return x end",
+			want: "function M.a:b(x, ...)\n    return ...\nend\nlocal function f() end\ncb = function(x)\n    return x\nend\n",
+		},
+		{
+			name: "comments and blank lines",
+			src:  "-- header\n\n\nname=\"app\"   -- the name\ncfg={ -- settings\nport=80, -- port\n-- last\n}\n\n\n-- footer\n",
+			want: "-- header\n\nname = \"app\" -- the name\ncfg = {\n    -- settings\n    port = 80, -- port\n    -- last\n}\n\n-- footer\n",
+		},
+		{
+			name: "literal spelling",
+			src:  "x=0xFF y=1e3 z=[[long]]",
+			want: "x = 0xFF\ny = 1e3\nz = [[long]]\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Format([]byte(tt.src))
+			if err != nil {
+				t.Fatalf("Format() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Format() =\n%s\nwant:\n%s", got, tt.want)
+			}
+			again, err := Format(got)
+			if err != nil {
+				t.Fatalf("Format() of formatted output error = %v", err)
+			}
+			if string(again) != string(got) {
+				t.Errorf("Format() is not idempotent:\n%s", again)
+			}
+		})
+	}
+}
+
+func TestFormat_ParseError(t *testing.T) {
+	if _, err := Format([]byte("x = = 1")); err == nil {
+		t.Error("expected an error for invalid source")
+	}
+}
+
+func TestFormatProgram_NonLossless(t *testing.T) {
+	program, err := NewParser(`s = "a\"b" f = 2.0 t = {1, "x"}`).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "s = \"a\\\"b\"\nf = 2.0\nt = {1, \"x\"}\n"
+	if got := FormatProgram(program); got != want {
+		t.Errorf("FormatProgram() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,363 @@
+package luar
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Func is a Go function that a config can call with the raw Lua arguments.
+// A non-nil error is reported at the position of the call.
+type Func func(args []Value) ([]Value, error)
+
+var (
+	funcType  = reflect.TypeOf(Func(nil))
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	tableType = reflect.TypeOf((*Table)(nil))
+)
+
+// RegisterFunc makes fn callable from the config as name. A dotted name such
+// as "vault.secret" stores the function in a global table, creating it as
+// needed.
+//
+// fn is either a Func, or a func(args []Value) ([]Value, error), which is
+// called as is, or any other Go function, whose arguments are converted from
+// Lua values like decoded fields and whose results are converted to Lua
+// values. A final error result is raised as an error instead of returned.
+func (d *Decoder) RegisterFunc(name string, fn interface{}) error {
+	if name == "" {
+		return fmt.Errorf("luar: empty function name")
+	}
+	for _, part := range strings.Split(name, ".") {
+		if !isIdentifier(part) {
+			return fmt.Errorf("luar: invalid function name %q", name)
+		}
+	}
+
+	f, err := d.function(name, fn)
+	if err != nil {
+		return err
+	}
+	if d.funcs == nil {
+		d.funcs = make(map[string]*goFunction)
+	}
+	d.funcs[name] = f
+	return nil
+}
+
+// function converts fn to a Lua function named name, as RegisterFunc and
+// the conversion of function results do.
+func (d *Decoder) function(name string, fn interface{}) (*goFunction, error) {
+	var f Func
+	switch v := fn.(type) {
+	case Func:
+		f = v
+	case func([]Value) ([]Value, error):
+		f = v
+	default:
+		rv := reflect.ValueOf(fn)
+		if rv.Kind() != reflect.Func || rv.IsNil() {
+			return nil, fmt.Errorf("luar: cannot register %T as function %q", fn, name)
+		}
+		f = d.wrapFunc(name, rv)
+	}
+	if f == nil {
+		return nil, fmt.Errorf("luar: cannot register nil function %q", name)
+	}
+	return &goFunction{name: name, fn: recovering(name, f)}, nil
+}
+
+// recovering returns f with a panic turned into an error, so that a faulty
+// function fails the chunk instead of the program decoding it.
+func recovering(name string, f Func) Func {
+	return func(args []Value) (results []Value, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				results, err = nil, fmt.Errorf("'%s' panicked: %v", name, r)
+			}
+		}()
+		return f(args)
+	}
+}
+
+// define stores the registered functions in the globals of in, in the order
+// of their names.
+func (d *Decoder) define(in *interpreter) {
+	names := make([]string, 0, len(d.funcs))
+	for name := range d.funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fn := d.funcs[name]
+		path := strings.Split(name, ".")
+		table := in.globals
+		for _, key := range path[:len(path)-1] {
+			next, ok := table.Get(key).(*Table)
+			if !ok {
+				next = NewTable()
+				table.Set(key, next)
+			}
+			table = next
+		}
+		table.Set(path[len(path)-1], fn)
+	}
+}
+
+// wrapFunc adapts an arbitrary Go function to a Func by converting its
+// arguments and results.
+func (d *Decoder) wrapFunc(name string, fn reflect.Value) Func {
+	t := fn.Type()
+	numIn := t.NumIn()
+	returnsError := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+
+	return func(args []Value) ([]Value, error) {
+		// A variadic function takes its fixed parameters and then only the
+		// extra arguments actually passed.
+		n := numIn
+		if t.IsVariadic() {
+			n = numIn - 1
+			if len(args) > n {
+				n = len(args)
+			}
+		}
+		in := make([]reflect.Value, 0, n)
+		for i := 0; i < n; i++ {
+			var typ reflect.Type
+			if t.IsVariadic() && i >= numIn-1 {
+				typ = t.In(numIn - 1).Elem()
+			} else {
+				typ = t.In(i)
+			}
+			arg := reflect.New(typ).Elem()
+			if err := d.setArg(arg, at(args, i)); err != nil {
+				return nil, fmt.Errorf("bad argument #%d to '%s' (%v)", i+1, name, err)
+			}
+			in = append(in, arg)
+		}
+
+		out := fn.Call(in)
+		if returnsError {
+			if err := out[len(out)-1]; !err.IsNil() {
+				return nil, err.Interface().(error)
+			}
+			out = out[:len(out)-1]
+		}
+		results := make([]Value, len(out))
+		for i, v := range out {
+			r, err := d.fromGo(v)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = r
+		}
+		return results, nil
+	}
+}
+
+// setArg converts a Lua argument to the Go parameter v. Unlike setValue it
+// rejects values of the wrong type.
+func (d *Decoder) setArg(v reflect.Value, val Value) error {
+	expected := ""
+	switch v.Type() {
+	case tableType:
+		if t, ok := val.(*Table); ok || val == nil {
+			v.Set(reflect.ValueOf(t))
+			return nil
+		}
+		expected = "table"
+	case durationType:
+		if _, ok := val.(string); !ok && !isNumber(val) {
+			expected = "duration"
+		}
+	case timeType:
+		if _, ok := val.(string); !ok && !isNumber(val) {
+			expected = "time"
+		}
+	default:
+		switch v.Kind() {
+		case reflect.Interface:
+			// Interfaces such as Value receive the Lua value as is.
+			if val != nil && reflect.TypeOf(val).AssignableTo(v.Type()) {
+				v.Set(reflect.ValueOf(val))
+				return nil
+			}
+		case reflect.String:
+			if s, ok := toStr(val); ok {
+				v.SetString(s)
+				return nil
+			}
+			expected = "string"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, ok := toNumber(val)
+			if !ok {
+				expected = "number"
+				break
+			}
+			if _, ok := toInteger(n); !ok {
+				return fmt.Errorf("number has no integer representation")
+			}
+		case reflect.Float32, reflect.Float64:
+			n, ok := toNumber(val)
+			if !ok {
+				expected = "number"
+				break
+			}
+			v.SetFloat(toFloat(n))
+			return nil
+		case reflect.Bool:
+			v.SetBool(truthy(val))
+			return nil
+		case reflect.Slice, reflect.Map, reflect.Struct:
+			if _, ok := val.(*Table); !ok && val != nil {
+				expected = "table"
+			}
+		}
+	}
+	if expected != "" {
+		return fmt.Errorf("%s expected, got %s", expected, typeName(val))
+	}
+	if n, ok := toNumber(val); ok && v.Kind() != reflect.Interface {
+		val = n
+	}
+	return d.setValue(v, val)
+}
+
+// fromGo converts a Go value to a Lua value: numbers, strings and booleans
+// directly, slices and arrays to sequences, maps and structs to tables, and
+// functions like RegisterFunc does. Struct fields are named like the encoder
+// names them. A value that refers back to itself fails with a *CycleError.
+func (d *Decoder) fromGo(v reflect.Value) (Value, error) {
+	return d.luaValue(v, make(map[seenKey]bool))
+}
+
+func (d *Decoder) luaValue(v reflect.Value, visiting map[seenKey]bool) (Value, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	switch v.Type() {
+	case tableType:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return v.Interface().(*Table), nil
+	case durationType:
+		return time.Duration(v.Int()).String(), nil
+	case timeType:
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		key := seenKey{ptr: v.Pointer(), typ: v.Type()}
+		if v.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+		if visiting[key] {
+			return nil, &CycleError{Type: v.Type()}
+		}
+		visiting[key] = true
+		defer delete(visiting, key)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if fn, ok := v.Interface().(*closure); ok && fn != nil {
+			return fn, nil
+		}
+		if fn, ok := v.Interface().(*goFunction); ok && fn != nil {
+			return fn, nil
+		}
+		if v.IsNil() {
+			return nil, nil
+		}
+		return d.luaValue(v.Elem(), visiting)
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := v.Uint(); u <= math.MaxInt64 {
+			return int64(u), nil
+		}
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Slice, reflect.Array:
+		t := NewTable()
+		for i := 0; i < v.Len(); i++ {
+			e, err := d.luaValue(v.Index(i), visiting)
+			if err != nil {
+				return nil, err
+			}
+			t.Set(int64(i+1), e)
+		}
+		return t, nil
+	case reflect.Map:
+		t := NewTable()
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			switch a, b := keys[i], keys[j]; {
+			case a.CanInt():
+				return a.Int() < b.Int()
+			case a.CanUint():
+				return a.Uint() < b.Uint()
+			}
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, k := range keys {
+			key, err := d.luaValue(k, visiting)
+			if err != nil {
+				return nil, err
+			}
+			if key == nil {
+				continue
+			}
+			e, err := d.luaValue(v.MapIndex(k), visiting)
+			if err != nil {
+				return nil, err
+			}
+			t.Set(key, e)
+		}
+		return t, nil
+	case reflect.Struct:
+		t := NewTable()
+		typ := v.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := field.Tag.Get("lua")
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			e, err := d.luaValue(v.Field(i), visiting)
+			if err != nil {
+				return nil, err
+			}
+			t.Set(name, e)
+		}
+		return t, nil
+	case reflect.Func:
+		if v.IsNil() {
+			return nil, nil
+		}
+		fn := v.Interface()
+		if v.Type().ConvertibleTo(funcType) {
+			fn = v.Convert(funcType).Interface()
+		}
+		// A function has no name of its own; Lua reports it as '?'.
+		return d.function("?", fn)
+	}
+	return nil, nil
+}
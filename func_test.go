@@ -0,0 +1,206 @@
+package luar
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoder_RegisterFunc(t *testing.T) {
+	type Config struct {
+		Password string            `lua:"password"`
+		Host     string            `lua:"host"`
+		Workers  int               `lua:"workers"`
+		Sum      float64           `lua:"sum"`
+		Joined   string            `lua:"joined"`
+		Alone    string            `lua:"alone"`
+		Total    int               `lua:"total"`
+		Empty    int               `lua:"empty"`
+		Pair     []int             `lua:"pair"`
+		Labels   map[string]string `lua:"labels"`
+		Raw      int               `lua:"raw"`
+	}
+	src := `
+password = vault.secret("db/password")
+host = hostname()
+workers = cpu_count() * 2
+sum = add(1, 2.5)
+joined = join("-", "a", "b", 3)
+alone = join("-") .. "|"
+total = add_all(1, 2, 3)
+empty = add_all()
+pair = {swap(1, 2)}
+labels = labels({app = "api"})
+raw = count(nil, false, {})
+`
+	dec := NewDecoder(strings.NewReader(src))
+	funcs := map[string]interface{}{
+		"vault.secret": func(path string) (string, error) { return "s3cret:" + path, nil },
+		"hostname":     func() string { return "web-1" },
+		"cpu_count":    func() int { return 4 },
+		"add":          func(a, b float64) float64 { return a + b },
+		"join":         func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+		"add_all": func(ns ...int) int {
+			total := 0
+			for _, n := range ns {
+				total += n
+			}
+			return total
+		},
+		"swap": func(a, b int) (int, int) { return b, a },
+		"labels": func(m map[string]string) map[string]string {
+			m["env"] = "prod"
+			return m
+		},
+		"count": func(args []Value) ([]Value, error) { return []Value{int64(len(args))}, nil },
+	}
+	for name, fn := range funcs {
+		if err := dec.RegisterFunc(name, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		Password: "s3cret:db/password",
+		Host:     "web-1",
+		Workers:  8,
+		Sum:      3.5,
+		Joined:   "a-b-3",
+		Alone:    "|",
+		Total:    6,
+		Pair:     []int{2, 1},
+		Labels:   map[string]string{"app": "api", "env": "prod"},
+		Raw:      3,
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+}
+
+var errNotFound = errors.New("not found")
+
+func TestDecoder_RegisterFuncErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"x = 1\nx = secret('missing')", "luar: line 2: secret missing: not found"},
+		{"x = secret(1)", ""},
+		{"x = secret({})", "luar: line 1: bad argument #1 to 'secret' (string expected, got table)"},
+		{"x = double(1.5)", "bad argument #1 to 'double' (number has no integer representation)"},
+		{"x = double('a')", "bad argument #1 to 'double' (number expected, got string)"},
+		{"x = keys(5)", "bad argument #1 to 'keys' (table expected, got number)"},
+		{"x = 1\nx = boom()", "luar: line 2: 'boom' panicked: kaboom"},
+		{"ok, msg = pcall(boom)\nassert(not ok)", ""},
+		{"x = callback()(20)\nassert(x == 21)", ""},
+		{"x = 1\nx = failing()()", "luar: line 2: '?' panicked: kaboom"},
+		{"x = loop()", "encountered a cycle via *luar.node"},
+	}
+	for _, tt := range tests {
+		dec := NewDecoder(strings.NewReader(tt.src))
+		dec.RegisterFunc("secret", func(name string) (string, error) {
+			if name == "missing" {
+				return "", fmt.Errorf("secret %s: %w", name, errNotFound)
+			}
+			return name, nil
+		})
+		dec.RegisterFunc("double", func(n int) int { return n * 2 })
+		dec.RegisterFunc("keys", func(m map[string]int) int { return len(m) })
+		dec.RegisterFunc("boom", func() int { panic("kaboom") })
+		dec.RegisterFunc("callback", func() func(int) int { return func(n int) int { return n + 1 } })
+		dec.RegisterFunc("failing", func() func() { return func() { panic("kaboom") } })
+		dec.RegisterFunc("loop", func() *node {
+			n := &node{}
+			n.Next = n
+			return n
+		})
+		dec.OpenLibs(LibBase)
+
+		var cfg struct{}
+		err := dec.Decode(&cfg)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error %v", tt.src, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.src, err, tt.want)
+		}
+	}
+
+	dec := NewDecoder(strings.NewReader("x = secret('missing')"))
+	dec.RegisterFunc("secret", func(string) (string, error) { return "", errNotFound })
+	var rerr *RuntimeError
+	if err := dec.Decode(&struct{}{}); !errors.Is(err, errNotFound) || !errors.As(err, &rerr) || rerr.Pos.Line != 1 {
+		t.Errorf("got %v, want a RuntimeError wrapping errNotFound", err)
+	}
+
+	for _, name := range []string{"", "a b", "a.", "1x"} {
+		if err := dec.RegisterFunc(name, func() {}); err == nil {
+			t.Errorf("RegisterFunc(%q) succeeded", name)
+		}
+	}
+	if err := dec.RegisterFunc("x", 42); err == nil {
+		t.Error("RegisterFunc accepted a non-function")
+	}
+}
+
+type node struct {
+	Next *node
+}
+
+func TestFromGo(t *testing.T) {
+	type S struct {
+		Name  string `lua:"name"`
+		Count int
+		skip  bool
+	}
+	d := NewDecoder(nil)
+	got, err := d.fromGo(reflect.ValueOf(S{Name: "a", Count: 2}))
+	tbl, ok := got.(*Table)
+	if err != nil || !ok || tbl.Get("name") != "a" || tbl.Get("count") != int64(2) || tbl.Get("skip") != nil {
+		v, _ := toGo(got)
+		t.Errorf("got %#v", v)
+	}
+	for _, tt := range []struct {
+		in   interface{}
+		want Value
+	}{
+		{uint8(7), int64(7)},
+		{float32(1.5), 1.5},
+		{(*int)(nil), nil},
+		{[]string(nil), nil},
+	} {
+		if got, err := d.fromGo(reflect.ValueOf(tt.in)); err != nil || got != tt.want {
+			t.Errorf("fromGo(%#v) = %#v, %v, want %#v", tt.in, got, err, tt.want)
+		}
+	}
+
+	// Integer keys are inserted in numeric order.
+	got, _ = d.fromGo(reflect.ValueOf(map[int]bool{10: true, 2: true, -1: true}))
+	if keys := got.(*Table).Keys(); !reflect.DeepEqual(keys, []Value{int64(-1), int64(2), int64(10)}) {
+		t.Errorf("got keys %v", keys)
+	}
+
+	// Shared values are converted twice, cycles fail.
+	shared := &node{}
+	if _, err := d.fromGo(reflect.ValueOf([]*node{shared, shared})); err != nil {
+		t.Errorf("shared pointer: %v", err)
+	}
+	m := map[string]interface{}{}
+	m["self"] = m
+	list := []interface{}{nil}
+	list[0] = list
+	var cycleErr *CycleError
+	for _, v := range []interface{}{m, list} {
+		if _, err := d.fromGo(reflect.ValueOf(v)); !errors.As(err, &cycleErr) {
+			t.Errorf("%T: expected CycleError, got %v", v, err)
+		}
+	}
+}
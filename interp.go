@@ -0,0 +1,1325 @@
+package luar
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RuntimeError reports an error raised while running a chunk, such as
+// arithmetic on nil or indexing a number, with the position of the
+// expression or statement that raised it. Err holds the error returned by a
+// Go function, if that is what failed.
+type RuntimeError struct {
+	Pos Position
+	Msg string
+	Err error
+
+	// raised is set for errors raised by Lua's error function, with the
+	// error value in value.
+	raised bool
+	value  Value
+}
+
+func (e *RuntimeError) Error() string {
+	return limitMessage(e.Pos, e.Msg)
+}
+
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// interpreter runs a chunk against a table of globals.
+type interpreter struct {
+	globals *Table
+	depth   int
+
+	// opts holds the limits of the run, and steps and memory what it has
+	// used of them. ctx is nil unless the run can be canceled.
+	opts   DecoderOptions
+	steps  int64
+	memory int64
+	ctx    context.Context
+
+	// file is the file being run, empty for the main chunk, and the
+	// remaining fields hold the state of require, dofile and include.
+	file   string
+	loader *loader
+
+	// strings holds the methods of string values, if the string library
+	// is open.
+	strings *Table
+
+	// site is the call being made to a Go function.
+	site Node
+
+	// jump is the break or goto statement being handled, and results and
+	// ret the values and statement of the return being handled.
+	jump    Statement
+	results []Value
+	ret     *ReturnStatement
+}
+
+func newInterpreter() *interpreter {
+	return &interpreter{globals: NewTable()}
+}
+
+// control tells how a statement finished: normally, or by a break, goto or
+// return that an enclosing statement has to handle.
+type control int
+
+const (
+	ctlNext control = iota
+	ctlBreak
+	ctlGoto
+	ctlReturn
+)
+
+// maxCallDepth limits how deeply calls may nest, so that runaway recursion
+// in a config fails with an error instead of exhausting the Go stack.
+const maxCallDepth = 200
+
+// closure is a Lua function: a function literal or statement together with
+// the scope it was created in, whose locals it shares as upvalues, and the
+// file it was defined in.
+type closure struct {
+	name   string
+	params []*Identifier
+	vararg bool
+	body   *Block
+	env    *scope
+	file   string
+}
+
+func (in *interpreter) newClosure(name string, params []*Identifier, body *Block, env *scope) *closure {
+	vars := variables(params)
+	return &closure{name: name, params: vars, vararg: len(vars) < len(params), body: body, env: env, file: in.file}
+}
+
+// goFunction is a function implemented in Go.
+type goFunction struct {
+	name string
+	fn   func(args []Value) ([]Value, error)
+}
+
+// scope is a chain of local variable declarations. Every declaration adds a
+// link holding the variables it declares, so a closure sees exactly the
+// locals in scope where it was created, and variables are stored by pointer
+// so that every closure capturing a local shares it. The link starting a
+// function call is marked and holds the call's extra arguments.
+type scope struct {
+	vars    map[string]*Value
+	parent  *scope
+	fn      bool
+	varargs []Value
+}
+
+func (s *scope) lookup(name string) *Value {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// declare returns a scope that adds the local name with value v to s.
+func (s *scope) declare(name string, v Value) *scope {
+	return &scope{vars: map[string]*Value{name: &v}, parent: s}
+}
+
+// declareAll returns a scope that adds the locals names to s, with the
+// matching values or nil.
+func (s *scope) declareAll(names []*Identifier, values []Value) *scope {
+	vars := make(map[string]*Value, len(names))
+	for i, name := range names {
+		v := at(values, i)
+		vars[name.Name] = &v
+	}
+	return &scope{vars: vars, parent: s}
+}
+
+// kind tells whether name is a local of the current function, an upvalue
+// from an enclosing function or a global.
+func (s *scope) kind(name string) string {
+	kind := "local"
+	for ; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok {
+			return kind
+		}
+		if s.fn {
+			kind = "upvalue"
+		}
+	}
+	return "global"
+}
+
+// function returns the scope of the innermost function call.
+func (s *scope) function() *scope {
+	for s != nil && !s.fn {
+		s = s.parent
+	}
+	return s
+}
+
+func (in *interpreter) errorf(n Node, format string, args ...interface{}) error {
+	return &RuntimeError{Pos: in.pos(n), Msg: fmt.Sprintf(format, args...)}
+}
+
+// pos returns the position of n in the file being run.
+func (in *interpreter) pos(n Node) Position {
+	var pos Position
+	if n != nil {
+		pos = n.Pos()
+	}
+	pos.Filename = in.file
+	return pos
+}
+
+// run executes program. When the chunk returns, it sets in.ret and returns
+// the returned values, which are then non-nil even if there are none.
+func (in *interpreter) run(program *Program) ([]Value, error) {
+	ctl, err := in.execBlock(&program.Block, &scope{fn: true, varargs: []Value{}})
+	if err == nil {
+		err = in.escaped(ctl)
+	}
+	if err != nil || ctl != ctlReturn {
+		in.ret = nil
+		return nil, err
+	}
+	return in.results, nil
+}
+
+// escaped reports a break or goto that left a chunk or function body
+// without finding its loop or label.
+func (in *interpreter) escaped(ctl control) error {
+	switch ctl {
+	case ctlBreak:
+		return in.errorf(in.jump, "break outside a loop")
+	case ctlGoto:
+		return in.errorf(in.jump, "no visible label '%s' for goto", in.jump.(*GotoStatement).Name)
+	}
+	return nil
+}
+
+func (in *interpreter) execBlock(block *Block, sc *scope) (control, error) {
+	ctl, _, err := in.execIn(block, sc)
+	return ctl, err
+}
+
+// execIn runs block in the scope sc and returns the scope at the point the
+// block finished. A goto to a label of the block jumps to it, back in the
+// scope of the label; any other break, goto or return is passed on to the
+// caller.
+func (in *interpreter) execIn(block *Block, sc *scope) (control, *scope, error) {
+	scopes := make([]*scope, len(block.Statements))
+	for i := 0; i < len(block.Statements); i++ {
+		scopes[i] = sc
+		ctl := ctlNext
+		err := in.step(block.Statements[i])
+		if err != nil {
+			return ctl, sc, err
+		}
+		switch s := block.Statements[i].(type) {
+		case *LocalAssignmentStatement:
+			var values []Value
+			if values, err = in.evalMulti(s.Values, sc); err == nil {
+				sc = sc.declareAll(s.Names, values)
+			}
+		case *LocalFunctionStatement:
+			// The closure captures the scope declaring its own name, so
+			// the function can recurse.
+			sc = sc.declare(s.Name.Name, nil)
+			*sc.vars[s.Name.Name] = in.newClosure(s.Name.Name, s.Parameters, s.Body, sc)
+		default:
+			ctl, err = in.exec(s, sc)
+		}
+		if err != nil {
+			return ctl, sc, err
+		}
+		if ctl == ctlGoto {
+			if j := findLabel(block, in.jump.(*GotoStatement).Name); j >= 0 {
+				if scopes[j] != nil {
+					sc = scopes[j]
+				}
+				i = j
+				continue
+			}
+		}
+		if ctl != ctlNext {
+			return ctl, sc, nil
+		}
+	}
+	if block.Return != nil {
+		results, err := in.evalMulti(block.Return.Results, sc)
+		if err != nil {
+			return ctlNext, sc, err
+		}
+		in.results, in.ret = results, block.Return
+		return ctlReturn, sc, nil
+	}
+	return ctlNext, sc, nil
+}
+
+func findLabel(block *Block, name string) int {
+	for i, stmt := range block.Statements {
+		if label, ok := stmt.(*LabelStatement); ok && label.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// endLoop reports whether a loop body that finished with ctl ends the loop,
+// and how the loop statement itself finishes: a break just ends the loop,
+// while a goto or return carries on outwards.
+func endLoop(ctl control) (control, bool) {
+	switch ctl {
+	case ctlNext:
+		return ctlNext, false
+	case ctlBreak:
+		return ctlNext, true
+	}
+	return ctl, true
+}
+
+func (in *interpreter) exec(stmt Statement, sc *scope) (control, error) {
+	switch s := stmt.(type) {
+	case *AssignmentStatement:
+		return ctlNext, in.execAssignment(s, sc)
+	case *FunctionCallStatement:
+		_, err := in.evalCall(s.Function, sc)
+		return ctlNext, err
+	case *FunctionStatement:
+		return ctlNext, in.execFunction(s, sc)
+	case *IfStatement:
+		return in.execIf(s, sc)
+	case *WhileStatement:
+		return in.execWhile(s, sc)
+	case *RepeatStatement:
+		return in.execRepeat(s, sc)
+	case *ForNumericStatement:
+		return in.execForNumeric(s, sc)
+	case *ForInStatement:
+		return in.execForIn(s, sc)
+	case *BreakStatement:
+		in.jump = s
+		return ctlBreak, nil
+	case *GotoStatement:
+		in.jump = s
+		return ctlGoto, nil
+	case *ErrorNode:
+		return ctlNext, in.errorf(s, "%s", s.Message)
+	}
+	return ctlNext, nil
+}
+
+// execFunction assigns the function of a function statement to its name,
+// which may be a field path such as a.b.c or a method a.b:m with an
+// implicit self parameter.
+func (in *interpreter) execFunction(s *FunctionStatement, sc *scope) error {
+	path := strings.Split(s.Name.Name.Name, ".")
+	params := s.Parameters
+	name := s.Name.Name.Name
+	if s.Name.Method != "" {
+		path = append(path, s.Name.Method)
+		params = append([]*Identifier{{Name: "self"}}, params...)
+		name += ":" + s.Name.Method
+	}
+	fn := in.newClosure(name, params, s.Body, sc)
+	if len(path) == 1 {
+		return in.setVariable(s.Name, path[0], fn, sc)
+	}
+
+	var obj Value
+	if local := sc.lookup(path[0]); local != nil {
+		obj = *local
+	} else {
+		obj = in.globals.Get(path[0])
+	}
+	for i, key := range path[1:] {
+		table, ok := obj.(*Table)
+		if !ok {
+			desc := fmt.Sprintf(" (field '%s')", path[i])
+			if i == 0 {
+				desc = fmt.Sprintf(" (%s '%s')", sc.kind(path[0]), path[0])
+			}
+			return in.errorf(s.Name, "attempt to index a %s value%s", typeName(obj), desc)
+		}
+		if i == len(path)-2 {
+			return in.set(s.Name, table, key, fn)
+		}
+		obj = table.Get(key)
+	}
+	return nil
+}
+
+func (in *interpreter) execIf(s *IfStatement, sc *scope) (control, error) {
+	cond, err := in.eval(s.Condition, sc)
+	if err != nil {
+		return ctlNext, err
+	}
+	if truthy(cond) {
+		return in.execBlock(s.Then, sc)
+	}
+	for _, clause := range s.ElseIfs {
+		cond, err := in.eval(clause.Condition, sc)
+		if err != nil {
+			return ctlNext, err
+		}
+		if truthy(cond) {
+			return in.execBlock(clause.Then, sc)
+		}
+	}
+	if s.Else != nil {
+		return in.execBlock(s.Else, sc)
+	}
+	return ctlNext, nil
+}
+
+func (in *interpreter) execWhile(s *WhileStatement, sc *scope) (control, error) {
+	for {
+		if err := in.step(s); err != nil {
+			return ctlNext, err
+		}
+		cond, err := in.eval(s.Condition, sc)
+		if err != nil || !truthy(cond) {
+			return ctlNext, err
+		}
+		ctl, err := in.execBlock(s.Body, sc)
+		if err != nil {
+			return ctl, err
+		}
+		if ctl, done := endLoop(ctl); done {
+			return ctl, nil
+		}
+	}
+}
+
+// execRepeat runs a repeat loop. The condition is evaluated in the scope of
+// the body, so it can refer to the body's locals.
+func (in *interpreter) execRepeat(s *RepeatStatement, sc *scope) (control, error) {
+	for {
+		if err := in.step(s); err != nil {
+			return ctlNext, err
+		}
+		ctl, body, err := in.execIn(s.Body, sc)
+		if err != nil {
+			return ctl, err
+		}
+		if ctl, done := endLoop(ctl); done {
+			return ctl, nil
+		}
+		cond, err := in.eval(s.Condition, body)
+		if err != nil || truthy(cond) {
+			return ctlNext, err
+		}
+	}
+}
+
+func (in *interpreter) execAssignment(s *AssignmentStatement, sc *scope) error {
+	targets := s.Targets
+	if len(targets) == 0 {
+		for _, name := range s.Names {
+			targets = append(targets, name)
+		}
+	}
+	values, err := in.evalMulti(s.Values, sc)
+	if err != nil || len(targets) == 0 {
+		return err
+	}
+
+	// Lua evaluates every expression before assigning any target.
+	type slot struct {
+		table *Table
+		key   Value
+	}
+	slots := make([]slot, len(targets))
+	for i, target := range targets {
+		var obj, key Value
+		switch t := target.(type) {
+		case *Identifier:
+			continue
+		case *MemberExpression:
+			if obj, err = in.eval(t.Object, sc); err != nil {
+				return err
+			}
+			key = t.Member
+		case *IndexExpression:
+			if obj, err = in.eval(t.Object, sc); err != nil {
+				return err
+			}
+			if key, err = in.eval(t.Index, sc); err != nil {
+				return err
+			}
+		default:
+			return in.errorf(target, "cannot assign to %s", target.NodeType())
+		}
+		table, ok := obj.(*Table)
+		if !ok {
+			return in.errorf(target, "attempt to index a %s value%s", typeName(obj), describe(objectOf(target), sc))
+		}
+		if err := checkKey(key); err != nil {
+			return in.errorf(target, "%v", err)
+		}
+		slots[i] = slot{table, key}
+	}
+
+	for i, target := range targets {
+		value := at(values, i)
+		if ident, ok := target.(*Identifier); ok {
+			err = in.setVariable(target, ident.Name, value, sc)
+		} else {
+			err = in.set(target, slots[i].table, slots[i].key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *interpreter) setVariable(n Node, name string, v Value, sc *scope) error {
+	if local := sc.lookup(name); local != nil {
+		*local = v
+		return nil
+	}
+	return in.set(n, in.globals, name, v)
+}
+
+// execForNumeric runs a numeric for loop with Lua 5.4 semantics: the loop is
+// an integer loop when the start and step are integers, with a float limit
+// clipped to the integers, and a float loop otherwise.
+func (in *interpreter) execForNumeric(s *ForNumericStatement, sc *scope) (control, error) {
+	start, err := in.forValue(s.Start, "initial", sc)
+	if err != nil {
+		return ctlNext, err
+	}
+	limit, err := in.forValue(s.Limit, "limit", sc)
+	if err != nil {
+		return ctlNext, err
+	}
+	var step Value = int64(1)
+	if s.Step != nil {
+		if step, err = in.forValue(s.Step, "step", sc); err != nil {
+			return ctlNext, err
+		}
+	}
+
+	// body runs one iteration with a fresh loop variable and reports
+	// whether the loop ends there.
+	var ctl control
+	body := func(v Value) bool {
+		if err = in.step(s); err != nil {
+			return true
+		}
+		ctl, err = in.execBlock(s.Body, sc.declare(s.Var.Name, v))
+		if err != nil {
+			return true
+		}
+		var done bool
+		ctl, done = endLoop(ctl)
+		return done
+	}
+
+	i0, startInt := start.(int64)
+	st, stepInt := step.(int64)
+	if startInt && stepInt {
+		if st == 0 {
+			return ctlNext, in.errorf(s.Step, "'for' step is zero")
+		}
+		lim, run := forLimit(limit, st)
+		if !run || (st > 0 && i0 > lim) || (st < 0 && i0 < lim) {
+			return ctlNext, nil
+		}
+		// Count the iterations up front so the control variable never
+		// overflows.
+		var count uint64
+		if st > 0 {
+			count = (uint64(lim) - uint64(i0)) / uint64(st)
+		} else {
+			count = (uint64(i0) - uint64(lim)) / (uint64(-(st + 1)) + 1)
+		}
+		for i := i0; !body(i) && count > 0; i += st {
+			count--
+		}
+		return ctl, err
+	}
+
+	f0, fl, fs := toFloat(start), toFloat(limit), toFloat(step)
+	if fs == 0 {
+		return ctlNext, in.errorf(s.Step, "'for' step is zero")
+	}
+	for f := f0; (fs > 0 && f <= fl) || (fs < 0 && f >= fl); f += fs {
+		if body(f) {
+			break
+		}
+	}
+	return ctl, err
+}
+
+// execForIn runs a generic for loop: it calls the iterator function with
+// the state and the control value until the iterator's first result is nil.
+func (in *interpreter) execForIn(s *ForInStatement, sc *scope) (control, error) {
+	values, err := in.evalMulti(s.Values, sc)
+	if err != nil {
+		return ctlNext, err
+	}
+	iter, state, ctrl := at(values, 0), at(values, 1), at(values, 2)
+	for {
+		results, err := in.call(s, iter, []Value{state, ctrl}, " (for iterator 'for iterator')")
+		if err != nil {
+			return ctlNext, err
+		}
+		if ctrl = at(results, 0); ctrl == nil {
+			return ctlNext, nil
+		}
+		ctl, err := in.execBlock(s.Body, sc.declareAll(s.Names, results))
+		if err != nil {
+			return ctl, err
+		}
+		if ctl, done := endLoop(ctl); done {
+			return ctl, nil
+		}
+	}
+}
+
+func (in *interpreter) forValue(expr Expression, what string, sc *scope) (Value, error) {
+	v, err := in.eval(expr, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch v.(type) {
+	case int64, float64:
+		return v, nil
+	}
+	return nil, in.errorf(expr, "'for' %s value must be a number", what)
+}
+
+// forLimit converts the limit of an integer loop to an integer, flooring or
+// ceiling a float limit depending on the direction of the loop. It reports
+// false when the loop must not run at all.
+func forLimit(limit Value, step int64) (int64, bool) {
+	switch l := limit.(type) {
+	case int64:
+		return l, true
+	case float64:
+		if math.IsNaN(l) {
+			return 0, false
+		}
+		if step > 0 {
+			l = math.Floor(l)
+		} else {
+			l = math.Ceil(l)
+		}
+		switch {
+		case l >= 9223372036854775807:
+			return math.MaxInt64, true
+		case l < -9223372036854775808:
+			return math.MinInt64, true
+		}
+		return int64(l), true
+	}
+	return 0, false
+}
+
+// evalMulti evaluates a list of expressions to their values. A function
+// call or `...` at the end of the list contributes all of its values;
+// anywhere else it is truncated to its first value.
+func (in *interpreter) evalMulti(exprs []Expression, sc *scope) ([]Value, error) {
+	values := make([]Value, 0, len(exprs))
+	for i, expr := range exprs {
+		if i == len(exprs)-1 {
+			results, err := in.evalAll(expr, sc)
+			if err != nil {
+				return nil, err
+			}
+			return append(values, results...), nil
+		}
+		v, err := in.eval(expr, sc)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// evalAll evaluates expr to all of its values: every result of a function
+// call, every extra argument for `...` and a single value otherwise, which
+// includes a call or `...` in parentheses.
+func (in *interpreter) evalAll(expr Expression, sc *scope) ([]Value, error) {
+	switch e := expr.(type) {
+	case *FunctionCall:
+		if !e.Parenthesized {
+			return in.evalCall(e, sc)
+		}
+	case *Identifier:
+		if e.Name == "..." && !e.Parenthesized {
+			return in.varargs(e, sc)
+		}
+	}
+	v, err := in.eval(expr, sc)
+	if err != nil {
+		return nil, err
+	}
+	return []Value{v}, nil
+}
+
+func (in *interpreter) varargs(e *Identifier, sc *scope) ([]Value, error) {
+	fn := sc.function()
+	if fn == nil || fn.varargs == nil {
+		return nil, in.errorf(e, "cannot use '...' outside a vararg function")
+	}
+	return fn.varargs, nil
+}
+
+// evalCall evaluates a function or method call and returns all of its
+// results.
+func (in *interpreter) evalCall(e *FunctionCall, sc *scope) ([]Value, error) {
+	fn, err := in.eval(e.Function, sc)
+	if err != nil {
+		return nil, err
+	}
+	desc := describe(e.Function, sc)
+	var args []Value
+	if e.Method != "" {
+		self := fn
+		if fn, err = in.index(e, self, e.Method, sc); err != nil {
+			return nil, err
+		}
+		desc = fmt.Sprintf(" (method '%s')", e.Method)
+		args = append(args, self)
+	}
+	rest, err := in.evalMulti(e.Arguments, sc)
+	if err != nil {
+		return nil, err
+	}
+	return in.call(e, fn, append(args, rest...), desc)
+}
+
+// call calls fn with args. desc describes where fn came from in the error
+// for a value that is not a function.
+func (in *interpreter) call(n Node, fn Value, args []Value, desc string) ([]Value, error) {
+	if err := in.step(n); err != nil {
+		return nil, err
+	}
+	switch f := fn.(type) {
+	case *closure:
+		return in.callClosure(n, f, args)
+	case *goFunction:
+		site := in.site
+		in.site = n
+		results, err := f.fn(args)
+		in.site = site
+		if err != nil {
+			if _, ok := err.(*RuntimeError); !ok && !isFatal(err) {
+				err = &RuntimeError{Pos: in.pos(n), Msg: err.Error(), Err: err}
+			}
+			return nil, err
+		}
+		return results, nil
+	}
+	return nil, in.errorf(n, "attempt to call a %s value%s", typeName(fn), desc)
+}
+
+// callClosure runs the body of f with its parameters bound to args.
+func (in *interpreter) callClosure(n Node, f *closure, args []Value) ([]Value, error) {
+	if max := in.opts.maxDepth(); in.depth >= max {
+		return nil, &DepthLimitError{Pos: in.pos(n), Max: max}
+	}
+	in.depth++
+	file := in.file
+	in.file = f.file
+	defer func() { in.depth--; in.file = file }()
+
+	call := &scope{parent: f.env, fn: true}
+	if f.vararg {
+		call.varargs = []Value{}
+		if len(args) > len(f.params) {
+			call.varargs = append(call.varargs, args[len(f.params):]...)
+		}
+	}
+
+	ctl, err := in.execBlock(f.body, call.declareAll(f.params, args))
+	if err == nil {
+		err = in.escaped(ctl)
+	}
+	if err != nil || ctl != ctlReturn {
+		return nil, err
+	}
+	return in.results, nil
+}
+
+func (in *interpreter) eval(expr Expression, sc *scope) (Value, error) {
+	switch e := expr.(type) {
+	case *Identifier:
+		if e.Name == "..." {
+			values, err := in.varargs(e, sc)
+			return at(values, 0), err
+		}
+		if local := sc.lookup(e.Name); local != nil {
+			return *local, nil
+		}
+		return in.globals.Get(e.Name), nil
+	case *NumberLiteral:
+		if e.IsInt {
+			return e.IntValue, nil
+		}
+		return e.Value, nil
+	case *StringLiteral:
+		return e.Value, nil
+	case *BooleanLiteral:
+		return e.Value, nil
+	case *NilLiteral:
+		return nil, nil
+	case *TableLiteral:
+		return in.evalTable(e, sc)
+	case *FunctionLiteral:
+		return in.newClosure("", e.Parameters, e.Body, sc), nil
+	case *BinaryExpression:
+		return in.evalBinary(e, sc)
+	case *UnaryExpression:
+		return in.evalUnary(e, sc)
+	case *MemberExpression:
+		obj, err := in.eval(e.Object, sc)
+		if err != nil {
+			return nil, err
+		}
+		return in.index(e, obj, e.Member, sc)
+	case *IndexExpression:
+		obj, err := in.eval(e.Object, sc)
+		if err != nil {
+			return nil, err
+		}
+		key, err := in.eval(e.Index, sc)
+		if err != nil {
+			return nil, err
+		}
+		return in.index(e, obj, key, sc)
+	case *FunctionCall:
+		results, err := in.evalCall(e, sc)
+		if err != nil {
+			return nil, err
+		}
+		return at(results, 0), nil
+	case *ErrorNode:
+		return nil, in.errorf(e, "%s", e.Message)
+	}
+	return nil, in.errorf(expr, "cannot evaluate %s", expr.NodeType())
+}
+
+func (in *interpreter) index(e Expression, obj, key Value, sc *scope) (Value, error) {
+	if _, ok := obj.(string); ok && in.strings != nil {
+		return in.strings.Get(key), nil
+	}
+	table, ok := obj.(*Table)
+	if !ok {
+		return nil, in.errorf(e, "attempt to index a %s value%s", typeName(obj), describe(objectOf(e), sc))
+	}
+	return table.Get(key), nil
+}
+
+func (in *interpreter) evalTable(t *TableLiteral, sc *scope) (Value, error) {
+	if err := in.alloc(t, tableBytes); err != nil {
+		return nil, err
+	}
+	result := NewTable()
+	n := int64(0)
+	for i, field := range t.Fields {
+		if field.Key == nil && i == len(t.Fields)-1 {
+			// A trailing positional call or `...` fills in all its values.
+			values, err := in.evalAll(field.Value, sc)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range values {
+				n++
+				if err := in.set(field, result, n, v); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		value, err := in.eval(field.Value, sc)
+		if err != nil {
+			return nil, err
+		}
+		if field.Key == nil {
+			n++
+			if err := in.set(field, result, n, value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var key Value
+		switch k := field.Key.(type) {
+		case *Identifier:
+			key = k.Name
+		case *TableIndex:
+			if key, err = in.eval(k.Key, sc); err != nil {
+				return nil, err
+			}
+		default:
+			if key, err = in.eval(k, sc); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkKey(key); err != nil {
+			return nil, in.errorf(field, "%v", err)
+		}
+		if err := in.set(field, result, key, value); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func checkKey(key Value) error {
+	switch k := key.(type) {
+	case nil:
+		return fmt.Errorf("index is nil")
+	case float64:
+		if math.IsNaN(k) {
+			return fmt.Errorf("index is NaN")
+		}
+	}
+	return nil
+}
+
+func (in *interpreter) evalBinary(e *BinaryExpression, sc *scope) (Value, error) {
+	left, err := in.eval(e.Left, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch e.Operator {
+	case AND:
+		if !truthy(left) {
+			return left, nil
+		}
+		return in.eval(e.Right, sc)
+	case OR:
+		if truthy(left) {
+			return left, nil
+		}
+		return in.eval(e.Right, sc)
+	}
+
+	right, err := in.eval(e.Right, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.Operator {
+	case EQ:
+		return rawEqual(left, right), nil
+	case NE:
+		return !rawEqual(left, right), nil
+	case LT, LE, GT, GE:
+		return in.compare(e, left, right, sc)
+	case CONCAT:
+		ls, lok := toStr(left)
+		rs, rok := toStr(right)
+		if !lok || !rok {
+			bad, badExpr := left, e.Left
+			if lok {
+				bad, badExpr = right, e.Right
+			}
+			return nil, in.errorf(e, "attempt to concatenate a %s value%s", typeName(bad), describe(badExpr, sc))
+		}
+		if err := in.alloc(e, int64(len(ls)+len(rs))); err != nil {
+			return nil, err
+		}
+		return ls + rs, nil
+	}
+
+	v, err := arith(e.Operator, left, right)
+	if err != nil {
+		return nil, in.errorf(e, "%v", err)
+	}
+	if v == nil {
+		bad, badExpr := right, e.Right
+		if _, ok := toNumber(left); !ok {
+			bad, badExpr = left, e.Left
+		}
+		what := "perform arithmetic on"
+		if e.Operator == LSHIFT || e.Operator == RSHIFT {
+			what = "perform bitwise operation on"
+			if _, ok := toNumber(bad); ok {
+				return nil, in.errorf(e, "number has no integer representation")
+			}
+		}
+		return nil, in.errorf(e, "attempt to %s a %s value%s", what, typeName(bad), describe(badExpr, sc))
+	}
+	return v, nil
+}
+
+func (in *interpreter) compare(e *BinaryExpression, left, right Value, sc *scope) (Value, error) {
+	if e.Operator == GT || e.Operator == GE {
+		left, right = right, left
+	}
+	var less, equal bool
+	ls, lstr := left.(string)
+	rs, rstr := right.(string)
+	switch {
+	case lstr && rstr:
+		less, equal = ls < rs, ls == rs
+	case isNumber(left) && isNumber(right):
+		less, equal = numLess(left, right), rawEqual(left, right)
+	default:
+		lt, rt := typeName(left), typeName(right)
+		if lt == rt {
+			return nil, in.errorf(e, "attempt to compare two %s values", lt)
+		}
+		return nil, in.errorf(e, "attempt to compare %s with %s", lt, rt)
+	}
+	if e.Operator == LE || e.Operator == GE {
+		return less || equal, nil
+	}
+	return less, nil
+}
+
+func (in *interpreter) evalUnary(e *UnaryExpression, sc *scope) (Value, error) {
+	right, err := in.eval(e.Right, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch e.Operator {
+	case NOT:
+		return !truthy(right), nil
+	case MINUS:
+		switch n, _ := toNumber(right); n := n.(type) {
+		case int64:
+			return -n, nil
+		case float64:
+			return -n, nil
+		}
+		return nil, in.errorf(e, "attempt to perform arithmetic on a %s value%s", typeName(right), describe(e.Right, sc))
+	case HASH:
+		switch v := right.(type) {
+		case string:
+			return int64(len(v)), nil
+		case *Table:
+			return int64(v.Len()), nil
+		}
+		return nil, in.errorf(e, "attempt to get length of a %s value%s", typeName(right), describe(e.Right, sc))
+	}
+	return nil, in.errorf(e, "unknown operator %s", e.Operator)
+}
+
+// arith applies an arithmetic or bitwise operator with Lua 5.4 semantics,
+// coercing numeric strings. It returns nil when an operand is not a number.
+func arith(op TokenType, left, right Value) (Value, error) {
+	a, ok := toNumber(left)
+	if !ok {
+		return nil, nil
+	}
+	b, ok := toNumber(right)
+	if !ok {
+		return nil, nil
+	}
+
+	if op == LSHIFT || op == RSHIFT {
+		x, xok := toInteger(a)
+		y, yok := toInteger(b)
+		if !xok || !yok {
+			return nil, nil
+		}
+		if op == RSHIFT {
+			y = -y
+		}
+		return shiftLeft(x, y), nil
+	}
+
+	x, xint := a.(int64)
+	y, yint := b.(int64)
+	if xint && yint {
+		switch op {
+		case PLUS:
+			return x + y, nil
+		case MINUS:
+			return x - y, nil
+		case STAR:
+			return x * y, nil
+		case MOD:
+			if y == 0 {
+				return nil, fmt.Errorf("attempt to perform 'n%%%%0'")
+			}
+			if y == -1 {
+				return int64(0), nil
+			}
+			m := x % y
+			if m != 0 && (m^y) < 0 {
+				m += y
+			}
+			return m, nil
+		}
+	}
+
+	f, g := toFloat(a), toFloat(b)
+	switch op {
+	case PLUS:
+		return f + g, nil
+	case MINUS:
+		return f - g, nil
+	case STAR:
+		return f * g, nil
+	case SLASH:
+		return f / g, nil
+	case POW:
+		return math.Pow(f, g), nil
+	case MOD:
+		switch {
+		case math.IsInf(g, 0) && !math.IsNaN(f) && !math.IsInf(f, 0):
+			if (f >= 0) == (g > 0) {
+				return f, nil
+			}
+			return g, nil
+		}
+		m := math.Mod(f, g)
+		if m != 0 && (m < 0) != (g < 0) {
+			m += g
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func shiftLeft(x, n int64) int64 {
+	switch {
+	case n <= -64 || n >= 64:
+		return 0
+	case n >= 0:
+		return int64(uint64(x) << uint(n))
+	default:
+		return int64(uint64(x) >> uint(-n))
+	}
+}
+
+// toNumber converts v to an int64 or float64, accepting numeric strings as
+// Lua does for arithmetic.
+func toNumber(v Value) (Value, bool) {
+	switch n := v.(type) {
+	case int64, float64:
+		return n, true
+	case string:
+		return parseNumber(n)
+	}
+	return nil, false
+}
+
+// parseNumber reads a Lua numeral: a decimal or hexadecimal integer or
+// float, surrounded by optional whitespace.
+func parseNumber(s string) (Value, bool) {
+	s = strings.TrimSpace(s)
+	neg := false
+	body := s
+	if strings.HasPrefix(body, "-") {
+		neg, body = true, body[1:]
+	} else if strings.HasPrefix(body, "+") {
+		body = body[1:]
+	}
+	if body == "" {
+		return nil, false
+	}
+	if strings.HasPrefix(body, "0x") || strings.HasPrefix(body, "0X") {
+		if digits := body[2:]; digits != "" && strings.Trim(digits, "0123456789abcdefABCDEF") == "" {
+			// Hexadecimal integers wrap around on overflow.
+			var u uint64
+			for i := 0; i < len(digits); i++ {
+				d, _ := hexDigit(rune(digits[i]))
+				u = u<<4 | uint64(d)
+			}
+			n := int64(u)
+			if neg {
+				n = -n
+			}
+			return n, true
+		}
+		hex := body
+		if !strings.ContainsAny(hex, "pP") {
+			hex += "p0"
+		}
+		f, err := strconv.ParseFloat(hex, 64)
+		if err != nil {
+			return nil, false
+		}
+		if neg {
+			f = -f
+		}
+		return f, true
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, true
+	}
+	for _, c := range body {
+		if !(c >= '0' && c <= '9' || c == '.' || c == 'e' || c == 'E' || c == '+' || c == '-') {
+			return nil, false
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil && !strings.Contains(err.Error(), "range") {
+		return nil, false
+	}
+	return f, true
+}
+
+// toInteger converts a number with an exact integer value to int64.
+func toInteger(v Value) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case float64:
+		if n == math.Floor(n) && n >= -9223372036854775808 && n < 9223372036854775808 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v Value) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return math.NaN()
+}
+
+func isNumber(v Value) bool {
+	switch v.(type) {
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+func numLess(a, b Value) bool {
+	x, xint := a.(int64)
+	y, yint := b.(int64)
+	if xint && yint {
+		return x < y
+	}
+	return toFloat(a) < toFloat(b)
+}
+
+// rawEqual compares values without metamethods: numbers by value, so 1 and
+// 1.0 are equal, and tables by identity.
+func rawEqual(a, b Value) bool {
+	if isNumber(a) && isNumber(b) {
+		x, xint := a.(int64)
+		y, yint := b.(int64)
+		if xint && yint {
+			return x == y
+		}
+		return toFloat(a) == toFloat(b)
+	}
+	return a == b
+}
+
+func truthy(v Value) bool {
+	return v != nil && v != false
+}
+
+// toStr converts a string or number to a string as Lua's concatenation does.
+func toStr(v Value) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case int64:
+		return strconv.FormatInt(s, 10), true
+	case float64:
+		return formatFloat(s), true
+	}
+	return "", false
+}
+
+// formatFloat formats f like Lua's tostring: "%.14g", with ".0" added to
+// integral values.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	s := strconv.FormatFloat(f, 'g', 14, 64)
+	if strings.ContainsAny(s, "e") {
+		mantissa, exp, _ := strings.Cut(s, "e")
+		if strings.Contains(mantissa, ".") {
+			mantissa = strings.TrimRight(strings.TrimRight(mantissa, "0"), ".")
+		}
+		sign := exp[0]
+		digits := strings.TrimLeft(exp[1:], "0")
+		if len(digits) < 2 {
+			digits = strings.Repeat("0", 2-len(digits)) + digits
+		}
+		return mantissa + "e" + string(sign) + digits
+	}
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if !strings.ContainsAny(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// typeName returns the Lua type name of v.
+func typeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case int64, float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *closure, *goFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+// describe names the variable an erroneous value came from, as in Lua's
+// "(global 'x')" suffix of error messages.
+func describe(expr Expression, sc *scope) string {
+	switch e := expr.(type) {
+	case *Identifier:
+		return fmt.Sprintf(" (%s '%s')", sc.kind(e.Name), e.Name)
+	case *MemberExpression:
+		return fmt.Sprintf(" (field '%s')", e.Member)
+	case *IndexExpression:
+		if s, ok := e.Index.(*StringLiteral); ok {
+			return fmt.Sprintf(" (field '%s')", s.Value)
+		}
+	}
+	return ""
+}
+
+// objectOf returns the expression being indexed by a member or index
+// expression.
+func objectOf(expr Expression) Expression {
+	switch e := expr.(type) {
+	case *MemberExpression:
+		return e.Object
+	case *IndexExpression:
+		return e.Object
+	}
+	return expr
+}
+
+// at returns values[i], or nil past the end of the list.
+func at(values []Value, i int) Value {
+	if i < len(values) {
+		return values[i]
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package luar
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func runChunk(t *testing.T, src string) *Table {
+	t.Helper()
+	program, err := NewParser(src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newInterpreter()
+	if _, err := in.run(program); err != nil {
+		t.Fatal(err)
+	}
+	return in.globals
+}
+
+func runError(t *testing.T, src string) string {
+	t.Helper()
+	program, err := NewParser(src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newInterpreter().run(program)
+	if err == nil {
+		t.Fatalf("%q: expected an error", src)
+	}
+	return err.Error()
+}
+
+func TestInterp_Expressions(t *testing.T) {
+	tests := []struct {
+		src  string
+		want Value
+	}{
+		{"x = 1 + 2", int64(3)},
+		{"x = 1 + 2.0", 3.0},
+		{"x = 7 / 2", 3.5},
+		{"x = -7 % 3", int64(2)},
+		{"x = 7.5 % -2", -0.5},
+		{"x = 2 ^ 10", 1024.0},
+		{"x = 1 << 4", int64(16)},
+		{"x = 256 >> 4", int64(16)},
+		{`x = "10" + 1`, int64(11)},
+		{`x = "0x10" * 2`, int64(32)},
+		{`x = "a" .. 1 .. 2.0`, "a12.0"},
+		{"x = 1 == 1.0", true},
+		{`x = "a" < "b"`, true},
+		{"x = 3 >= 4", false},
+		{"x = nil or 5", int64(5)},
+		{"x = false and error", false},
+		{"x = not nil", true},
+		{"x = #{1, 2, 3}", int64(3)},
+		{`x = #"abc"`, int64(3)},
+		{"local t = {a = {b = 4}} x = t.a.b", int64(4)},
+		{`local t = {[1 + 1] = "two"} x = t[2]`, "two"},
+	}
+	for _, tt := range tests {
+		got := runChunk(t, tt.src).Get("x")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestInterp_Assignment(t *testing.T) {
+	g := runChunk(t, "a, b = 1, 2\na, b = b, a\nt = {}\nt.x, t[1] = a, b\nlocal l = 5\nl = 6\nc = l")
+	for name, want := range map[string]Value{"a": int64(2), "b": int64(1), "c": int64(6), "l": nil} {
+		if got := g.Get(name); got != want {
+			t.Errorf("%s = %#v, want %#v", name, got, want)
+		}
+	}
+	tbl := g.Get("t").(*Table)
+	if tbl.Get("x") != int64(2) || tbl.Get(int64(1)) != int64(1) {
+		v, _ := toGo(tbl)
+		t.Errorf("t = %v", v)
+	}
+}
+
+func TestInterp_ForNumeric(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []Value
+	}{
+		{"for i = 1, 4 do n = n + 1 r[n] = i end", []Value{int64(1), int64(2), int64(3), int64(4)}},
+		{"for i = 3, 1, -1 do n = n + 1 r[n] = i end", []Value{int64(3), int64(2), int64(1)}},
+		{"for i = 1, 0 do n = n + 1 r[n] = i end", []Value{}},
+		{"for i = 1, 3.5 do n = n + 1 r[n] = i end", []Value{int64(1), int64(2), int64(3)}},
+		{"for i = 1.0, 2 do n = n + 1 r[n] = i end", []Value{1.0, 2.0}},
+		{"for i = 0, 1, 0.25 do n = n + 1 r[n] = i end", []Value{0.0, 0.25, 0.5, 0.75, 1.0}},
+		{"for i = math_maxinteger - 1, math_maxinteger do n = n + 1 r[n] = i end",
+			[]Value{int64(9223372036854775806), int64(9223372036854775807)}},
+		{"for i = 1, 3 do local i = i * 10 n = n + 1 r[n] = i end", []Value{int64(10), int64(20), int64(30)}},
+	}
+	for _, tt := range tests {
+		src := "n = 0 r = {} math_maxinteger = 9223372036854775807\n" + tt.src
+		r := runChunk(t, src).Get("r").(*Table)
+		got := []Value{}
+		for i := 1; i <= r.Len(); i++ {
+			got = append(got, r.Get(int64(i)))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestInterp_Errors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"for i = 1, 10, 0 do end", "line 1: 'for' step is zero"},
+		{"for i = 1.0, 10, 0.0 do end", "'for' step is zero"},
+		{`for i = "a", 10 do end`, "'for' initial value must be a number"},
+		{"for i = 1, nil do end", "'for' limit value must be a number"},
+		{"x = y + 1", "attempt to perform arithmetic on a nil value (global 'y')"},
+		{"local t = {}\nx = t.a.b", "line 2: attempt to index a nil value (field 'a')"},
+		{"x = 1 % 0", "attempt to perform 'n%%0'"},
+		{"x = {} < {}", "attempt to compare two table values"},
+		{"x = 1 < 'a'", "attempt to compare number with string"},
+		{"local s\nx = s .. 'a'", "attempt to concatenate a nil value (local 's')"},
+		{"t = {}\nt[nil] = 1", "index is nil"},
+	}
+	for _, tt := range tests {
+		if got := runError(t, tt.src); !strings.Contains(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestUnmarshal_ForLoop(t *testing.T) {
+	type Worker struct {
+		Name string `lua:"name"`
+		Port int    `lua:"port"`
+	}
+	var cfg struct {
+		Workers []Worker `lua:"workers"`
+	}
+	src := `
+workers = {}
+for i = 1, 4 do
+    workers[i] = {name = "worker-" .. i, port = 8000 + i}
+end
+`
+	if err := Unmarshal([]byte(src), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Workers) != 4 {
+		t.Fatalf("got %d workers, want 4", len(cfg.Workers))
+	}
+	if w := cfg.Workers[3]; w.Name != "worker-4" || w.Port != 8004 {
+		t.Errorf("workers[4] = %+v", w)
+	}
+
+	err := Unmarshal([]byte("for i = 1, 2, 0 do end"), &cfg)
+	if err == nil || err.Error() != "luar: line 1: 'for' step is zero" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestInterp_ControlFlow(t *testing.T) {
+	tests := []struct {
+		src  string
+		want Value
+	}{
+		{`env = "prod" if env == "prod" then x = 443 else x = 80 end`, int64(443)},
+		{`if false then x = 1 elseif nil then x = 2 elseif 0 then x = 3 else x = 4 end`, int64(3)},
+		{`if false then x = 1 end`, nil},
+		{`x = 0 while x < 10 do x = x + 3 end`, int64(12)},
+		{`x = 0 while true do x = x + 1 if x == 5 then break end end`, int64(5)},
+		{`x = 0 repeat local y = x + 1 x = y until y >= 3`, int64(3)},
+		{`x = 0 for i = 1, 10 do if i > 4 then break end x = x + i end`, int64(10)},
+		{`x = 0 for i = 1, 5 do if i % 2 == 0 then goto continue end x = x + i ::continue:: end`, int64(9)},
+		{`x = 0 ::top:: x = x + 1 if x < 3 then goto top end`, int64(3)},
+		{`x = 0 for i = 1, 3 do for j = 1, 3 do if j == 2 then goto next end x = x + 1 end ::next:: end`, int64(3)},
+		{`x = 0 for i = 1, 3 do while true do break end x = x + 1 end`, int64(3)},
+	}
+	for _, tt := range tests {
+		got := runChunk(t, tt.src).Get("x")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestInterp_Return(t *testing.T) {
+	program, err := NewParser("x = 1\nif x then return 'early', 2 end\nreturn 'late'").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newInterpreter()
+	results, err := in.run(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(results, []Value{"early", int64(2)}) || in.ret.Pos().Line != 2 {
+		t.Errorf("got %#v from line %d", results, in.ret.Pos().Line)
+	}
+
+	program, _ = NewParser("x = 1").Parse()
+	if results, err := in.run(program); err != nil || results != nil || in.ret != nil {
+		t.Errorf("got %#v, %v for a chunk without return", results, err)
+	}
+}
+
+func TestInterp_ForIn(t *testing.T) {
+	program, err := NewParser("x = '' for i, v in iter, 'st', 0 do x = x .. i .. v end").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newInterpreter()
+	in.globals.Set("iter", &goFunction{name: "iter", fn: func(args []Value) ([]Value, error) {
+		if args[0] != "st" {
+			t.Errorf("iterator state %#v", args[0])
+		}
+		i := args[1].(int64) + 1
+		if i > 3 {
+			return []Value{nil}, nil
+		}
+		return []Value{i, i * 10}, nil
+	}})
+	if _, err := in.run(program); err != nil {
+		t.Fatal(err)
+	}
+	if got := in.globals.Get("x"); got != "110220330" {
+		t.Errorf("got %#v", got)
+	}
+}
+
+func TestInterp_ControlFlowErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"x = 1\nbreak", "line 2: break outside a loop"},
+		{"if true then\n  goto nowhere\nend", "line 2: no visible label 'nowhere' for goto"},
+		{"for k in nil do end", "attempt to call a nil value (for iterator 'for iterator')"},
+		{"f()", "attempt to call a nil value (global 'f')"},
+		{"t = {}\nt:m()", "line 2: attempt to call a nil value (method 'm')"},
+	}
+	for _, tt := range tests {
+		if got := runError(t, tt.src); !strings.Contains(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestUnmarshal_Conditional(t *testing.T) {
+	var cfg SimpleConfig
+	src := `
+env = "prod"
+name = "api"
+if env == "prod" then
+    port = 443
+else
+    port = 8080
+end
+`
+	if err := Unmarshal([]byte(src), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 443 || cfg.Name != "api" {
+		t.Errorf("got %+v", cfg)
+	}
+
+	dec := NewDecoder(strings.NewReader("if true then return {name = 'ret'} end"))
+	dec.SetMode(ModeReturn)
+	if err := dec.Decode(&cfg); err != nil || cfg.Name != "ret" {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestInterp_Functions(t *testing.T) {
+	tests := []struct {
+		src  string
+		want Value
+	}{
+		{`local function svc(name, port) return {name = name, port = port} end
+		  x = svc("api", 80).port`, int64(80)},
+		{`function add(a, b) return a + b end x = add(1, 2)`, int64(3)},
+		{`local f = function(a) return a * 2 end x = f(21)`, int64(42)},
+		{`local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end
+		  x = fib(20)`, int64(6765)},
+		{`local function counter()
+		      local n = 0
+		      return function() n = n + 1 return n end
+		  end
+		  local c1, c2 = counter(), counter()
+		  c1() c1() c2()
+		  x = c1() * 10 + c2()`, int64(32)},
+		{`local function two() return 1, 2 end
+		  local a, b, c = two(), 10
+		  x = a + b + (c or 100)`, int64(111)},
+		{`local function two() return 1, 2 end x = #{two(), two()}`, int64(3)},
+		{`local function count(...) return #{...} end x = count(1, 2, 3, 4)`, int64(4)},
+		{`local function second(_, ...) local a, b = ... return b end x = second(1, 2, 3)`, int64(3)},
+		{`local function pass(...) return ... end local a, b = pass(5, 6) x = a + b`, int64(11)},
+		{`local fs = {}
+		  for i = 1, 3 do fs[i] = function() return i end end
+		  x = fs[1]() + fs[2]() * 10 + fs[3]() * 100`, int64(321)},
+		{`x = 1
+		  local function f() return x end
+		  local x = 2
+		  x = f()`, int64(1)},
+		{`local obj = {n = 5}
+		  function obj:get(k) return self.n * k end
+		  x = obj:get(2)`, int64(10)},
+		{`local m = {util = {}}
+		  function m.util.double(v) return v * 2 end
+		  x = m.util.double(4)`, int64(8)},
+		{`local function noret() end x = noret()`, nil},
+		{`local function two() return 1, 2 end x = #{(two())}`, int64(1)},
+		{`local function two() return 1, 2 end
+		  local function first() return (two()) end
+		  local a, b = first() x = b == nil and a`, int64(1)},
+		{`local function pass(...) return (...) end local a, b = pass(5, 6) x = b == nil and a`, int64(5)},
+		{`local function count(...) return #{...} end
+		  local function two() return 1, 2 end
+		  x = count((two())) * 10 + count(two())`, int64(12)},
+	}
+	for _, tt := range tests {
+		got := runChunk(t, tt.src).Get("x")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestInterp_FunctionErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"local function f(n) return f(n + 1) end\nf(1)", "line 1: stack overflow"},
+		{"local function f() return ... end\nf()", "line 1: cannot use '...' outside a vararg function"},
+		{"local t\nfunction t.f() end", "line 2: attempt to index a nil value (local 't')"},
+		{"local n\nlocal function f() return n + 1 end\nf()", "attempt to perform arithmetic on a nil value (upvalue 'n')"},
+		{"for i = 1, 2 do\n  local f = function() break end\n  f()\nend", "line 2: break outside a loop"},
+	}
+	for _, tt := range tests {
+		if got := runError(t, tt.src); !strings.Contains(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestUnmarshal_Functions(t *testing.T) {
+	type Service struct {
+		Name string `lua:"name"`
+		Port int    `lua:"port"`
+	}
+	var cfg struct {
+		Services []Service `lua:"services"`
+	}
+	src := `
+local function svc(name, port)
+    return {name = name, port = port or 80}
+end
+
+services = {svc("web"), svc("api", 8080)}
+`
+	if err := Unmarshal([]byte(src), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := []Service{{"web", 80}, {"api", 8080}}
+	if !reflect.DeepEqual(cfg.Services, want) {
+		t.Errorf("got %+v, want %+v", cfg.Services, want)
+	}
+}
@@ -74,6 +74,10 @@ func (l *Lexer) skipComment() {
 	if l.currentChar() == '-' && l.peekChar() == '-' {
 		l.readChar()
 		l.readChar()
+		if end := longBracketEnd(l.input[l.pos:]); end >= 0 {
+			l.skipTo(l.pos + end)
+			return
+		}
 		for {
 			ch := l.currentChar()
 			if ch == '\n' || ch == 0 {
@@ -88,40 +92,142 @@ func (l *Lexer) readString() (TokenType, string) {
 	quote := l.readChar()
 	var sb strings.Builder
 	for {
-		ch := l.readChar()
-		if ch == 0 {
+		if l.pos >= len(l.input) {
 			return ILLEGAL, l.errorf("unterminated string")
 		}
-		if ch == quote {
+		if rune(l.input[l.pos]) == quote {
+			l.readChar()
 			break
 		}
-		if ch == '\\' {
-			ch = l.readChar()
-			switch ch {
-			case 'n':
-				sb.WriteRune('\n')
-			case 't':
-				sb.WriteRune('\t')
-			case 'r':
-				sb.WriteRune('\r')
-			case '\\':
-				sb.WriteRune('\\')
-			case '"':
-				sb.WriteRune('"')
-			case '\'':
-				sb.WriteRune('\'')
-			case '0':
-				sb.WriteRune(0)
-			default:
-				sb.WriteRune(ch)
-			}
-		} else {
-			sb.WriteRune(ch)
+		if l.input[l.pos] != '\\' {
+			// Copy the raw bytes, so that strings need not be valid UTF-8.
+			start := l.pos
+			l.readChar()
+			sb.WriteString(l.input[start:l.pos])
+			continue
+		}
+		l.readChar()
+		if msg := l.readEscape(&sb); msg != "" {
+			return ILLEGAL, l.errorf("%s", msg)
 		}
 	}
 	return STRING, sb.String()
 }
 
+// readEscape decodes the escape sequence following a backslash into sb. It
+// returns an error message for a malformed sequence.
+func (l *Lexer) readEscape(sb *strings.Builder) string {
+	if l.pos >= len(l.input) {
+		return "unterminated string"
+	}
+	ch := l.input[l.pos]
+	if i := strings.IndexByte("abfnrtv\\\"'", ch); i >= 0 {
+		l.readChar()
+		sb.WriteByte("\a\b\f\n\r\t\v\\\"'"[i])
+		return ""
+	}
+	switch {
+	case ch == '\n' || ch == '\r':
+		// A backslash followed by a line break is a newline; \r\n and
+		// \n\r count as one line break.
+		l.readChar()
+		if next := l.currentChar(); (next == '\n' || next == '\r') && next != rune(ch) {
+			l.readChar()
+		}
+		sb.WriteByte('\n')
+	case ch == 'z':
+		l.readChar()
+		for l.pos < len(l.input) && strings.IndexByte(" \t\r\n\v\f", l.input[l.pos]) >= 0 {
+			l.readChar()
+		}
+	case ch == 'x':
+		l.readChar()
+		v := 0
+		for i := 0; i < 2; i++ {
+			d, ok := hexDigit(l.currentChar())
+			if !ok {
+				return "hexadecimal digit expected"
+			}
+			l.readChar()
+			v = v*16 + d
+		}
+		sb.WriteByte(byte(v))
+	case ch == 'u':
+		l.readChar()
+		if l.currentChar() != '{' {
+			return "missing '{' in \\u{xxxx}"
+		}
+		l.readChar()
+		var r uint32
+		digits := 0
+		for {
+			d, ok := hexDigit(l.currentChar())
+			if !ok {
+				break
+			}
+			l.readChar()
+			digits++
+			if r = r*16 + uint32(d); r > utf8.MaxRune {
+				return "UTF-8 value too large"
+			}
+		}
+		if digits == 0 {
+			return "hexadecimal digit expected"
+		}
+		if l.currentChar() != '}' {
+			return "missing '}' in \\u{xxxx}"
+		}
+		l.readChar()
+		writeUTF8(sb, r)
+	case ch >= '0' && ch <= '9':
+		v := 0
+		for i := 0; i < 3 && l.pos < len(l.input) && l.input[l.pos] >= '0' && l.input[l.pos] <= '9'; i++ {
+			v = v*10 + int(l.input[l.pos]-'0')
+			l.readChar()
+		}
+		if v > 255 {
+			return "decimal escape too large"
+		}
+		sb.WriteByte(byte(v))
+	default:
+		return fmt.Sprintf("invalid escape sequence '\\%c'", l.currentChar())
+	}
+	return ""
+}
+
+func hexDigit(r rune) (int, bool) {
+	switch {
+	case r >= '0' && r <= '9':
+		return int(r - '0'), true
+	case r >= 'a' && r <= 'f':
+		return int(r-'a') + 10, true
+	case r >= 'A' && r <= 'F':
+		return int(r-'A') + 10, true
+	}
+	return 0, false
+}
+
+// writeUTF8 writes the UTF-8 encoding of r to sb. Unlike WriteRune it also
+// encodes surrogate halves, as Lua does.
+func writeUTF8(sb *strings.Builder, r uint32) {
+	switch {
+	case r < 0x80:
+		sb.WriteByte(byte(r))
+	case r < 0x800:
+		sb.WriteByte(byte(0xc0 | r>>6))
+		sb.WriteByte(byte(0x80 | r&0x3f))
+	case r < 0x10000:
+		sb.WriteByte(byte(0xe0 | r>>12))
+		sb.WriteByte(byte(0x80 | r>>6&0x3f))
+		sb.WriteByte(byte(0x80 | r&0x3f))
+	default:
+		sb.WriteByte(byte(0xf0 | r>>18))
+		sb.WriteByte(byte(0x80 | r>>12&0x3f))
+		sb.WriteByte(byte(0x80 | r>>6&0x3f))
+		sb.WriteByte(byte(0x80 | r&0x3f))
+	}
+}
+
 func (l *Lexer) readNumber() (TokenType, string) {
 	start := l.pos
 	hasDot := false
@@ -132,10 +238,30 @@ func (l *Lexer) readNumber() (TokenType, string) {
 		l.readChar()
 		if l.currentChar() == 'x' || l.currentChar() == 'X' {
 			l.readChar()
-			for unicode.IsDigit(l.currentChar()) || (l.currentChar() >= 'a' && l.currentChar() <= 'f') || (l.currentChar() >= 'A' && l.currentChar() <= 'F') {
-				l.readChar()
+			typ := INT
+			for {
+				ch := l.currentChar()
+				if _, ok := hexDigit(ch); ok {
+					l.readChar()
+				} else if ch == '.' && typ == INT {
+					typ = FLOAT
+					l.readChar()
+				} else if ch == 'p' || ch == 'P' {
+					// A binary exponent, as in 0x1.8p+1.
+					typ = FLOAT
+					l.readChar()
+					if l.currentChar() == '+' || l.currentChar() == '-' {
+						l.readChar()
+					}
+					for unicode.IsDigit(l.currentChar()) {
+						l.readChar()
+					}
+					break
+				} else {
+					break
+				}
 			}
-			return INT, l.input[start:l.pos]
+			return typ, l.input[start:l.pos]
 		}
 	}
 
@@ -178,11 +304,78 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[start:l.pos]
 }
 
+// longBracketEnd returns the length of the long bracket (`[[...]]`,
+// `[==[...]==]`) that s starts with, len(s) if it is unterminated, or -1 if s
+// does not start with a long bracket.
+func longBracketEnd(s string) int {
+	level := longBracketLevel(s)
+	if level < 0 {
+		return -1
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(s[level+2:], closing)
+	if end < 0 {
+		return len(s)
+	}
+	return level + 2 + end + len(closing)
+}
+
+func longBracketLevel(s string) int {
+	if len(s) < 2 || s[0] != '[' {
+		return -1
+	}
+	level := 1
+	for level < len(s) && s[level] == '=' {
+		level++
+	}
+	if level < len(s) && s[level] == '[' {
+		return level - 1
+	}
+	return -1
+}
+
+func (l *Lexer) skipTo(pos int) {
+	for l.pos < pos {
+		l.readChar()
+	}
+}
+
+func (l *Lexer) readLongString() (TokenType, string) {
+	level := longBracketLevel(l.input[l.pos:])
+	end := longBracketEnd(l.input[l.pos:])
+	closing := "]" + strings.Repeat("=", level) + "]"
+	raw := l.input[l.pos : l.pos+end]
+	l.skipTo(l.pos + end)
+	if !strings.HasSuffix(raw, closing) || len(raw) < 2*(level+2) {
+		return ILLEGAL, l.errorf("unterminated long string")
+	}
+	content := raw[level+2 : len(raw)-len(closing)]
+	if strings.HasPrefix(content, "\r\n") {
+		content = content[2:]
+	} else if strings.HasPrefix(content, "\n") {
+		content = content[1:]
+	}
+	return STRING, content
+}
+
+// NextToken returns the next token, recording its byte offset and its raw
+// source text.
 func (l *Lexer) NextToken() Token {
 	l.skipWhitespace()
-	l.skipComment()
-	l.skipWhitespace()
+	for l.currentChar() == '-' && l.peekChar() == '-' {
+		l.skipComment()
+		l.skipWhitespace()
+	}
+
+	start, line := l.pos, l.line
+	tok := l.nextToken()
+	tok.Line = line
+	tok.Offset = start
+	tok.Raw = l.input[start:l.pos]
+	return tok
+}
 
+func (l *Lexer) nextToken() Token {
 	startCol := l.column
 
 	ch := l.currentChar()
@@ -203,10 +396,6 @@ func (l *Lexer) NextToken() Token {
 		return Token{Type: PLUS, Literal: "+", Line: l.line, Column: startCol}
 	case '-':
 		l.readChar()
-		if l.currentChar() == '-' {
-			l.skipComment()
-			return l.NextToken()
-		}
 		return Token{Type: MINUS, Literal: "-", Line: l.line, Column: startCol}
 	case '*':
 		l.readChar()
@@ -236,6 +425,10 @@ func (l *Lexer) NextToken() Token {
 		l.readChar()
 		return Token{Type: RBRACE, Literal: "}", Line: l.line, Column: startCol}
 	case '[':
+		if longBracketLevel(l.input[l.pos:]) >= 0 {
+			typ, val := l.readLongString()
+			return Token{Type: typ, Literal: val, Line: l.line, Column: startCol}
+		}
 		l.readChar()
 		return Token{Type: LBRACKET, Literal: "[", Line: l.line, Column: startCol}
 	case ']':
@@ -327,3 +520,58 @@ func (l *Lexer) Tokens() []Token {
 	}
 	return tokens
 }
+
+// LosslessTokens returns all tokens like Tokens, but with the whitespace and
+// comments between them attached as trivia. A token's trailing trivia runs up
+// to the end of its line; everything else belongs to the leading trivia of
+// the next token, and whatever follows the last token is the leading trivia
+// of EOF. Concatenating every token's leading trivia, Raw text and trailing
+// trivia reproduces the input exactly.
+func (l *Lexer) LosslessTokens() []Token {
+	tokens := l.Tokens()
+	prevEnd := 0
+	for i := range tokens {
+		gap := splitTrivia(l.input[prevEnd:tokens[i].Offset])
+		if i > 0 {
+			n := 0
+			for n < len(gap) && gap[n].Kind != TriviaNewline {
+				n++
+			}
+			tokens[i-1].Trailing = gap[:n:n]
+			gap = gap[n:]
+		}
+		tokens[i].Leading = gap
+		prevEnd = tokens[i].Offset + len(tokens[i].Raw)
+	}
+	return tokens
+}
+
+func splitTrivia(s string) []Trivia {
+	var trivia []Trivia
+	for len(s) > 0 {
+		var n int
+		kind := TriviaWhitespace
+		switch {
+		case strings.HasPrefix(s, "\r\n"):
+			kind, n = TriviaNewline, 2
+		case s[0] == '\n':
+			kind, n = TriviaNewline, 1
+		case strings.HasPrefix(s, "--"):
+			kind = TriviaComment
+			if end := longBracketEnd(s[2:]); end >= 0 {
+				n = 2 + end
+			} else if n = strings.IndexByte(s, '\n'); n < 0 {
+				n = len(s)
+			} else if n > 0 && s[n-1] == '\r' {
+				n--
+			}
+		default:
+			for n < len(s) && s[n] != '\n' && !strings.HasPrefix(s[n:], "--") && !strings.HasPrefix(s[n:], "\r\n") {
+				n++
+			}
+		}
+		trivia = append(trivia, Trivia{Kind: kind, Text: s[:n]})
+		s = s[n:]
+	}
+	return trivia
+}
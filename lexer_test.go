@@ -1,6 +1,8 @@
 package luar
 
 import (
+	"math"
+	"strings"
 	"testing"
 )
 
@@ -231,3 +233,121 @@ func TestLexer_MultiCharOperators(t *testing.T) {
 		}
 	}
 }
+
+func TestLexer_ConsecutiveComments(t *testing.T) {
+	input := "-- first\n-- second\nx = 1 -- trailing\n-- last"
+	tokens := NewLexer(input).Tokens()
+
+	want := []TokenType{IDENT, ASSIGN, INT, EOF}
+	if len(tokens) != len(want) {
+		t.Fatalf("expected %d tokens, got %d: %v", len(want), len(tokens), tokens)
+	}
+	for i, typ := range want {
+		if tokens[i].Type != typ {
+			t.Errorf("token %d: expected %s, got %s", i, typ, tokens[i].Type)
+		}
+	}
+}
+
+func TestLexer_LongBrackets(t *testing.T) {
+	input := "--[[ block\ncomment ]] s = [==[\nline1\n]]line2]==]"
+	tokens := NewLexer(input).Tokens()
+
+	want := []TokenType{IDENT, ASSIGN, STRING, EOF}
+	if len(tokens) != len(want) {
+		t.Fatalf("expected %d tokens, got %d: %v", len(want), len(tokens), tokens)
+	}
+	if tokens[2].Literal != "line1\n]]line2" {
+		t.Errorf("expected long string content, got %q", tokens[2].Literal)
+	}
+	if tokens[2].Raw != "[==[\nline1\n]]line2]==]" {
+		t.Errorf("expected raw long string, got %q", tokens[2].Raw)
+	}
+}
+
+func TestLexer_LosslessTokens(t *testing.T) {
+	input := "-- header\n\nport = 8080 -- http\n-- footer\n"
+	tokens := NewLexer(input).LosslessTokens()
+
+	port := tokens[0]
+	if port.Offset != 11 || port.Raw != "port" {
+		t.Errorf("unexpected first token %+v", port)
+	}
+	if len(port.Leading) != 3 || port.Leading[0].Kind != TriviaComment || port.Leading[0].Text != "-- header" {
+		t.Errorf("unexpected leading trivia %+v", port.Leading)
+	}
+
+	value := tokens[2]
+	if len(value.Trailing) != 2 || value.Trailing[1].Text != "-- http" {
+		t.Errorf("expected trailing comment on 8080, got %+v", value.Trailing)
+	}
+
+	eof := tokens[len(tokens)-1]
+	if len(eof.Leading) != 3 || eof.Leading[1].Text != "-- footer" {
+		t.Errorf("expected footer in EOF leading trivia, got %+v", eof.Leading)
+	}
+}
+
+func TestLexer_Escapes(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{`"a\tb\nc\\d\"e\'f"`, "a\tb\nc\\d\"e'f"},
+		{`'\a\b\f\v\r'`, "\a\b\f\v\r"},
+		{`"\x41\x6a\xFF"`, "Aj\xff"},
+		{`"\65\066\0067\0"`, "AB\x067\x00"},
+		{`"\u{48}\u{20AC}\u{1F600}\u{D800}"`, "H€😀\xed\xa0\x80"},
+		{"\"a\\z  \n\t  b\"", "ab"},
+		{"\"a\\\nb\\\r\nc\"", "a\nb\nc"},
+		{"\"\xff\xfe\"", "\xff\xfe"},
+	}
+	for _, tt := range tests {
+		tok := NewLexer(tt.input).NextToken()
+		if tok.Type != STRING || tok.Literal != tt.want {
+			t.Errorf("%s: got %v %q, want %q", tt.input, tok.Type, tok.Literal, tt.want)
+		}
+	}
+
+	errors := map[string]string{
+		`"\q"`:         "invalid escape sequence '\\q'",
+		`"\300"`:       "decimal escape too large",
+		`"\xZ1"`:       "hexadecimal digit expected",
+		`"\u{}"`:       "hexadecimal digit expected",
+		`"\u41"`:       "missing '{' in \\u{xxxx}",
+		`"\u{41"`:      "missing '}' in \\u{xxxx}",
+		`"\u{110000}"`: "UTF-8 value too large",
+		`"abc\`:        "unterminated string",
+	}
+	for input, want := range errors {
+		tok := NewLexer(input).NextToken()
+		if tok.Type != ILLEGAL || !strings.HasSuffix(tok.Literal, want) {
+			t.Errorf("%s: got %v %q, want %q", input, tok.Type, tok.Literal, want)
+		}
+	}
+}
+
+func TestLexer_HexNumbers(t *testing.T) {
+	tests := []struct {
+		input string
+		typ   TokenType
+		value Value
+	}{
+		{"0xff", INT, int64(255)},
+		{"0x1p4", FLOAT, 16.0},
+		{"0x1.8p+1", FLOAT, 3.0},
+		{"0xA.8", FLOAT, 10.5},
+		{"0x.1p-4", FLOAT, 1.0 / 256},
+		{"0xffffffffffffffff", INT, int64(-1)},
+		{"0x8000000000000000", INT, int64(math.MinInt64)},
+	}
+	for _, tt := range tests {
+		tok := NewLexer(tt.input).NextToken()
+		if tok.Type != tt.typ || tok.Literal != tt.input {
+			t.Errorf("%s: got %v %q", tt.input, tok.Type, tok.Literal)
+			continue
+		}
+		if v, ok := parseNumber(tok.Literal); !ok || v != tt.value {
+			t.Errorf("%s: got %#v, want %#v", tt.input, v, tt.value)
+		}
+	}
+}
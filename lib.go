@@ -0,0 +1,1272 @@
+package luar
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Lib selects parts of the standard library to open for a config. None of
+// them gives access to files, the environment or processes.
+type Lib uint
+
+const (
+	// LibBase opens assert, error, ipairs, next, pairs, pcall, rawequal,
+	// rawget, rawlen, rawset, select, tonumber, tostring and type.
+	LibBase Lib = 1 << iota
+	// LibString opens the string table, with Lua pattern matching, and
+	// method calls on strings such as ("x"):upper().
+	LibString
+	// LibMath opens the math table, without math.random.
+	LibMath
+	// LibTable opens the table table.
+	LibTable
+	// LibUTF8 opens the utf8 table.
+	LibUTF8
+
+	// LibAll opens every library.
+	LibAll = LibBase | LibString | LibMath | LibTable | LibUTF8
+)
+
+// OpenLibs makes the libraries libs available to the config. Functions
+// registered with RegisterFunc take precedence over library functions of
+// the same name.
+func (d *Decoder) OpenLibs(libs Lib) {
+	d.libs |= libs
+}
+
+// libArgs holds the arguments of a library function call and checks them,
+// failing with Lua's "bad argument" errors.
+type libArgs struct {
+	name string
+	vals []Value
+	in   *interpreter
+}
+
+// fits reports an error if a string of size bytes would exceed the memory
+// limit, before the function builds it.
+func (a *libArgs) fits(size int64) error {
+	if a.in == nil {
+		return nil
+	}
+	return a.in.fits(a.in.site, size)
+}
+
+// pattern compiles pat, so that matching it counts against the step limit
+// and checks for cancellation, and the strings replacing it builds against
+// the memory limit.
+func (a *libArgs) pattern(pat string) (*Pattern, error) {
+	p, err := CompilePattern(pat)
+	if err != nil {
+		return nil, err
+	}
+	return a.limit(p), nil
+}
+
+// limit makes p count its steps and the strings it builds against the
+// interpreter's limits.
+func (a *libArgs) limit(p *Pattern) *Pattern {
+	if in := a.in; in != nil {
+		p.step = func() error { return in.step(in.site) }
+		p.fits = func(size int64) error { return in.fits(in.site, size) }
+	}
+	return p
+}
+
+func (a *libArgs) get(i int) Value {
+	return at(a.vals, i)
+}
+
+func (a *libArgs) errorf(i int, format string, args ...interface{}) error {
+	return fmt.Errorf("bad argument #%d to '%s' (%s)", i+1, a.name, fmt.Sprintf(format, args...))
+}
+
+func (a *libArgs) typeError(i int, expected string) error {
+	got := "no value"
+	if i < len(a.vals) {
+		got = typeName(a.vals[i])
+	}
+	return a.errorf(i, "%s expected, got %s", expected, got)
+}
+
+func (a *libArgs) any(i int) (Value, error) {
+	if i >= len(a.vals) {
+		return nil, a.errorf(i, "value expected")
+	}
+	return a.vals[i], nil
+}
+
+func (a *libArgs) str(i int) (string, error) {
+	if s, ok := toStr(a.get(i)); ok {
+		return s, nil
+	}
+	return "", a.typeError(i, "string")
+}
+
+func (a *libArgs) optStr(i int, def string) (string, error) {
+	if a.get(i) == nil {
+		return def, nil
+	}
+	return a.str(i)
+}
+
+func (a *libArgs) number(i int) (Value, error) {
+	if n, ok := toNumber(a.get(i)); ok {
+		return n, nil
+	}
+	return nil, a.typeError(i, "number")
+}
+
+func (a *libArgs) float(i int) (float64, error) {
+	n, err := a.number(i)
+	return toFloat(n), err
+}
+
+func (a *libArgs) integer(i int) (int64, error) {
+	n, err := a.number(i)
+	if err != nil {
+		return 0, err
+	}
+	v, ok := toInteger(n)
+	if !ok {
+		return 0, a.errorf(i, "number has no integer representation")
+	}
+	return v, nil
+}
+
+func (a *libArgs) optInteger(i int, def int64) (int64, error) {
+	if a.get(i) == nil {
+		return def, nil
+	}
+	return a.integer(i)
+}
+
+func (a *libArgs) table(i int) (*Table, error) {
+	if t, ok := a.get(i).(*Table); ok {
+		return t, nil
+	}
+	return nil, a.typeError(i, "table")
+}
+
+// libFunc is the Go implementation of a library function.
+type libFunc func(a *libArgs) ([]Value, error)
+
+// setFuncs stores funcs in t in the order of their names, so that the
+// order of the keys of t does not vary between runs. A panic in a function
+// fails the chunk like in a registered one. If allocates is set, the
+// strings the functions return are new and count against the memory limit;
+// the base library only passes values through.
+func (in *interpreter) setFuncs(t *Table, funcs map[string]libFunc, allocates bool) {
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		name, fn := name, funcs[name]
+		t.Set(name, &goFunction{name: name, fn: recovering(name, func(args []Value) ([]Value, error) {
+			results, err := fn(&libArgs{name: name, vals: args, in: in})
+			if err == nil && allocates {
+				err = in.allocStrings(in.site, results)
+			}
+			return results, err
+		})})
+	}
+}
+
+func one(v Value) []Value {
+	return []Value{v}
+}
+
+// openLibs stores the libraries libs in the globals of in.
+func (in *interpreter) openLibs(libs Lib) {
+	if libs&LibBase != 0 {
+		in.setFuncs(in.globals, in.baseLib(), false)
+	}
+	if libs&LibString != 0 {
+		in.strings = NewTable()
+		in.setFuncs(in.strings, stringLib, true)
+		in.setFuncs(in.strings, in.patternLib(), true)
+		in.globals.Set("string", in.strings)
+	}
+	if libs&LibMath != 0 {
+		t := NewTable()
+		in.setFuncs(t, mathLib, true)
+		t.Set("pi", math.Pi)
+		t.Set("huge", math.Inf(1))
+		t.Set("maxinteger", int64(math.MaxInt64))
+		t.Set("mininteger", int64(math.MinInt64))
+		in.globals.Set("math", t)
+	}
+	if libs&LibTable != 0 {
+		t := NewTable()
+		in.setFuncs(t, in.tableLib(), true)
+		in.globals.Set("table", t)
+	}
+	if libs&LibUTF8 != 0 {
+		t := NewTable()
+		in.setFuncs(t, utf8Lib, true)
+		t.Set("charpattern", "[\x00-\x7F\xC2-\xFD][\x80-\xBF]*")
+		in.globals.Set("utf8", t)
+	}
+}
+
+func (in *interpreter) baseLib() map[string]libFunc {
+	return map[string]libFunc{
+		"assert": func(a *libArgs) ([]Value, error) {
+			v, err := a.any(0)
+			if err != nil {
+				return nil, err
+			}
+			if truthy(v) {
+				return a.vals, nil
+			}
+			if len(a.vals) < 2 {
+				return nil, in.raise("assertion failed!")
+			}
+			return nil, in.raise(a.vals[1])
+		},
+		"error": func(a *libArgs) ([]Value, error) {
+			return nil, in.raise(a.get(0))
+		},
+		"pcall": func(a *libArgs) ([]Value, error) {
+			fn, err := a.any(0)
+			if err != nil {
+				return nil, err
+			}
+			results, err := in.call(in.site, fn, a.vals[1:], "")
+			if err != nil {
+				rerr, ok := err.(*RuntimeError)
+				if !ok {
+					return nil, err
+				}
+				if rerr.raised {
+					return []Value{false, rerr.value}, nil
+				}
+				return []Value{false, strings.TrimPrefix(rerr.Error(), "luar: ")}, nil
+			}
+			return append([]Value{true}, results...), nil
+		},
+		"ipairs": func(a *libArgs) ([]Value, error) {
+			t, err := a.table(0)
+			if err != nil {
+				return nil, err
+			}
+			iter := &goFunction{name: "ipairs_iterator", fn: func(args []Value) ([]Value, error) {
+				i, _ := at(args, 1).(int64)
+				i++
+				if v := t.Get(i); v != nil {
+					return []Value{i, v}, nil
+				}
+				return one(nil), nil
+			}}
+			return []Value{iter, t, int64(0)}, nil
+		},
+		"next": func(a *libArgs) ([]Value, error) {
+			t, err := a.table(0)
+			if err != nil {
+				return nil, err
+			}
+			k, v, ok := t.next(a.get(1))
+			if !ok {
+				return nil, fmt.Errorf("invalid key to 'next'")
+			}
+			if k == nil {
+				return one(nil), nil
+			}
+			return []Value{k, v}, nil
+		},
+		"pairs": func(a *libArgs) ([]Value, error) {
+			t, err := a.table(0)
+			if err != nil {
+				return nil, err
+			}
+			// Iterate over a snapshot of the keys, so that fields may be
+			// cleared during the traversal as Lua allows.
+			keys := t.Keys()
+			i := 0
+			iter := &goFunction{name: "pairs_iterator", fn: func([]Value) ([]Value, error) {
+				for ; i < len(keys); i++ {
+					if v := t.Get(keys[i]); v != nil {
+						i++
+						return []Value{keys[i-1], v}, nil
+					}
+				}
+				return one(nil), nil
+			}}
+			return []Value{iter, t, nil}, nil
+		},
+		"rawequal": func(a *libArgs) ([]Value, error) {
+			if len(a.vals) < 2 {
+				return nil, a.errorf(len(a.vals), "value expected")
+			}
+			return one(rawEqual(a.vals[0], a.vals[1])), nil
+		},
+		"rawget": func(a *libArgs) ([]Value, error) {
+			t, err := a.table(0)
+			if err != nil {
+				return nil, err
+			}
+			return one(t.Get(a.get(1))), nil
+		},
+		"rawlen": func(a *libArgs) ([]Value, error) {
+			switch v := a.get(0).(type) {
+			case *Table:
+				return one(int64(v.Len())), nil
+			case string:
+				return one(int64(len(v))), nil
+			}
+			return nil, a.errorf(0, "table or string expected")
+		},
+		"rawset": func(a *libArgs) ([]Value, error) {
+			t, err := a.table(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkKey(a.get(1)); err != nil {
+				return nil, err
+			}
+			if err := in.set(in.site, t, a.get(1), a.get(2)); err != nil {
+				return nil, err
+			}
+			return one(t), nil
+		},
+		"select": func(a *libArgs) ([]Value, error) {
+			if s, ok := a.get(0).(string); ok && s == "#" {
+				return one(int64(len(a.vals) - 1)), nil
+			}
+			n, err := a.integer(0)
+			if err != nil {
+				return nil, err
+			}
+			rest := int64(len(a.vals) - 1)
+			switch {
+			case n < 0:
+				if n < -rest {
+					return nil, a.errorf(0, "index out of range")
+				}
+				n = rest + n + 1
+			case n == 0:
+				return nil, a.errorf(0, "index out of range")
+			case n > rest:
+				return nil, nil
+			}
+			return a.vals[n:], nil
+		},
+		"tonumber": func(a *libArgs) ([]Value, error) {
+			if a.get(1) == nil {
+				v, err := a.any(0)
+				if err != nil {
+					return nil, err
+				}
+				if s, ok := v.(string); ok {
+					n, ok := parseNumber(s)
+					if !ok {
+						return one(nil), nil
+					}
+					return one(n), nil
+				}
+				if isNumber(v) {
+					return one(v), nil
+				}
+				return one(nil), nil
+			}
+			base, err := a.integer(1)
+			if err != nil {
+				return nil, err
+			}
+			s, ok := a.get(0).(string)
+			if !ok {
+				return nil, a.typeError(0, "string")
+			}
+			if base < 2 || base > 36 {
+				return nil, a.errorf(1, "base out of range")
+			}
+			n, err := strconv.ParseInt(strings.ToLower(strings.TrimSpace(s)), int(base), 64)
+			if err != nil {
+				return one(nil), nil
+			}
+			return one(n), nil
+		},
+		"tostring": func(a *libArgs) ([]Value, error) {
+			v, err := a.any(0)
+			if err != nil {
+				return nil, err
+			}
+			return one(tostring(v)), nil
+		},
+		"type": func(a *libArgs) ([]Value, error) {
+			v, err := a.any(0)
+			if err != nil {
+				return nil, err
+			}
+			return one(typeName(v)), nil
+		},
+	}
+}
+
+// raise returns the error raised by Lua's error function with value v. A
+// string message gets the position of the call.
+func (in *interpreter) raise(v Value) error {
+	msg, ok := toStr(v)
+	if !ok {
+		msg = fmt.Sprintf("(error object is a %s value)", typeName(v))
+	}
+	err := &RuntimeError{Msg: msg, raised: true, value: v}
+	if _, ok := v.(string); ok && in.site != nil {
+		err.Pos = in.pos(in.site)
+	}
+	return err
+}
+
+// tostring converts v to a string as Lua's tostring does.
+func tostring(v Value) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	case int64, float64:
+		s, _ := toStr(v)
+		return s
+	case *goFunction:
+		return fmt.Sprintf("function: builtin: %p", v)
+	case deletion:
+		return "delete"
+	}
+	return fmt.Sprintf("%s: %p", typeName(v), v)
+}
+
+// next returns the key and value following key in the table, or a nil key
+// after the last one. It reports false if key is not in the table.
+func (t *Table) next(key Value) (Value, Value, bool) {
+	i := 0
+	if key != nil {
+		key = normalizeKey(key)
+		for i < len(t.keys) && t.keys[i] != key {
+			i++
+		}
+		if i == len(t.keys) {
+			return nil, nil, false
+		}
+		i++
+	}
+	if i < len(t.keys) {
+		return t.keys[i], t.values[t.keys[i]], true
+	}
+	return nil, nil, true
+}
+
+// strIndex converts a Lua string index, which may count from the end, to a
+// 1-based position clipped to [0, n+1].
+func strIndex(i int64, n int) int64 {
+	switch {
+	case i > 0:
+		return i
+	case i == 0:
+		return 1
+	case i < -int64(n):
+		return 1
+	}
+	return int64(n) + i + 1
+}
+
+// substring returns s[i:j] for the Lua indices i and j.
+func substring(s string, i, j int64) string {
+	i = strIndex(i, len(s))
+	if j < 0 {
+		j = int64(len(s)) + j + 1
+	} else if j > int64(len(s)) {
+		j = int64(len(s))
+	}
+	if i > j {
+		return ""
+	}
+	return s[i-1 : j]
+}
+
+var stringLib = map[string]libFunc{
+	"byte": func(a *libArgs) ([]Value, error) {
+		s, err := a.str(0)
+		if err != nil {
+			return nil, err
+		}
+		i, err := a.optInteger(1, 1)
+		if err != nil {
+			return nil, err
+		}
+		j, err := a.optInteger(2, i)
+		if err != nil {
+			return nil, err
+		}
+		var out []Value
+		for _, c := range []byte(substring(s, i, j)) {
+			out = append(out, int64(c))
+		}
+		return out, nil
+	},
+	"char": func(a *libArgs) ([]Value, error) {
+		b := make([]byte, len(a.vals))
+		for i := range a.vals {
+			c, err := a.integer(i)
+			if err != nil {
+				return nil, err
+			}
+			if c < 0 || c > 255 {
+				return nil, a.errorf(i, "value out of range")
+			}
+			b[i] = byte(c)
+		}
+		return one(string(b)), nil
+	},
+	"format": func(a *libArgs) ([]Value, error) {
+		s, err := strformat(a)
+		if err != nil {
+			return nil, err
+		}
+		return one(s), nil
+	},
+	"len": func(a *libArgs) ([]Value, error) {
+		s, err := a.str(0)
+		return one(int64(len(s))), err
+	},
+	"lower": func(a *libArgs) ([]Value, error) {
+		s, err := a.str(0)
+		return one(strings.ToLower(s)), err
+	},
+	"upper": func(a *libArgs) ([]Value, error) {
+		s, err := a.str(0)
+		return one(strings.ToUpper(s)), err
+	},
+	"rep": func(a *libArgs) ([]Value, error) {
+		s, err := a.str(0)
+		if err != nil {
+			return nil, err
+		}
+		n, err := a.integer(1)
+		if err != nil {
+			return nil, err
+		}
+		sep, err := a.optStr(2, "")
+		if err != nil || n <= 0 {
+			return one(""), err
+		}
+		unit := int64(len(s)) + int64(len(sep))
+		if unit == 0 {
+			return one(""), nil
+		}
+		if n > maxStringSize/unit {
+			return nil, fmt.Errorf("resulting string too large")
+		}
+		if err := a.fits(unit * n); err != nil {
+			return nil, err
+		}
+		parts := make([]string, n)
+		for i := range parts {
+			parts[i] = s
+		}
+		return one(strings.Join(parts, sep)), nil
+	},
+	"reverse": func(a *libArgs) ([]Value, error) {
+		s, err := a.str(0)
+		b := []byte(s)
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return one(string(b)), err
+	},
+	"sub": func(a *libArgs) ([]Value, error) {
+		s, err := a.str(0)
+		if err != nil {
+			return nil, err
+		}
+		i, err := a.optInteger(1, 1)
+		if err != nil {
+			return nil, err
+		}
+		j, err := a.optInteger(2, -1)
+		if err != nil {
+			return nil, err
+		}
+		return one(substring(s, i, j)), nil
+	},
+}
+
+// patternLib holds the string functions that match Lua patterns.
+func (in *interpreter) patternLib() map[string]libFunc {
+	return map[string]libFunc{
+		"find": func(a *libArgs) ([]Value, error) {
+			s, pat, init, err := patternArgs(a)
+			if err != nil || init > len(s) {
+				return one(nil), err
+			}
+			if truthy(a.get(3)) || !hasSpecials(pat) {
+				i := strings.Index(s[init:], pat)
+				if i < 0 {
+					return one(nil), nil
+				}
+				return []Value{int64(init + i + 1), int64(init + i + len(pat))}, nil
+			}
+			m, err := findPattern(a, s, pat, init)
+			if m == nil || err != nil {
+				return one(nil), err
+			}
+			results := []Value{int64(m.Start + 1), int64(m.End)}
+			if len(m.Captures) > 0 {
+				results = append(results, m.values()...)
+			}
+			return results, nil
+		},
+		"match": func(a *libArgs) ([]Value, error) {
+			s, pat, init, err := patternArgs(a)
+			if err != nil || init > len(s) {
+				return one(nil), err
+			}
+			m, err := findPattern(a, s, pat, init)
+			if m == nil || err != nil {
+				return one(nil), err
+			}
+			return m.values(), nil
+		},
+		"gmatch": func(a *libArgs) ([]Value, error) {
+			s, pat, init, err := patternArgs(a)
+			if err != nil {
+				return nil, err
+			}
+			// As in Lua 5.4, a leading '^' is not an anchor here.
+			p, err := compilePattern(pat, false)
+			if err != nil {
+				return nil, err
+			}
+			a.limit(p)
+			if init > len(s) {
+				init = len(s) + 1
+			}
+			src, last := init, -1
+			iter := &goFunction{name: "gmatch_iterator", fn: func([]Value) ([]Value, error) {
+				for ; src <= len(s); src++ {
+					m, err := p.matchAt(s, src)
+					if err != nil {
+						return nil, err
+					}
+					if m != nil && m.End != last {
+						src, last = m.End, m.End
+						return m.values(), nil
+					}
+				}
+				return one(nil), nil
+			}}
+			return one(iter), nil
+		},
+		"gsub": func(a *libArgs) ([]Value, error) {
+			s, err := a.str(0)
+			if err != nil {
+				return nil, err
+			}
+			pat, err := a.str(1)
+			if err != nil {
+				return nil, err
+			}
+			repl := a.get(2)
+			switch repl.(type) {
+			case string, int64, float64, *Table, *closure, *goFunction:
+			default:
+				return nil, a.typeError(2, "string/function/table")
+			}
+			n, err := a.optInteger(3, -1)
+			if err != nil {
+				return nil, err
+			}
+			if a.get(3) != nil && n < 0 {
+				n = 0
+			}
+			p, err := a.pattern(pat)
+			if err != nil {
+				return nil, err
+			}
+			out, count, err := p.replace(s, int(n), func(m *Match) (string, bool, error) {
+				var v Value
+				switch r := repl.(type) {
+				case *Table:
+					key, err := m.capture(1)
+					if err != nil {
+						return "", false, err
+					}
+					v = r.Get(key)
+				case *closure, *goFunction:
+					results, err := in.call(in.site, r, m.values(), "")
+					if err != nil {
+						return "", false, err
+					}
+					v = at(results, 0)
+				default:
+					s, _ := toStr(r)
+					out, err := expandReplacement(m, s)
+					return out, true, err
+				}
+				if !truthy(v) {
+					return "", false, nil
+				}
+				s, ok := toStr(v)
+				if !ok {
+					return "", false, fmt.Errorf("invalid replacement value (a %s)", typeName(v))
+				}
+				return s, true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			return []Value{out, int64(count)}, nil
+		},
+	}
+}
+
+// patternArgs checks the subject, pattern and initial position arguments of
+// a pattern function and converts the position to a 0-based offset.
+func patternArgs(a *libArgs) (s, pat string, init int, err error) {
+	if s, err = a.str(0); err != nil {
+		return
+	}
+	if pat, err = a.str(1); err != nil {
+		return
+	}
+	i, err := a.optInteger(2, 1)
+	return s, pat, int(strIndex(i, len(s))) - 1, err
+}
+
+func findPattern(a *libArgs, s, pat string, init int) (*Match, error) {
+	p, err := a.pattern(pat)
+	if err != nil {
+		return nil, err
+	}
+	return p.Find(s, init)
+}
+
+// maxStringSize bounds the strings built by string.rep and string.format.
+const maxStringSize = 1 << 28
+
+// maxUnpack bounds the number of values table.unpack returns.
+const maxUnpack = 1 << 20
+
+var mathLib = map[string]libFunc{
+	"abs": func(a *libArgs) ([]Value, error) {
+		n, err := a.number(0)
+		if i, ok := n.(int64); ok {
+			if i < 0 {
+				i = -i
+			}
+			return one(i), err
+		}
+		return one(math.Abs(toFloat(n))), err
+	},
+	"ceil": func(a *libArgs) ([]Value, error) {
+		n, err := a.number(0)
+		return one(floatToInt(math.Ceil, n)), err
+	},
+	"floor": func(a *libArgs) ([]Value, error) {
+		n, err := a.number(0)
+		return one(floatToInt(math.Floor, n)), err
+	},
+	"fmod": func(a *libArgs) ([]Value, error) {
+		x, err := a.number(0)
+		if err != nil {
+			return nil, err
+		}
+		y, err := a.number(1)
+		if err != nil {
+			return nil, err
+		}
+		if xi, ok := x.(int64); ok {
+			if yi, ok := y.(int64); ok {
+				if yi == 0 {
+					return nil, a.errorf(1, "zero")
+				}
+				if yi == -1 {
+					return one(int64(0)), nil
+				}
+				return one(xi % yi), nil
+			}
+		}
+		return one(math.Mod(toFloat(x), toFloat(y))), nil
+	},
+	"max": func(a *libArgs) ([]Value, error) {
+		return minmax(a, false)
+	},
+	"min": func(a *libArgs) ([]Value, error) {
+		return minmax(a, true)
+	},
+	"modf": func(a *libArgs) ([]Value, error) {
+		f, err := a.float(0)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsInf(f, 0) {
+			return []Value{f, 0.0}, nil
+		}
+		i, frac := math.Modf(f)
+		return []Value{i, frac}, nil
+	},
+	"sqrt": mathFunc(math.Sqrt),
+	"exp":  mathFunc(math.Exp),
+	"sin":  mathFunc(math.Sin),
+	"cos":  mathFunc(math.Cos),
+	"tan":  mathFunc(math.Tan),
+	"asin": mathFunc(math.Asin),
+	"acos": mathFunc(math.Acos),
+	"atan": func(a *libArgs) ([]Value, error) {
+		y, err := a.float(0)
+		if err != nil {
+			return nil, err
+		}
+		x := 1.0
+		if a.get(1) != nil {
+			if x, err = a.float(1); err != nil {
+				return nil, err
+			}
+		}
+		return one(math.Atan2(y, x)), nil
+	},
+	"log": func(a *libArgs) ([]Value, error) {
+		x, err := a.float(0)
+		if err != nil || a.get(1) == nil {
+			return one(math.Log(x)), err
+		}
+		base, err := a.float(1)
+		switch base {
+		case 2:
+			return one(math.Log2(x)), err
+		case 10:
+			return one(math.Log10(x)), err
+		}
+		return one(math.Log(x) / math.Log(base)), err
+	},
+	"tointeger": func(a *libArgs) ([]Value, error) {
+		if n, ok := toInteger(a.get(0)); ok {
+			return one(n), nil
+		}
+		return one(nil), nil
+	},
+	"type": func(a *libArgs) ([]Value, error) {
+		v, err := a.any(0)
+		switch v.(type) {
+		case int64:
+			return one("integer"), err
+		case float64:
+			return one("float"), err
+		}
+		return one(nil), err
+	},
+	"ult": func(a *libArgs) ([]Value, error) {
+		x, err := a.integer(0)
+		if err != nil {
+			return nil, err
+		}
+		y, err := a.integer(1)
+		return one(uint64(x) < uint64(y)), err
+	},
+}
+
+func mathFunc(f func(float64) float64) libFunc {
+	return func(a *libArgs) ([]Value, error) {
+		x, err := a.float(0)
+		return one(f(x)), err
+	}
+}
+
+// floatToInt rounds n with round and returns an integer if the result fits,
+// as math.floor and math.ceil do.
+func floatToInt(round func(float64) float64, n Value) Value {
+	if i, ok := n.(int64); ok {
+		return i
+	}
+	f := round(toFloat(n))
+	if i, ok := toInteger(f); ok {
+		return i
+	}
+	return f
+}
+
+func minmax(a *libArgs, min bool) ([]Value, error) {
+	best, err := a.number(0)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(a.vals); i++ {
+		n, err := a.number(i)
+		if err != nil {
+			return nil, err
+		}
+		if numLess(n, best) == min && !rawEqual(n, best) {
+			best = n
+		}
+	}
+	return one(best), nil
+}
+
+func (in *interpreter) tableLib() map[string]libFunc {
+	return map[string]libFunc{
+		"concat": func(a *libArgs) ([]Value, error) {
+			t, err := a.table(0)
+			if err != nil {
+				return nil, err
+			}
+			sep, err := a.optStr(1, "")
+			if err != nil {
+				return nil, err
+			}
+			i, err := a.optInteger(2, 1)
+			if err != nil {
+				return nil, err
+			}
+			j, err := a.optInteger(3, int64(t.Len()))
+			if err != nil {
+				return nil, err
+			}
+			var b strings.Builder
+			for k := i; k <= j; k++ {
+				s, ok := toStr(t.Get(k))
+				if !ok {
+					return nil, fmt.Errorf("invalid value (at index %d) in table for 'concat'", k)
+				}
+				b.WriteString(s)
+				if k == j {
+					break
+				}
+				b.WriteString(sep)
+				if b.Len() > maxStringSize {
+					return nil, fmt.Errorf("resulting string too large")
+				}
+				if err := a.fits(int64(b.Len())); err != nil {
+					return nil, err
+				}
+			}
+			if err := a.fits(int64(b.Len())); err != nil {
+				return nil, err
+			}
+			return one(b.String()), nil
+		},
+		"insert": func(a *libArgs) ([]Value, error) {
+			t, err := a.table(0)
+			if err != nil {
+				return nil, err
+			}
+			n := int64(t.Len())
+			switch len(a.vals) {
+			case 2:
+				if err := in.set(in.site, t, n+1, a.vals[1]); err != nil {
+					return nil, err
+				}
+			case 3:
+				pos, err := a.integer(1)
+				if err != nil {
+					return nil, err
+				}
+				if pos < 1 || pos > n+1 {
+					return nil, a.errorf(1, "position out of bounds")
+				}
+				if err := in.set(in.site, t, n+1, t.Get(n)); err != nil {
+					return nil, err
+				}
+				for i := n - 1; i >= pos; i-- {
+					t.Set(i+1, t.Get(i))
+				}
+				t.Set(pos, a.vals[2])
+			default:
+				return nil, fmt.Errorf("wrong number of arguments to 'insert'")
+			}
+			return nil, nil
+		},
+		"remove": func(a *libArgs) ([]Value, error) {
+			t, err := a.table(0)
+			if err != nil {
+				return nil, err
+			}
+			n := int64(t.Len())
+			pos, err := a.optInteger(1, n)
+			if err != nil {
+				return nil, err
+			}
+			if pos != n && (pos < 1 || pos > n+1) {
+				return nil, a.errorf(1, "position out of bounds")
+			}
+			v := t.Get(pos)
+			for ; pos < n; pos++ {
+				t.Set(pos, t.Get(pos+1))
+			}
+			t.Set(pos, nil)
+			return one(v), nil
+		},
+		"pack": func(a *libArgs) ([]Value, error) {
+			if err := in.alloc(in.site, tableBytes); err != nil {
+				return nil, err
+			}
+			t := NewTable()
+			for i, v := range a.vals {
+				if err := in.set(in.site, t, int64(i+1), v); err != nil {
+					return nil, err
+				}
+			}
+			if err := in.set(in.site, t, "n", int64(len(a.vals))); err != nil {
+				return nil, err
+			}
+			return one(t), nil
+		},
+		"unpack": func(a *libArgs) ([]Value, error) {
+			t, err := a.table(0)
+			if err != nil {
+				return nil, err
+			}
+			i, err := a.optInteger(1, 1)
+			if err != nil {
+				return nil, err
+			}
+			j, err := a.optInteger(2, int64(t.Len()))
+			if err != nil {
+				return nil, err
+			}
+			if i > j {
+				return nil, nil
+			}
+			// j-i is computed unsigned, as it can exceed math.MaxInt64.
+			n := uint64(j) - uint64(i)
+			if n >= maxUnpack {
+				return nil, fmt.Errorf("too many results to unpack")
+			}
+			if err := a.fits(int64(n+1) * entryBytes); err != nil {
+				return nil, err
+			}
+			out := make([]Value, n+1)
+			for k := range out {
+				out[k] = t.Get(i + int64(k))
+			}
+			return out, nil
+		},
+		"sort": func(a *libArgs) ([]Value, error) {
+			t, err := a.table(0)
+			if err != nil {
+				return nil, err
+			}
+			comp := a.get(1)
+			if comp != nil {
+				if _, ok := comp.(*Table); ok || !isFunction(comp) {
+					return nil, a.typeError(1, "function")
+				}
+			}
+			n := t.Len()
+			values := make([]Value, n)
+			for i := range values {
+				values[i] = t.Get(int64(i + 1))
+			}
+			var sortErr error
+			sort.SliceStable(values, func(i, j int) bool {
+				if sortErr != nil {
+					return false
+				}
+				less, err := in.less(values[i], values[j], comp)
+				if err != nil {
+					sortErr = err
+				}
+				return less
+			})
+			if sortErr != nil {
+				return nil, sortErr
+			}
+			for i, v := range values {
+				t.Set(int64(i+1), v)
+			}
+			return nil, nil
+		},
+	}
+}
+
+// less compares a and b for table.sort, with the comparison function comp
+// if it is not nil and with the < operator otherwise.
+func (in *interpreter) less(a, b, comp Value) (bool, error) {
+	if comp != nil {
+		results, err := in.call(in.site, comp, []Value{a, b}, "")
+		return truthy(at(results, 0)), err
+	}
+	as, aok := a.(string)
+	bs, bok := b.(string)
+	switch {
+	case aok && bok:
+		return as < bs, nil
+	case isNumber(a) && isNumber(b):
+		return numLess(a, b), nil
+	}
+	if ta, tb := typeName(a), typeName(b); ta != tb {
+		return false, fmt.Errorf("attempt to compare %s with %s", ta, tb)
+	}
+	return false, fmt.Errorf("attempt to compare two %s values", typeName(a))
+}
+
+func isFunction(v Value) bool {
+	switch v.(type) {
+	case *closure, *goFunction:
+		return true
+	}
+	return false
+}
+
+var utf8Lib = map[string]libFunc{
+	"char": func(a *libArgs) ([]Value, error) {
+		var b strings.Builder
+		for i := range a.vals {
+			c, err := a.integer(i)
+			if err != nil {
+				return nil, err
+			}
+			if c < 0 || c > utf8.MaxRune {
+				return nil, a.errorf(i, "value out of range")
+			}
+			b.WriteRune(rune(c))
+		}
+		return one(b.String()), nil
+	},
+	"codepoint": func(a *libArgs) ([]Value, error) {
+		s, err := a.str(0)
+		if err != nil {
+			return nil, err
+		}
+		i, err := a.optInteger(1, 1)
+		if err != nil {
+			return nil, err
+		}
+		j, err := a.optInteger(2, i)
+		if err != nil {
+			return nil, err
+		}
+		i, j = strIndex(i, len(s)), strIndex(j, len(s))
+		if i > j {
+			return nil, nil
+		}
+		if i < 1 || j > int64(len(s)) {
+			return nil, a.errorf(1, "out of bounds")
+		}
+		var out []Value
+		for p := int(i - 1); p < int(j); {
+			r, size := utf8.DecodeRuneInString(s[p:])
+			if r == utf8.RuneError && size <= 1 {
+				return nil, fmt.Errorf("invalid UTF-8 code")
+			}
+			out = append(out, int64(r))
+			p += size
+		}
+		return out, nil
+	},
+	"len": func(a *libArgs) ([]Value, error) {
+		s, err := a.str(0)
+		if err != nil {
+			return nil, err
+		}
+		i, err := a.optInteger(1, 1)
+		if err != nil {
+			return nil, err
+		}
+		j, err := a.optInteger(2, -1)
+		if err != nil {
+			return nil, err
+		}
+		i, j = strIndex(i, len(s)), strIndex(j, len(s))
+		if i < 1 || i > int64(len(s))+1 {
+			return nil, a.errorf(1, "initial position out of bounds")
+		}
+		if j > int64(len(s)) {
+			return nil, a.errorf(2, "final position out of bounds")
+		}
+		n := int64(0)
+		for p := int(i - 1); p < int(j); {
+			r, size := utf8.DecodeRuneInString(s[p:])
+			if r == utf8.RuneError && size <= 1 {
+				return []Value{nil, int64(p + 1)}, nil
+			}
+			p += size
+			n++
+		}
+		return one(n), nil
+	},
+	"offset": func(a *libArgs) ([]Value, error) {
+		s, err := a.str(0)
+		if err != nil {
+			return nil, err
+		}
+		n, err := a.integer(1)
+		if err != nil {
+			return nil, err
+		}
+		def := int64(1)
+		if n < 0 {
+			def = int64(len(s)) + 1
+		}
+		i, err := a.optInteger(2, def)
+		if err != nil {
+			return nil, err
+		}
+		i = strIndex(i, len(s))
+		if i < 1 || i > int64(len(s))+1 {
+			return nil, a.errorf(2, "position out of bounds")
+		}
+		cont := func(p int64) bool { return p < int64(len(s)) && s[p]&0xC0 == 0x80 }
+		p := i - 1
+		if n == 0 {
+			for p > 0 && cont(p) {
+				p--
+			}
+			return one(p + 1), nil
+		}
+		if cont(p) {
+			return nil, fmt.Errorf("initial position is a continuation byte")
+		}
+		if n < 0 {
+			for ; n < 0 && p > 0; n++ {
+				p--
+				for p > 0 && cont(p) {
+					p--
+				}
+			}
+		} else {
+			for n--; n > 0 && p < int64(len(s)); n-- {
+				p++
+				for cont(p) {
+					p++
+				}
+			}
+		}
+		if n != 0 {
+			return one(nil), nil
+		}
+		return one(p + 1), nil
+	},
+	"codes": func(a *libArgs) ([]Value, error) {
+		s, err := a.str(0)
+		if err != nil {
+			return nil, err
+		}
+		iter := &goFunction{name: "codes_iterator", fn: func(args []Value) ([]Value, error) {
+			p, _ := at(args, 1).(int64)
+			if p > int64(len(s)) {
+				return one(nil), nil
+			}
+			if p > 0 {
+				_, size := utf8.DecodeRuneInString(s[p-1:])
+				p += int64(size)
+			} else {
+				p = 1
+			}
+			if p > int64(len(s)) {
+				return one(nil), nil
+			}
+			r, size := utf8.DecodeRuneInString(s[p-1:])
+			if r == utf8.RuneError && size <= 1 {
+				return nil, fmt.Errorf("invalid UTF-8 code")
+			}
+			return []Value{p, int64(r)}, nil
+		}}
+		return []Value{iter, s, int64(0)}, nil
+	},
+}
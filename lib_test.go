@@ -0,0 +1,221 @@
+package luar
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func runLib(t *testing.T, src string) (Value, error) {
+	t.Helper()
+	program, err := NewParser(src).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newInterpreter()
+	in.openLibs(LibAll)
+	if _, err := in.run(program); err != nil {
+		return nil, err
+	}
+	return in.globals.Get("x"), nil
+}
+
+func TestLib_Functions(t *testing.T) {
+	tests := []struct {
+		src  string
+		want Value
+	}{
+		// base
+		{`x = type(nil) .. type(1) .. type("") .. type({}) .. type(print) .. type(type)`, "nilnumberstringtablenilfunction"},
+		{`x = tostring(1.5) .. tostring(10) .. tostring(nil) .. tostring(true) .. tostring(1e100)`, "1.510niltrue1e+100"},
+		{`x = tonumber("0x1F") + tonumber(" 10 ") + tonumber("z", 36) + tonumber("1e1")`, 86.0},
+		{`x = tonumber("abc")`, nil},
+		{`x = select("#", 1, nil, 3)`, int64(3)},
+		{`x = select(-1, 1, 2, 3)`, int64(3)},
+		{`x = select(2, "a", "b", "c")`, "b"},
+		{`x = select("#", table.unpack({}, math.maxinteger - 1, math.maxinteger))`, int64(2)},
+		{`local f, s = utf8.codes("abc") x = f(s, 100)`, nil},
+		{`x = "" for i, v in ipairs({"a", "b", nil, "d"}) do x = x .. i .. v end`, "1a2b"},
+		{`local t = {a = 1, b = 2, c = 3} x = "" for k, v in pairs(t) do x = x .. k .. v t[k] = nil end`, "a1b2c3"},
+		{`local t = {10, 20} local k, v = next(t) x = k + v + select("#", next(t, 2))`, int64(12)},
+		{`x = rawlen({1, 2}) + rawlen("abc")`, int64(5)},
+		{`x = rawequal(1, 1.0) and rawget({5}, 1)`, int64(5)},
+		{`x = assert(7, "unused")`, int64(7)},
+		{`local ok, err = pcall(error, "boom") x = tostring(ok) .. err`, "falseboom"},
+		{`local ok, err = pcall(function() return nil + 1 end) x = err`, "line 1: attempt to perform arithmetic on a nil value"},
+		{`local ok, a, b = pcall(function(...) return ... end, 1, 2) x = a + b`, int64(3)},
+
+		// string
+		{`x = string.upper("abc") .. ("X"):lower() .. ("ab"):rep(3, "-")`, "ABCxab-ab-ab"},
+		{`x = ("hello"):sub(2, -2) .. ("hello"):sub(-3) .. ("hello"):sub(0) .. ("hi"):sub(5)`, "ellllohello"},
+		{`x = string.len("abc") + #("abc"):reverse()`, int64(6)},
+		{`x = string.char(string.byte("abc", 1, -1))`, "abc"},
+		{`local s = "x" x = s:upper()`, "X"},
+		{`x = string.format("%d-%5.2f-%s-%x-%X-%o-%c-%%", 42, 3.14159, "s", 255, 255, 8, 65)`, "42- 3.14-s-ff-FF-10-A-%"},
+		{`x = string.format("%-5s|%5s|%.2s", "ab", "cd", "xyz")`, "ab   |   cd|xy"},
+		{`x = string.format("%g %g %g %e", 1e20, 0.1, 100, 1)`, "1e+20 0.1 100 1.000000e+00"},
+		{`x = string.format("%5.1f|%+d|%05d", 2.25, 3, -42)`, "  2.2|+3|-0042"},
+		{`x = string.format("%s %s %s", 1, 2.0, nil)`, "1 2.0 nil"},
+		{`x = string.format("%x", -1)`, "ffffffffffffffff"},
+		{`x = string.format("%a", 1)`, "0x1p+0"},
+
+		// math
+		{`x = math.floor(3.7) + math.ceil(3.2) + math.floor(-3.5)`, int64(3)},
+		{`x = math.type(math.floor(1e100))`, "float"},
+		{`x = math.max(1, 5.5, 3) + math.min(4, 2)`, 7.5},
+		{`x = math.type(math.max(1, 2))`, "integer"},
+		{`x = math.abs(-3) + math.fmod(7, 3) + math.fmod(-7, 3)`, int64(3)},
+		{`x = math.sqrt(16) + math.huge - math.huge`, math.NaN()},
+		{`x = math.tointeger(3.0)`, int64(3)},
+		{`x = math.tointeger(3.5)`, nil},
+		{`local i, f = math.modf(3.75) x = i + f * 4`, 6.0},
+		{`x = math.maxinteger + 1 == math.mininteger`, true},
+		{`x = math.log(8, 2) + math.log(100, 10)`, 5.0},
+		{`x = math.ult(1, -1)`, true},
+
+		// table
+		{`x = table.concat({1, 2, "three"}, ", ")`, "1, 2, three"},
+		{`x = table.concat({"a", "b", "c", "d"}, "", 2, 3)`, "bc"},
+		{`local t = {"a", "c"} table.insert(t, 2, "b") table.insert(t, "d") x = table.concat(t)`, "abcd"},
+		{`local t = {"a", "b", "c"} local r = table.remove(t, 1) x = r .. table.concat(t) .. #t`, "abc2"},
+		{`local t = {"a", "b"} local r = table.remove(t) x = r .. #t`, "b1"},
+		{`local t = {} x = tostring(table.remove(t))`, "nil"},
+		{`local a, b, c = table.unpack({1, 2, 3}) x = a + b + c`, int64(6)},
+		{`local t = table.pack(1, nil, 3) x = t.n`, int64(3)},
+		{`local t = {5, 2, 8, 1} table.sort(t) x = table.concat(t, ",")`, "1,2,5,8"},
+		{`local t = {"b", "c", "a"} table.sort(t, function(a, b) return a > b end) x = table.concat(t)`, "cba"},
+
+		// utf8
+		{`x = utf8.char(72, 228, 8364)`, "Hä€"},
+		{`x = utf8.len("Hä€")`, int64(3)},
+		{`x = select(2, utf8.codepoint("Hä€", 1, -1))`, int64(228)},
+		{`x = utf8.offset("Hä€", 3)`, int64(4)},
+		{`x = utf8.offset("Hä€", -1)`, int64(4)},
+		{`x = "" for p, c in utf8.codes("aä") do x = x .. p .. ":" .. c .. " " end`, "1:97 2:228 "},
+		{`x = select(2, utf8.len(string.char(97, 255, 98)))`, int64(2)},
+	}
+	for _, tt := range tests {
+		got, err := runLib(t, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if f, ok := tt.want.(float64); ok && math.IsNaN(f) {
+			if g, ok := got.(float64); ok && math.IsNaN(g) {
+				continue
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestLib_Errors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`x = ("x"):nope()`, "attempt to call a nil value (method 'nope')"},
+		{`x = string.rep()`, "bad argument #1 to 'rep' (string expected, got no value)"},
+		{`x = string.rep("x", 1.5)`, "bad argument #2 to 'rep' (number has no integer representation)"},
+		{`x = math.floor("a")`, "bad argument #1 to 'floor' (number expected, got string)"},
+		{`x = string.format("%d", 1.5)`, "bad argument #2 to 'format' (number has no integer representation)"},
+		{`x = string.format("%d")`, "bad argument #2 to 'format' (no value)"},
+		{`x = string.format("%y", 1)`, "invalid conversion '%y' to 'format'"},
+		{`x = table.concat({{}})`, "invalid value (at index 1) in table for 'concat'"},
+		{`x = table.insert({}, 5, 1)`, "bad argument #2 to 'insert' (position out of bounds)"},
+		{`x = table.sort({1, "a"})`, "attempt to compare"},
+		{"x = 1\nerror('custom')", "luar: line 2: custom"},
+		{`assert(false)`, "assertion failed!"},
+		{`assert(nil, "missing key")`, "missing key"},
+		{`for k in pairs(nil) do end`, "bad argument #1 to 'pairs' (table expected, got nil)"},
+		{`x = select(math.mininteger, 1)`, "bad argument #1 to 'select' (index out of range)"},
+		{`x = table.unpack({}, -9223372036854775807, 9223372036854775807)`, "too many results to unpack"},
+	}
+	for _, tt := range tests {
+		_, err := runLib(t, tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.src, err, tt.want)
+		}
+	}
+
+	// A panic in a library function fails the chunk.
+	in := newInterpreter()
+	in.setFuncs(in.globals, map[string]libFunc{"boom": func(*libArgs) ([]Value, error) { panic("kaboom") }}, false)
+	if _, err := in.globals.Get("boom").(*goFunction).fn(nil); err == nil || err.Error() != "'boom' panicked: kaboom" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDecoder_OpenLibs(t *testing.T) {
+	src := `name = string.format("%s-%02d", ("Web"):lower(), math.floor(7.9))`
+
+	var cfg SimpleConfig
+	if err := Unmarshal([]byte(src), &cfg); err == nil {
+		t.Fatal("expected an error without libraries")
+	}
+
+	dec := NewDecoder(strings.NewReader(src))
+	dec.OpenLibs(LibString | LibMath)
+	if err := dec.Decode(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != "web-07" {
+		t.Errorf("got %q", cfg.Name)
+	}
+
+	// Registered functions override library functions.
+	dec = NewDecoder(strings.NewReader(`name = tostring(1)`))
+	dec.OpenLibs(LibBase)
+	dec.RegisterFunc("tostring", func(n int) string { return "custom" })
+	if err := dec.Decode(&cfg); err != nil || cfg.Name != "custom" {
+		t.Errorf("got %q, %v", cfg.Name, err)
+	}
+}
+
+func TestDecoder_OpenLibsGlobals(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(`
+name = string.upper("web")
+port = env("PORT", 80)
+table = "reassigned"
+handler = function() end
+hooks = {1, tostring, start = tostring}
+`))
+	dec.OpenLibs(LibAll)
+	dec.SetEnv(Env{Lookup: MapLookup(nil), Allow: []string{"PORT"}})
+	dec.SetFS(testFS)
+	dec.RegisterFunc("app.version", func() string { return "1.0" })
+
+	// Only the globals the chunk assigned are decoded, without functions.
+	var v map[string]interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"name":  "WEB",
+		"port":  int64(80),
+		"table": "reassigned",
+		"hooks": map[string]interface{}{"1": int64(1)},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("got %#v\nwant %#v", v, want)
+	}
+
+	// Library functions are set in the same order on every run.
+	for i := 0; i < 5; i++ {
+		var keys struct{ Keys []string }
+		dec := NewDecoder(strings.NewReader(`
+keys = {}
+for k in pairs(math) do table.insert(keys, k) end
+`))
+		dec.OpenLibs(LibAll)
+		if err := dec.Decode(&keys); err != nil {
+			t.Fatal(err)
+		}
+		if !sort.StringsAreSorted(keys.Keys[:len(keys.Keys)-4]) {
+			t.Fatalf("got %v", keys.Keys)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package luar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// DecoderOptions limits the resources a chunk may use while it is decoded,
+// so that a config from an untrusted source cannot hang or exhaust the
+// process. A zero field means no limit, except for MaxDepth and
+// MaxParseDepth, which default to 200.
+type DecoderOptions struct {
+	// MaxSteps limits the number of statements, loop iterations,
+	// function calls and pattern matching steps executed.
+	MaxSteps int64
+
+	// MaxMemory limits the number of bytes taken by the strings and
+	// table entries the chunk creates. It is an approximation: memory is
+	// counted when it is allocated and never given back.
+	MaxMemory int64
+
+	// MaxTableSize limits the number of entries in each table the chunk
+	// builds or adds to, other than its globals.
+	MaxTableSize int
+
+	// MaxDepth limits how deeply function calls may nest.
+	MaxDepth int
+
+	// MaxParseDepth limits how deeply blocks and expressions may nest in
+	// the source.
+	MaxParseDepth int
+}
+
+func (o DecoderOptions) maxDepth() int {
+	if o.MaxDepth > 0 {
+		return o.MaxDepth
+	}
+	return maxCallDepth
+}
+
+func (o DecoderOptions) maxParseDepth() int {
+	if o.MaxParseDepth > 0 {
+		return o.MaxParseDepth
+	}
+	return defaultMaxDepth
+}
+
+// StepLimitError is returned when a chunk executes more than MaxSteps steps.
+type StepLimitError struct {
+	Pos Position
+	Max int64
+}
+
+func (e *StepLimitError) Error() string {
+	return limitMessage(e.Pos, "step limit exceeded")
+}
+
+// MemoryLimitError is returned when a chunk allocates more than MaxMemory
+// bytes.
+type MemoryLimitError struct {
+	Pos Position
+	Max int64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return limitMessage(e.Pos, "memory limit exceeded")
+}
+
+// TableSizeError is returned when a table would grow beyond MaxTableSize
+// entries.
+type TableSizeError struct {
+	Pos Position
+	Max int
+}
+
+func (e *TableSizeError) Error() string {
+	return limitMessage(e.Pos, "table size limit exceeded")
+}
+
+// DepthLimitError is returned when function calls nest more than MaxDepth
+// deep.
+type DepthLimitError struct {
+	Pos Position
+	Max int
+}
+
+func (e *DepthLimitError) Error() string {
+	return limitMessage(e.Pos, "stack overflow")
+}
+
+// NestingLimitError is returned when blocks and expressions in the source
+// nest more than MaxParseDepth deep. Parsing stops at the first one.
+type NestingLimitError struct {
+	Pos Position
+	Max int
+}
+
+func (e *NestingLimitError) Error() string {
+	return fmt.Sprintf("chunk has too many syntax levels at line %d", e.Pos.Line)
+}
+
+// CanceledError is returned by DecodeContext when the context is canceled
+// or its deadline passes while the chunk runs. Err is the context's error.
+type CanceledError struct {
+	Pos Position
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return limitMessage(e.Pos, e.Err.Error())
+}
+
+func (e *CanceledError) Unwrap() error { return e.Err }
+
+// limitMessage formats msg for an error at pos: with the file and line if
+// pos is in a file, and with the line otherwise.
+func limitMessage(pos Position, msg string) string {
+	switch {
+	case pos.Filename != "" && pos.IsValid():
+		return fmt.Sprintf("luar: %s:%d: %s", pos.Filename, pos.Line, msg)
+	case pos.Filename != "":
+		return fmt.Sprintf("luar: %s: %s", pos.Filename, msg)
+	case pos.IsValid():
+		return fmt.Sprintf("luar: line %d: %s", pos.Line, msg)
+	}
+	return "luar: " + msg
+}
+
+// fatalError is implemented by the errors that stop a chunk outright:
+// pcall does not catch them and Go functions pass them on unchanged.
+type fatalError interface {
+	error
+	fatal()
+}
+
+func (*StepLimitError) fatal()   {}
+func (*MemoryLimitError) fatal() {}
+func (*TableSizeError) fatal()   {}
+func (*DepthLimitError) fatal()  {}
+func (*CanceledError) fatal()    {}
+
+func isFatal(err error) bool {
+	var f fatalError
+	return errors.As(err, &f)
+}
+
+// Approximate sizes in bytes of a table and of each entry, for MaxMemory.
+const (
+	tableBytes = 64
+	entryBytes = 48
+)
+
+// cancelCheckInterval is the number of steps between checks of the
+// context, which are comparatively slow.
+const cancelCheckInterval = 1024
+
+// step counts one step of the chunk at n against MaxSteps, and checks now
+// and then whether the context was canceled.
+func (in *interpreter) step(n Node) error {
+	in.steps++
+	if max := in.opts.MaxSteps; max > 0 && in.steps > max {
+		return &StepLimitError{Pos: in.pos(n), Max: max}
+	}
+	if in.ctx != nil && in.steps%cancelCheckInterval == 0 {
+		if err := in.ctx.Err(); err != nil {
+			return &CanceledError{Pos: in.pos(n), Err: err}
+		}
+	}
+	return nil
+}
+
+// alloc counts size bytes allocated at n against MaxMemory.
+func (in *interpreter) alloc(n Node, size int64) error {
+	if err := in.fits(n, size); err != nil {
+		return err
+	}
+	in.memory += size
+	return nil
+}
+
+// allocStrings counts the strings among the results of a Go function
+// against MaxMemory.
+func (in *interpreter) allocStrings(n Node, results []Value) error {
+	if in.opts.MaxMemory <= 0 {
+		return nil
+	}
+	for _, v := range results {
+		if s, ok := v.(string); ok {
+			if err := in.alloc(n, int64(len(s))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fits reports whether size more bytes would exceed MaxMemory, so that a
+// library function can fail before it builds a large string.
+func (in *interpreter) fits(n Node, size int64) error {
+	if max := in.opts.MaxMemory; max > 0 && in.memory+size > max {
+		return &MemoryLimitError{Pos: in.pos(n), Max: max}
+	}
+	return nil
+}
+
+// set stores v in t under key. A new entry counts against MaxTableSize and
+// MaxMemory.
+func (in *interpreter) set(n Node, t *Table, key, v Value) error {
+	if v != nil && t.Get(key) == nil {
+		if max := in.opts.MaxTableSize; max > 0 && len(t.keys) >= max && t != in.globals {
+			return &TableSizeError{Pos: in.pos(n), Max: max}
+		}
+		if err := in.alloc(n, entryBytes); err != nil {
+			return err
+		}
+	}
+	t.Set(key, v)
+	return nil
+}
+
+// SetOptions sets the limits for the following calls to Decode.
+func (d *Decoder) SetOptions(opts DecoderOptions) {
+	if opts.maxParseDepth() != d.opts.maxParseDepth() {
+		d.parsed = false
+	}
+	d.opts = opts
+}
+
+// DecodeContext is like Decode, but stops the chunk with a *CanceledError
+// when ctx is canceled or its deadline passes.
+func (d *Decoder) DecodeContext(ctx context.Context, v interface{}) error {
+	return d.decode(ctx, v)
+}
@@ -0,0 +1,147 @@
+package luar
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeWith(src string, opts DecoderOptions) error {
+	d := NewDecoder(strings.NewReader(src))
+	d.OpenLibs(LibAll)
+	d.SetOptions(opts)
+	var v map[string]interface{}
+	return d.Decode(&v)
+}
+
+func TestDecoderOptions_Limits(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		opts DecoderOptions
+		want string
+		as   interface{}
+	}{
+		{"endless loop", "x = 1\nwhile true do end", DecoderOptions{MaxSteps: 1000}, "luar: line 2: step limit exceeded", new(*StepLimitError)},
+		{"endless repeat", "repeat until false", DecoderOptions{MaxSteps: 1000}, "step limit exceeded", new(*StepLimitError)},
+		{"long for loop", "for i = 1, 1e9 do end", DecoderOptions{MaxSteps: 1000}, "step limit exceeded", new(*StepLimitError)},
+		{"endless iterator", "for x in function() return 1 end do end", DecoderOptions{MaxSteps: 1000}, "step limit exceeded", new(*StepLimitError)},
+		{"pcall", "pcall(function() while true do end end)", DecoderOptions{MaxSteps: 1000}, "step limit exceeded", new(*StepLimitError)},
+		{"sort comparator", "t = {3, 2, 1}\ntable.sort(t, function(a, b) while true do end end)", DecoderOptions{MaxSteps: 1000}, "luar: line 2: step limit exceeded", new(*StepLimitError)},
+		{"backtracking pattern", `x = string.find(string.rep("a", 28), string.rep("a*", 28) .. "b")`, DecoderOptions{MaxSteps: 1000}, "luar: line 1: step limit exceeded", new(*StepLimitError)},
+		{"caught pattern", `ok = pcall(string.gsub, string.rep("a", 28), string.rep("a*", 28) .. "b", "")`, DecoderOptions{MaxSteps: 1000}, "step limit exceeded", new(*StepLimitError)},
+		{"doubling string", "local s = 'x'\nfor i = 1, 40 do s = s .. s end", DecoderOptions{MaxMemory: 1 << 20}, "luar: line 2: memory limit exceeded", new(*MemoryLimitError)},
+		{"string.rep", "s = string.rep('x', 1e8)", DecoderOptions{MaxMemory: 1 << 20}, "luar: line 1: memory limit exceeded", new(*MemoryLimitError)},
+		{"gsub", `s = string.rep("x", 1000):gsub("x", string.rep("y", 1000))`, DecoderOptions{MaxMemory: 1 << 16}, "luar: line 1: memory limit exceeded", new(*MemoryLimitError)},
+		{"table.concat", "t = {}\nfor i = 1, 100 do t[i] = 'x' end\ns = table.concat(t, string.rep(',', 1000))", DecoderOptions{MaxMemory: 1 << 16}, "luar: line 3: memory limit exceeded", new(*MemoryLimitError)},
+		{"many tables", "t = {}\nfor i = 1, 1e6 do t[i] = {} end", DecoderOptions{MaxMemory: 1 << 16}, "luar: line 2: memory limit exceeded", new(*MemoryLimitError)},
+		{"table size", "t = {}\nfor i = 1, 100 do t[i] = i end", DecoderOptions{MaxTableSize: 10}, "luar: line 2: table size limit exceeded", new(*TableSizeError)},
+		{"constructor", "t = {1, 2, 3, 4}", DecoderOptions{MaxTableSize: 3}, "table size limit exceeded", new(*TableSizeError)},
+		{"table.insert", "t = {}\nfor i = 1, 100 do table.insert(t, i) end", DecoderOptions{MaxTableSize: 10}, "table size limit exceeded", new(*TableSizeError)},
+		{"recursion", "local function f(n) return f(n + 1) end\nf(1)", DecoderOptions{MaxDepth: 10}, "luar: line 1: stack overflow", new(*DepthLimitError)},
+		{"caught recursion", "local function f(n) return f(n + 1) end\nok = pcall(f, 1)", DecoderOptions{}, "stack overflow", new(*DepthLimitError)},
+		{"nesting", "x = " + strings.Repeat("(", 300) + "1" + strings.Repeat(")", 300), DecoderOptions{}, "chunk has too many syntax levels at line 1", new(*NestingLimitError)},
+		{"nested tables", "x = " + strings.Repeat("{", 20) + strings.Repeat("}", 20), DecoderOptions{MaxParseDepth: 10}, "chunk has too many syntax levels", new(*NestingLimitError)},
+	}
+	for _, tt := range tests {
+		err := decodeWith(tt.src, tt.opts)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+			continue
+		}
+		if !errors.As(err, tt.as) {
+			t.Errorf("%s: got %T, want %T", tt.name, err, tt.as)
+		}
+	}
+}
+
+func TestDecoderOptions_WithinLimits(t *testing.T) {
+	src := `
+local t = {}
+for i = 1, 10 do t[#t + 1] = string.rep("x", i) end
+name = table.concat(t, ",")
+nested = ` + strings.Repeat("{", 50) + strings.Repeat("}", 50) + `
+for i = 1, 20 do _G_count = i end
+`
+	opts := DecoderOptions{MaxSteps: 1000, MaxMemory: 1 << 16, MaxTableSize: 10, MaxDepth: 10, MaxParseDepth: 100}
+	if err := decodeWith(src, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// The limits apply to each decode, not across them.
+	d := NewDecoder(strings.NewReader("for i = 1, 600 do end"))
+	d.SetOptions(DecoderOptions{MaxSteps: 1000})
+	for i := 0; i < 3; i++ {
+		var v map[string]interface{}
+		if err := d.Decode(&v); err != nil {
+			t.Fatalf("decode %d: %v", i, err)
+		}
+	}
+
+	// Raising the parse depth parses the source again.
+	deep := "x = " + strings.Repeat("(", 300) + "1" + strings.Repeat(")", 300)
+	d = NewDecoder(strings.NewReader(deep))
+	var v struct{ X int }
+	if err := d.Decode(&v); err == nil {
+		t.Fatal("expected a nesting error")
+	}
+	d.SetOptions(DecoderOptions{MaxParseDepth: 1000})
+	if err := d.Decode(&v); err != nil || v.X != 1 {
+		t.Fatalf("got %v, %+v", err, v)
+	}
+}
+
+func TestDecoder_DecodeContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	d := NewDecoder(strings.NewReader("x = 1\nwhile true do x = x + 1 end"))
+	var v map[string]interface{}
+	err := d.DecodeContext(ctx, &v)
+	var cerr *CanceledError
+	if !errors.As(err, &cerr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a deadline error", err)
+	}
+	if cerr.Pos.Line != 2 {
+		t.Errorf("got position %v, want line 2", cerr.Pos)
+	}
+
+	// Matching a pattern that backtracks checks for cancellation too.
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	d = NewDecoder(strings.NewReader(`x = string.find(string.rep("a", 28), string.rep("a*", 28) .. "b")`))
+	d.OpenLibs(LibString)
+	start := time.Now()
+	if err := d.DecodeContext(ctx, &v); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("decoding took %v", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := d.DecodeContext(ctx, &v); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if err := NewDecoder(strings.NewReader("x = 1")).DecodeContext(context.Background(), &v); err != nil || v["x"] != int64(1) {
+		t.Errorf("got %v, %v", err, v)
+	}
+}
+
+func TestParser_SetMaxDepth(t *testing.T) {
+	src := "x = " + strings.Repeat("not ", 50) + "1"
+	p := NewParser(src)
+	p.SetMaxDepth(20)
+	_, err := p.Parse()
+	var nerr *NestingLimitError
+	if !errors.As(err, &nerr) || nerr.Max != 20 || nerr.Pos.Line != 1 {
+		t.Errorf("got %v", err)
+	}
+	p = NewParser(src)
+	p.SetMaxDepth(0)
+	if _, err := p.Parse(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package luar
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SetFS lets the config load other files from fsys with require, dofile and
+// include, so that a config can be split across files. fsys may be an
+// os.DirFS, an embed.FS or an fstest.MapFS.
+//
+// require("services.db") runs services/db.lua or services/db/init.lua once
+// and returns its result, which later calls get from a cache. dofile(path)
+// runs a file each time it is called and returns its results. include(path)
+// runs files for their assignments to globals: its path is relative to the
+// including file, or to the root of fsys when it starts with /, and may be a
+// pattern such as "services/*.lua" that runs every matching file in order.
+// Loading a file that is already being loaded is an error.
+func (d *Decoder) SetFS(fsys fs.FS) {
+	d.fsys = fsys
+}
+
+// loader holds the state of require, dofile and include for a run.
+type loader struct {
+	fsys fs.FS
+
+	// loaded holds the results of require by module name, and programs
+	// the parsed files by path.
+	loaded   map[string]Value
+	programs map[string]*Program
+
+	// stack lists the files being run, outermost first.
+	stack []string
+
+	// sources records the files read, when a Watcher needs them.
+	sources *sources
+}
+
+// openFS stores require, dofile and include in the globals of in.
+func (in *interpreter) openFS(fsys fs.FS) {
+	in.loader = &loader{fsys: fsys, loaded: make(map[string]Value), programs: make(map[string]*Program)}
+	in.setFuncs(in.globals, map[string]libFunc{
+		"require": func(a *libArgs) ([]Value, error) {
+			name, err := a.str(0)
+			if err != nil {
+				return nil, err
+			}
+			if v, ok := in.loader.loaded[name]; ok {
+				return one(v), nil
+			}
+			base := strings.Replace(name, ".", "/", -1)
+			var tried strings.Builder
+			for _, file := range []string{base + ".lua", base + "/init.lua"} {
+				if _, err := fs.Stat(fsys, file); !fs.ValidPath(file) || err != nil {
+					fmt.Fprintf(&tried, "\n\tno file '%s'", file)
+					continue
+				}
+				results, err := in.runFile(file, []Value{name, file})
+				if err != nil {
+					return nil, err
+				}
+				v := at(results, 0)
+				if v == nil {
+					v = true
+				}
+				in.loader.loaded[name] = v
+				return []Value{v, file}, nil
+			}
+			return nil, fmt.Errorf("module '%s' not found:%s", name, tried.String())
+		},
+		"dofile": func(a *libArgs) ([]Value, error) {
+			file, err := a.str(0)
+			if err != nil {
+				return nil, err
+			}
+			return in.runFile(path.Clean(file), nil)
+		},
+		"include": func(a *libArgs) ([]Value, error) {
+			pattern, err := a.str(0)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(pattern, "/") {
+				pattern = path.Clean(pattern[1:])
+			} else {
+				pattern = path.Join(path.Dir(in.file), pattern)
+			}
+			if !strings.ContainsAny(pattern, "*?[") {
+				return in.runFile(pattern, nil)
+			}
+			files, err := fs.Glob(fsys, pattern)
+			if err != nil {
+				return nil, a.errorf(0, "%v", err)
+			}
+			sort.Strings(files)
+			in.loader.sources.addGlob(pattern, files)
+			for _, file := range files {
+				if _, err := in.runFile(file, nil); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		},
+	}, false)
+}
+
+// runFile runs the chunk in file with the globals of in and returns its
+// results.
+func (in *interpreter) runFile(file string, varargs []Value) ([]Value, error) {
+	l := in.loader
+	if !fs.ValidPath(file) {
+		return nil, fmt.Errorf("invalid file name '%s'", file)
+	}
+	for i, f := range l.stack {
+		if f == file {
+			cycle := append(append([]string(nil), l.stack[i:]...), file)
+			return nil, fmt.Errorf("cycle loading '%s': %s", file, strings.Join(cycle, " -> "))
+		}
+	}
+	program, err := in.parseFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if max := in.opts.maxDepth(); in.depth >= max {
+		return nil, &DepthLimitError{Pos: in.pos(in.site), Max: max}
+	}
+
+	in.depth++
+	l.stack = append(l.stack, file)
+	outer := in.file
+	in.file = file
+	defer func() {
+		in.depth--
+		l.stack = l.stack[:len(l.stack)-1]
+		in.file = outer
+	}()
+
+	ctl, err := in.execBlock(&program.Block, &scope{fn: true, varargs: append([]Value{}, varargs...)})
+	if err == nil {
+		err = in.escaped(ctl)
+	}
+	if err != nil || ctl != ctlReturn {
+		return nil, err
+	}
+	return in.results, nil
+}
+
+// parseFile reads and parses file, once per run.
+func (in *interpreter) parseFile(file string) (*Program, error) {
+	if program, ok := in.loader.programs[file]; ok {
+		return program, nil
+	}
+	data, err := fs.ReadFile(in.loader.fsys, file)
+	in.loader.sources.addFile(file, data, err)
+	if err != nil {
+		return nil, err
+	}
+	p := NewParser(string(data))
+	p.SetMaxDepth(in.opts.maxParseDepth())
+	program, err := p.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	in.loader.programs[file] = program
+	return program, nil
+}
@@ -0,0 +1,119 @@
+package luar
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var testFS = fstest.MapFS{
+	"base.lua":                {Data: []byte("port = 80\ninclude('shared/defaults.lua')\n")},
+	"shared/defaults.lua":     {Data: []byte("timeout = 30\n")},
+	"services/db.lua":         {Data: []byte("loads = (loads or 0) + 1\nreturn {host = 'db', port = port + 1}\n")},
+	"services/cache/init.lua": {Data: []byte("local name, file = ...\nreturn {name = name, file = file}\n")},
+	"services/extra/a.lua":    {Data: []byte("extras = (extras or '') .. 'a'\n")},
+	"services/extra/b.lua":    {Data: []byte("extras = (extras or '') .. 'b'\ninclude('../../shared/tail.lua')\n")},
+	"shared/tail.lua":         {Data: []byte("extras = extras .. '!'\n")},
+	"values.lua":              {Data: []byte("return 1, 2\n")},
+	"lib.lua":                 {Data: []byte("function check(x)\n  return x.y\nend\n")},
+	"bad.lua":                 {Data: []byte("local a = 1\nreturn a + nil\n")},
+	"syntax.lua":              {Data: []byte("x = = 1\n")},
+	"cycle/a.lua":             {Data: []byte("include('b.lua')\n")},
+	"cycle/b.lua":             {Data: []byte("\ninclude('a.lua')\n")},
+	"mod/self.lua":            {Data: []byte("return require('mod.self')\n")},
+}
+
+func decodeFS(t *testing.T, src string, libs Lib) (map[string]interface{}, error) {
+	t.Helper()
+	d := NewDecoder(strings.NewReader(src))
+	d.OpenLibs(libs)
+	d.SetFS(testFS)
+	var v map[string]interface{}
+	err := d.Decode(&v)
+	return v, err
+}
+
+func TestDecoder_SetFS(t *testing.T) {
+	v, err := decodeFS(t, `
+include("base.lua")
+local db = require("services.db")
+services = {db = db, same = require("services.db") == db, cache = require("services.cache")}
+local a, b = dofile("values.lua")
+values = a + b
+include("services/extra/*.lua")
+`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"port":    int64(80),
+		"timeout": int64(30),
+		"loads":   int64(1),
+		"services": map[string]interface{}{
+			"db":    map[string]interface{}{"host": "db", "port": int64(81)},
+			"same":  true,
+			"cache": map[string]interface{}{"name": "services.cache", "file": "services/cache/init.lua"},
+		},
+		"values": int64(3),
+		"extras": "ab!",
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("got %#v\nwant %#v", v, want)
+	}
+}
+
+func TestDecoder_SetFSErrors(t *testing.T) {
+	tests := []struct {
+		src, want, file string
+		line            int
+	}{
+		{`require("bad")`, "luar: bad.lua:2: attempt to perform arithmetic on a nil value", "bad.lua", 2},
+		{"require('lib')\ncheck(nil)", "luar: lib.lua:2: attempt to index a nil value (local 'x')", "lib.lua", 2},
+		{`ok, msg = pcall(dofile, "bad.lua") error(msg, 0)`, "luar: line 1: bad.lua:2: attempt to perform arithmetic on a nil value", "", 0},
+		{`include("cycle/a.lua")`, "luar: cycle/b.lua:2: cycle loading 'cycle/a.lua': cycle/a.lua -> cycle/b.lua -> cycle/a.lua", "cycle/b.lua", 2},
+		{`require("mod.self")`, "luar: mod/self.lua:1: cycle loading 'mod/self.lua'", "mod/self.lua", 1},
+		{"\nrequire('syntax')", "luar: line 2: syntax.lua: unexpected token", "", 2},
+		{`require("nope")`, "module 'nope' not found:\n\tno file 'nope.lua'\n\tno file 'nope/init.lua'", "", 1},
+		{`dofile("../etc/passwd")`, "invalid file name '../etc/passwd'", "", 1},
+		{`include("/values.lua/*[")`, "bad argument #1 to 'include' (syntax error in pattern)", "", 1},
+	}
+	for _, tt := range tests {
+		_, err := decodeFS(t, tt.src, LibBase)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.src, err, tt.want)
+			continue
+		}
+		var rerr *RuntimeError
+		if !errors.As(err, &rerr) {
+			t.Errorf("%s: got %T, want a *RuntimeError", tt.src, err)
+			continue
+		}
+		if tt.line != 0 && (rerr.Pos.Filename != tt.file || rerr.Pos.Line != tt.line) {
+			t.Errorf("%s: got position %v, want %s:%d", tt.src, rerr.Pos, tt.file, tt.line)
+		}
+	}
+
+	if _, err := decodeFS(t, `dofile("missing.lua")`, 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+	var v map[string]interface{}
+	if err := Unmarshal([]byte(`require("base")`), &v); err == nil || !strings.Contains(err.Error(), "global 'require'") {
+		t.Errorf("got %v, want require to be undefined without SetFS", err)
+	}
+}
+
+func TestDecoder_SetFSLimits(t *testing.T) {
+	fsys := fstest.MapFS{"loop.lua": {Data: []byte("x = 0\nwhile true do x = x + 1 end\n")}}
+	d := NewDecoder(strings.NewReader(`include("loop.lua")`))
+	d.SetFS(fsys)
+	d.SetOptions(DecoderOptions{MaxSteps: 100})
+	var v map[string]interface{}
+	err := d.Decode(&v)
+	var serr *StepLimitError
+	if !errors.As(err, &serr) || serr.Pos.Filename != "loop.lua" || err.Error() != "luar: loop.lua:2: step limit exceeded" {
+		t.Errorf("got %v", err)
+	}
+}
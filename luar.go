@@ -1,87 +1,251 @@
 package luar
 
 import (
+	"bytes"
+	"context"
+	"encoding"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+)
+
+// Marshaler is implemented by types that can encode themselves as a Lua
+// expression, e.g. a quoted string or a table constructor.
+type Marshaler interface {
+	MarshalLua() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that can decode themselves from a Lua
+// value. UnmarshalLua is called with nil when the source assigns nil.
+type Unmarshaler interface {
+	UnmarshalLua(Value) error
+}
+
+// MarshalerError wraps an error returned by MarshalLua or MarshalText, or
+// reports that MarshalLua produced something that is not a Lua expression.
+type MarshalerError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *MarshalerError) Error() string {
+	return "luar: error calling MarshalLua for type " + e.Type.String() + ": " + e.Err.Error()
+}
+
+func (e *MarshalerError) Unwrap() error { return e.Err }
+
+// Mode selects the shape of a Lua config chunk.
+type Mode int
+
+const (
+	// ModeGlobals writes every top-level field as a global assignment,
+	// e.g. `port = 8080`.
+	ModeGlobals Mode = iota
+	// ModeReturn writes a single `return { ... }` chunk.
+	ModeReturn
+	// ModeModule writes `local M = { ... }` followed by `return M`.
+	ModeModule
 )
 
 type Decoder struct {
-	program *Program
+	src          string
+	program      *Program
+	parsed       bool
+	err          error
+	opts         DecoderOptions
+	durationUnit time.Duration
+	mode         Mode
+	funcs        map[string]*goFunction
+	libs         Lib
+	env          *Env
+	fsys         fs.FS
 }
 
 func Unmarshal(data []byte, v interface{}) error {
 	return NewDecoder(strings.NewReader(string(data))).Decode(v)
 }
 
+// NewDecoder returns a decoder that reads a chunk from r. r may be nil for a
+// decoder used only with DecodeFile and LoadFiles.
 func NewDecoder(r io.Reader) *Decoder {
-	data, _ := io.ReadAll(r)
-	parser := NewParser(string(data))
-	program, _ := parser.Parse()
-	return &Decoder{program: program}
+	d := &Decoder{durationUnit: time.Second}
+	if r != nil {
+		data, err := io.ReadAll(r)
+		d.src, d.err = string(data), err
+	}
+	d.parse()
+	return d
+}
+
+// parse parses the source, unless it was already parsed with the current
+// options.
+func (d *Decoder) parse() {
+	if d.parsed || d.err != nil && d.program == nil {
+		return
+	}
+	p := NewParser(d.src)
+	p.SetMaxDepth(d.opts.maxParseDepth())
+	d.program, d.err = p.Parse()
+	d.parsed = true
+}
+
+// SetMode sets the chunk shape the decoder expects. ModeReturn and ModeModule
+// both decode the value returned by the chunk, so either accepts output of
+// the other.
+func (d *Decoder) SetMode(m Mode) {
+	d.mode = m
 }
 
 func (d *Decoder) Decode(v interface{}) error {
-	return d.decode(v)
+	return d.decode(context.Background(), v)
 }
 
-func (d *Decoder) decode(v interface{}) error {
-	rv := reflect.ValueOf(v)
-	if rv.Kind() != reflect.Ptr {
-		return fmt.Errorf("luar: expected pointer, got %v", rv.Kind())
+// decode runs the chunk read by NewDecoder and decodes it into v.
+func (d *Decoder) decode(ctx context.Context, v interface{}) error {
+	d.parse()
+	if d.err != nil {
+		return d.err
 	}
+	return d.exec(ctx, v, nil, chunk{program: d.program})
+}
 
-	rv = rv.Elem()
+// chunk is a parsed chunk and the file it was read from, which is empty for
+// the source given to NewDecoder.
+type chunk struct {
+	file    string
+	program *Program
+}
 
-	assignments := d.getTopLevelAssignments()
+// exec runs the chunks in turn with the same globals and decodes either the
+// globals or the value each chunk returns, depending on the mode. The files
+// the chunks load are recorded in src unless it is nil.
+func (d *Decoder) exec(ctx context.Context, v interface{}, src *sources, chunks ...chunk) error {
+	rv, err := pointerTo(v)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return &CanceledError{Pos: Position{Filename: chunks[0].file}, Err: err}
+	}
 
-	for _, assign := range assignments {
-		if len(assign.Names) != 1 || len(assign.Values) != 1 {
-			continue
+	in := d.newInterpreter(ctx, src)
+	preloaded := snapshot(in.globals)
+	for _, c := range chunks {
+		results, err := in.runChunk(c)
+		if err != nil {
+			return err
 		}
+		if d.mode != ModeGlobals {
+			val, err := returned(c.file, in.ret, results)
+			if err != nil {
+				return err
+			}
+			if err := d.setValue(rv, val); err != nil {
+				return fileError(c.file, err)
+			}
+		}
+	}
 
-		name := assign.Names[0].Name
-		value := assign.Values[0]
+	if d.mode != ModeGlobals {
+		return nil
+	}
+	err = d.setValue(rv, assigned(in.globals, preloaded))
+	if len(chunks) == 1 {
+		err = fileError(chunks[0].file, err)
+	}
+	return err
+}
 
-		fieldName := d.findFieldByTag(rv, name)
-		if fieldName == "" {
-			fieldName = name
-		}
+// pointerTo returns the value v points to, which decoding sets.
+func pointerTo(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr {
+		return reflect.Value{}, fmt.Errorf("luar: expected pointer, got %v", rv.Kind())
+	}
+	if rv.IsNil() {
+		return reflect.Value{}, fmt.Errorf("luar: expected non-nil pointer")
+	}
+	return rv.Elem(), nil
+}
 
-		field := rv.FieldByName(fieldName)
-		if !field.IsValid() {
-			continue
-		}
+// newInterpreter returns an interpreter with the libraries, environment,
+// file system and functions of the decoder, which records the files it
+// loads in src.
+func (d *Decoder) newInterpreter(ctx context.Context, src *sources) *interpreter {
+	in := newInterpreter()
+	in.opts = d.opts
+	if ctx.Done() != nil {
+		in.ctx = ctx
+	}
+	in.openLibs(d.libs)
+	if d.env != nil {
+		in.openEnv(d.env)
+	}
+	if d.fsys != nil {
+		in.openFS(d.fsys)
+		in.loader.sources = src
+	}
+	d.define(in)
+	return in
+}
 
-		val, err := d.evalExpression(value)
-		if err != nil {
-			continue
-		}
+// snapshot returns the globals set before a chunk runs, such as the
+// libraries and registered functions, by name.
+func snapshot(globals *Table) map[Value]Value {
+	values := make(map[Value]Value, len(globals.keys))
+	for _, k := range globals.Keys() {
+		values[k] = globals.Get(k)
+	}
+	return values
+}
 
-		if err := d.setValue(field, val); err != nil {
-			continue
+// assigned returns a table of the globals the chunks assigned: those not
+// in preloaded, or holding another value than they did then.
+func assigned(globals *Table, preloaded map[Value]Value) *Table {
+	t := NewTable()
+	for _, k := range globals.Keys() {
+		if v := globals.Get(k); v != preloaded[k] {
+			t.Set(k, v)
 		}
 	}
+	return t
+}
 
-	return nil
+// runChunk runs c as the main chunk of the file it was read from.
+func (in *interpreter) runChunk(c chunk) ([]Value, error) {
+	in.file = c.file
+	if in.loader != nil && c.file != "" {
+		in.loader.stack = []string{c.file}
+	}
+	return in.run(c.program)
 }
 
-func (d *Decoder) getTopLevelAssignments() []*AssignmentStatement {
-	var assignments []*AssignmentStatement
-	for _, stmt := range d.program.Statements {
-		if assign, ok := stmt.(*AssignmentStatement); ok {
-			assignments = append(assignments, assign)
-		}
+// returned returns the first value returned by the chunk in file through the
+// return statement ret, which is nil when the chunk ran to its end.
+func returned(file string, ret *ReturnStatement, results []Value) (Value, error) {
+	if ret == nil {
+		return nil, errors.New(limitMessage(Position{Filename: file}, "chunk has no return statement"))
 	}
-	return assignments
+	if len(results) == 0 {
+		return nil, errors.New(limitMessage(Position{Filename: file, Line: ret.TokenLine}, "chunk returns no value"))
+	}
+	return at(results, 0), nil
 }
 
 func (d *Decoder) findFieldByTag(rv reflect.Value, luaName string) string {
 	t := rv.Type()
 	for i := 0; i < t.NumField(); i++ {
 		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
 		tag := field.Tag.Get("lua")
 		if tag == "" {
 			tag = strings.ToLower(field.Name)
@@ -93,12 +257,104 @@ func (d *Decoder) findFieldByTag(rv reflect.Value, luaName string) string {
 	return ""
 }
 
-func (d *Decoder) setValue(field reflect.Value, val interface{}) error {
+// indirect walks down v through pointers, allocating them as needed, until it
+// finds an Unmarshaler, an encoding.TextUnmarshaler or a non-pointer value.
+// When decodingNil is set it stops at the first settable pointer so that the
+// caller can set it to nil. time.Time is returned as is so that the decoder
+// can accept more than its text form.
+func indirect(v reflect.Value, decodingNil bool) (Unmarshaler, encoding.TextUnmarshaler, reflect.Value) {
+	for {
+		if v.Type() == timeType {
+			return nil, nil, v
+		}
+		if v.Kind() != reflect.Ptr && v.CanAddr() {
+			switch u := v.Addr().Interface().(type) {
+			case Unmarshaler:
+				return u, nil, reflect.Value{}
+			case encoding.TextUnmarshaler:
+				return nil, u, reflect.Value{}
+			}
+		}
+		if v.Kind() != reflect.Ptr {
+			return nil, nil, v
+		}
+		if decodingNil && v.CanSet() {
+			return nil, nil, v
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Type().Elem() != timeType {
+			switch u := v.Interface().(type) {
+			case Unmarshaler:
+				return u, nil, reflect.Value{}
+			case encoding.TextUnmarshaler:
+				return nil, u, reflect.Value{}
+			}
+		}
+		v = v.Elem()
+	}
+}
+
+func (d *Decoder) setValue(field reflect.Value, val Value) error {
+	return d.decodeValue(field, val, make(map[*Table]bool))
+}
+
+// decodeValue sets field to val. visiting holds the tables being decoded,
+// so that a table containing itself fails with a *CycleError.
+func (d *Decoder) decodeValue(field reflect.Value, val Value, visiting map[*Table]bool) error {
 	if !field.CanSet() {
 		return fmt.Errorf("luar: cannot set unexported field")
 	}
+	if field.Type() == tableType {
+		if t, ok := val.(*Table); ok || val == nil {
+			field.Set(reflect.ValueOf(t))
+		}
+		return nil
+	}
+
+	u, tu, field := indirect(field, val == nil)
+	if u != nil {
+		return u.UnmarshalLua(val)
+	}
+	if tu != nil {
+		if str, ok := val.(string); ok {
+			return tu.UnmarshalText([]byte(str))
+		}
+		return nil
+	}
+
+	switch field.Type() {
+	case durationType:
+		return d.setDuration(field, val)
+	case timeType:
+		return d.setTime(field, val)
+	}
+
+	if tbl, ok := val.(*Table); ok {
+		if visiting[tbl] {
+			return &CycleError{Type: field.Type()}
+		}
+		visiting[tbl] = true
+		defer delete(visiting, tbl)
+	}
 
 	switch field.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if val == nil {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		if field.Kind() == reflect.Interface {
+			v, err := toGo(val)
+			if err != nil {
+				return err
+			}
+			goVal := reflect.ValueOf(v)
+			if goVal.IsValid() && goVal.Type().AssignableTo(field.Type()) {
+				field.Set(goVal)
+			}
+		}
 	case reflect.String:
 		if str, ok := val.(string); ok {
 			field.SetString(str)
@@ -107,6 +363,10 @@ func (d *Decoder) setValue(field reflect.Value, val interface{}) error {
 		if n, ok := toInt64(val); ok {
 			field.SetInt(n)
 		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, ok := toInt64(val); ok && n >= 0 {
+			field.SetUint(uint64(n))
+		}
 	case reflect.Float32, reflect.Float64:
 		field.SetFloat(toFloat64(val))
 	case reflect.Bool:
@@ -114,41 +374,55 @@ func (d *Decoder) setValue(field reflect.Value, val interface{}) error {
 			field.SetBool(b)
 		}
 	case reflect.Slice:
-		if slice, ok := val.([]interface{}); ok {
-			sliceType := field.Type()
-			elemType := sliceType.Elem()
-			newSlice := reflect.MakeSlice(sliceType, len(slice), len(slice))
-			for i, item := range slice {
-				elem := reflect.New(elemType).Elem()
-				if err := d.setValue(elem, item); err != nil {
-					continue
+		if tbl, ok := val.(*Table); ok {
+			n := tbl.Len()
+			newSlice := reflect.MakeSlice(field.Type(), n, n)
+			for i := 0; i < n; i++ {
+				if err := d.decodeValue(newSlice.Index(i), tbl.Get(int64(i+1)), visiting); err != nil {
+					return err
 				}
-				newSlice.Index(i).Set(elem)
 			}
 			field.Set(newSlice)
 		}
 	case reflect.Map:
-		if m, ok := val.(map[string]interface{}); ok {
+		if tbl, ok := val.(*Table); ok {
 			mapType := field.Type()
 			mapVal := reflect.MakeMap(mapType)
-			for k, v := range m {
-				key := reflect.ValueOf(k)
+			for _, k := range tbl.Keys() {
+				if isFunction(tbl.Get(k)) {
+					continue
+				}
+				key := reflect.New(mapType.Key()).Elem()
+				if key.Kind() == reflect.String {
+					ks, ok := keyString(k)
+					if !ok {
+						continue
+					}
+					key.SetString(ks)
+				} else if err := d.decodeValue(key, k, visiting); err != nil {
+					return err
+				}
 				elem := reflect.New(mapType.Elem()).Elem()
-				d.setValue(elem, v)
+				if err := d.decodeValue(elem, tbl.Get(k), visiting); err != nil {
+					return err
+				}
 				mapVal.SetMapIndex(key, elem)
 			}
 			field.Set(mapVal)
 		}
 	case reflect.Struct:
-		if m, ok := val.(map[string]interface{}); ok {
-			for k, v := range m {
-				fieldName := d.findFieldByTag(field, k)
+		if tbl, ok := val.(*Table); ok {
+			for _, k := range tbl.Keys() {
+				name, ok := k.(string)
+				if !ok {
+					continue
+				}
+				fieldName := d.findFieldByTag(field, name)
 				if fieldName == "" {
-					fieldName = k
+					continue
 				}
-				f := field.FieldByName(fieldName)
-				if f.IsValid() {
-					d.setValue(f, v)
+				if err := d.decodeValue(field.FieldByName(fieldName), tbl.Get(k), visiting); err != nil {
+					return err
 				}
 			}
 		}
@@ -157,140 +431,6 @@ func (d *Decoder) setValue(field reflect.Value, val interface{}) error {
 	return nil
 }
 
-func (d *Decoder) evalExpression(expr Expression) (interface{}, error) {
-	switch e := expr.(type) {
-	case *Identifier:
-		val := d.findVariable(e.Name)
-		return val, nil
-	case *NumberLiteral:
-		if e.IsInt {
-			return e.IntValue, nil
-		}
-		return e.Value, nil
-	case *StringLiteral:
-		return e.Value, nil
-	case *BooleanLiteral:
-		return e.Value, nil
-	case *NilLiteral:
-		return nil, nil
-	case *TableLiteral:
-		return d.evalTableLiteral(e)
-	case *BinaryExpression:
-		return d.evalBinaryExpression(e)
-	default:
-		return nil, nil
-	}
-}
-
-func (d *Decoder) findVariable(name string) interface{} {
-	assignments := d.getTopLevelAssignments()
-	for _, assign := range assignments {
-		if len(assign.Names) == 1 && assign.Names[0].Name == name && len(assign.Values) == 1 {
-			return d.evalExpressionValue(assign.Values[0])
-		}
-	}
-	return nil
-}
-
-func (d *Decoder) evalExpressionValue(expr Expression) interface{} {
-	val, _ := d.evalExpression(expr)
-	return val
-}
-
-func (d *Decoder) evalTableLiteral(t *TableLiteral) (interface{}, error) {
-	result := make(map[string]interface{})
-
-	for _, field := range t.Fields {
-		var key string
-
-		if ident, ok := field.Key.(*Identifier); ok {
-			key = ident.Name
-		} else if str, ok := field.Key.(*StringLiteral); ok {
-			key = str.Value
-		} else if num, ok := field.Key.(*NumberLiteral); ok {
-			key = strconv.FormatFloat(num.Value, 'f', -1, 64)
-		} else if idx, ok := field.Key.(*TableIndex); ok {
-			if ident, ok := idx.Key.(*Identifier); ok {
-				key = ident.Name
-			} else if str, ok := idx.Key.(*StringLiteral); ok {
-				key = str.Value
-			}
-		}
-
-		value := d.evalExpressionValue(field.Value)
-
-		if key != "" {
-			result[key] = value
-		} else {
-			result[strconv.Itoa(len(result))] = value
-		}
-	}
-
-	return result, nil
-}
-
-func (d *Decoder) evalBinaryExpression(e *BinaryExpression) (interface{}, error) {
-	left := d.evalExpressionValue(e.Left)
-	right := d.evalExpressionValue(e.Right)
-
-	switch e.Operator {
-	case PLUS:
-		if isNumber(left) && isNumber(right) {
-			return toFloat64(left) + toFloat64(right), nil
-		}
-		if isString(left) && isString(right) {
-			return toString(left) + toString(right), nil
-		}
-	case MINUS:
-		if isNumber(left) && isNumber(right) {
-			return toFloat64(left) - toFloat64(right), nil
-		}
-	case STAR:
-		if isNumber(left) && isNumber(right) {
-			return toFloat64(left) * toFloat64(right), nil
-		}
-	case SLASH:
-		if isNumber(left) && isNumber(right) {
-			return toFloat64(left) / toFloat64(right), nil
-		}
-	case EQ:
-		return reflect.DeepEqual(left, right), nil
-	case NE:
-		return !reflect.DeepEqual(left, right), nil
-	case LT:
-		if isNumber(left) && isNumber(right) {
-			return toFloat64(left) < toFloat64(right), nil
-		}
-	case LE:
-		if isNumber(left) && isNumber(right) {
-			return toFloat64(left) <= toFloat64(right), nil
-		}
-	case GT:
-		if isNumber(left) && isNumber(right) {
-			return toFloat64(left) > toFloat64(right), nil
-		}
-	case GE:
-		if isNumber(left) && isNumber(right) {
-			return toFloat64(left) >= toFloat64(right), nil
-		}
-	}
-
-	return nil, nil
-}
-
-func isNumber(v interface{}) bool {
-	switch v.(type) {
-	case int, int8, int16, int32, int64, float32, float64:
-		return true
-	}
-	return false
-}
-
-func isString(v interface{}) bool {
-	_, ok := v.(string)
-	return ok
-}
-
 func toFloat64(v interface{}) float64 {
 	switch n := v.(type) {
 	case float64:
@@ -317,15 +457,41 @@ func toInt64(v interface{}) (int64, bool) {
 	return 0, false
 }
 
-func toString(v interface{}) string {
-	s, _ := v.(string)
-	return s
+// UnsupportedTypeError is returned by Encode for values that have no Lua
+// representation, such as channels and functions.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "luar: unsupported type: " + e.Type.String()
+}
+
+// CycleError is returned by Encode when a value refers back to itself through
+// a pointer, map or slice, and by Decode when a table contains itself.
+type CycleError struct {
+	Type reflect.Type
+}
+
+func (e *CycleError) Error() string {
+	return "luar: encountered a cycle via " + e.Type.String()
 }
 
 type Encoder struct {
 	w           io.Writer
+	buf         bytes.Buffer
+	seen        map[seenKey]struct{}
 	indent      string
 	indentLevel int
+	mode        Mode
+}
+
+// seenKey identifies a pointer, map or slice currently being encoded. Slices
+// also record their length since a slice and a prefix of it share a pointer.
+type seenKey struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
 }
 
 func Marshal(v interface{}) ([]byte, error) {
@@ -342,11 +508,64 @@ func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{w: w, indent: "    "}
 }
 
+// Encode writes the Lua encoding of v to the underlying writer. The output is
+// buffered and only written once encoding succeeded, so a failed Encode never
+// leaves partial output behind.
 func (e *Encoder) Encode(v interface{}) error {
+	e.buf.Reset()
+	e.seen = make(map[seenKey]struct{})
+	e.indentLevel = 0
+
+	if err := e.encode(v); err != nil {
+		return err
+	}
+
+	n, err := e.w.Write(e.buf.Bytes())
+	if err == nil && n < e.buf.Len() {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// SetMode sets the chunk shape written for structs. Other values are written
+// as the expression returned by the chunk in ModeReturn and ModeModule.
+func (e *Encoder) SetMode(m Mode) {
+	e.mode = m
+}
+
+func (e *Encoder) encode(v interface{}) error {
 	rv := reflect.ValueOf(v)
 	if rv.Kind() == reflect.Ptr {
 		rv = rv.Elem()
 	}
+	if !rv.IsValid() {
+		// nil sets no globals, and the other modes return it.
+		if e.mode != ModeGlobals {
+			e.writeString("return nil\n")
+		}
+		return nil
+	}
+
+	switch e.mode {
+	case ModeReturn:
+		e.writeString("return ")
+		if err := e.encodeChunkValue(rv); err != nil {
+			return err
+		}
+		e.writeString("\n")
+		return nil
+	case ModeModule:
+		e.writeString("local M = ")
+		if err := e.encodeChunkValue(rv); err != nil {
+			return err
+		}
+		e.writeString("\n\nreturn M\n")
+		return nil
+	}
+
+	if m, ok := marshalerFor(rv); ok {
+		return e.encodeMarshaler(rv, m)
+	}
 
 	if rv.Kind() == reflect.Struct {
 		return e.encodeStructAsAssignments(rv)
@@ -355,6 +574,29 @@ func (e *Encoder) Encode(v interface{}) error {
 	return e.encodeValue(rv, false)
 }
 
+// encodeChunkValue writes the table returned by a ModeReturn or ModeModule
+// chunk, with one struct field per line.
+func (e *Encoder) encodeChunkValue(v reflect.Value) error {
+	if _, ok := marshalerFor(v); ok || v.Kind() != reflect.Struct {
+		return e.encodeValue(v, false)
+	}
+	return e.encodeStructMultiline(v)
+}
+
+// enter records that v is being encoded and reports a CycleError if it
+// already is. The returned function must be called once v is done.
+func (e *Encoder) enter(v reflect.Value) (func(), error) {
+	key := seenKey{ptr: v.Pointer(), typ: v.Type()}
+	if v.Kind() == reflect.Slice {
+		key.len = v.Len()
+	}
+	if _, ok := e.seen[key]; ok {
+		return nil, &CycleError{Type: v.Type()}
+	}
+	e.seen[key] = struct{}{}
+	return func() { delete(e.seen, key) }, nil
+}
+
 func (e *Encoder) encodeStructAsAssignments(v reflect.Value) error {
 	t := v.Type()
 
@@ -370,28 +612,132 @@ func (e *Encoder) encodeStructAsAssignments(v reflect.Value) error {
 			continue
 		}
 
+		e.writeDoc(field, "", i == 0)
 		e.writeString(tag)
 		e.writeString(" = ")
-		e.encodeValue(fieldVal, true)
+		if err := e.encodeValue(fieldVal, true); err != nil {
+			return err
+		}
 		e.writeString("\n")
 	}
 
 	return nil
 }
 
+// writeDoc writes the field's luadoc tag as `--` comment lines, one per line
+// of the tag. Documented fields other than the first are preceded by a blank
+// line so that each comment stays visually attached to its field.
+func (e *Encoder) writeDoc(field reflect.StructField, prefix string, first bool) {
+	doc := field.Tag.Get("luadoc")
+	if doc == "" {
+		return
+	}
+	if !first {
+		e.writeString("\n")
+	}
+	for _, line := range strings.Split(doc, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		e.writeString(prefix)
+		if line == "" {
+			e.writeString("--\n")
+			continue
+		}
+		e.writeString("-- ")
+		e.writeString(line)
+		e.writeString("\n")
+	}
+}
+
+func hasDoc(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("luadoc") != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalerFor returns the Marshaler or encoding.TextMarshaler implemented by
+// v or, if v is addressable, by a pointer to v.
+func marshalerFor(v reflect.Value) (interface{}, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+	if !v.CanInterface() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		return nil, false
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		switch m := v.Addr().Interface().(type) {
+		case Marshaler, encoding.TextMarshaler:
+			return m, true
+		}
+	}
+	switch m := v.Interface().(type) {
+	case Marshaler, encoding.TextMarshaler:
+		return m, true
+	}
+	return nil, false
+}
+
+func (e *Encoder) encodeMarshaler(v reflect.Value, m interface{}) error {
+	switch m := m.(type) {
+	case Marshaler:
+		b, err := m.MarshalLua()
+		if err != nil {
+			return &MarshalerError{Type: v.Type(), Err: err}
+		}
+		if err := checkExpression(b); err != nil {
+			return &MarshalerError{Type: v.Type(), Err: err}
+		}
+		e.writeString(string(b))
+	case encoding.TextMarshaler:
+		b, err := m.MarshalText()
+		if err != nil {
+			return &MarshalerError{Type: v.Type(), Err: err}
+		}
+		e.writeString(Quote(string(b)))
+	}
+	return nil
+}
+
+// checkExpression reports whether b holds exactly one Lua expression.
+func checkExpression(b []byte) error {
+	p := NewParser(string(b))
+	if nesting := p.guard(func() { p.protect(func() { p.parseExpression() }) }); nesting != nil {
+		return nesting
+	}
+	if len(p.errors) > 0 {
+		return errors.New(p.errorsAsString())
+	}
+	if !p.check(EOF) {
+		return fmt.Errorf("unexpected %s after expression", p.currentToken().Type)
+	}
+	return nil
+}
+
 func (e *Encoder) encodeValue(v reflect.Value, isTableValue bool) error {
 	if !v.IsValid() {
 		e.writeString("nil")
 		return nil
 	}
 
+	if m, ok := marshalerFor(v); ok {
+		return e.encodeMarshaler(v, m)
+	}
+
 	switch v.Kind() {
 	case reflect.String:
-		e.writeString(fmt.Sprintf("%q", v.String()))
+		e.writeString(Quote(v.String()))
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == durationType {
+			e.encodeDuration(v)
+			return nil
+		}
 		e.writeString(fmt.Sprintf("%d", v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.writeString(fmt.Sprintf("%d", v.Uint()))
 	case reflect.Float32, reflect.Float64:
-		e.writeString(fmt.Sprintf("%g", v.Float()))
+		e.encodeFloat(v.Float())
 	case reflect.Bool:
 		if v.Bool() {
 			e.writeString("true")
@@ -403,48 +749,99 @@ func (e *Encoder) encodeValue(v reflect.Value, isTableValue bool) error {
 			e.writeString("nil")
 			return nil
 		}
+		leave, err := e.enter(v)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		fallthrough
+	case reflect.Array:
 		e.writeString("{")
 		e.indentLevel++
 		for i := 0; i < v.Len(); i++ {
 			if i > 0 {
 				e.writeString(", ")
 			}
-			e.encodeValue(v.Index(i), false)
+			if err := e.encodeValue(v.Index(i), false); err != nil {
+				return err
+			}
 		}
 		e.indentLevel--
 		e.writeString("}")
 	case reflect.Map:
+		if v.IsNil() {
+			e.writeString("nil")
+			return nil
+		}
+		leave, err := e.enter(v)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		keys, err := e.encodeMapKeys(v)
+		if err != nil {
+			return err
+		}
 		e.writeString("{")
 		e.indentLevel++
-		keys := v.MapKeys()
-		first := true
-		for _, key := range keys {
-			if !first {
+		for i, key := range keys {
+			if i > 0 {
 				e.writeString(", ")
 			}
-			first = false
-			e.writeString(e.getLuaTag(key))
+			e.writeString(key.lua)
 			e.writeString(" = ")
-			e.encodeValue(v.MapIndex(key), true)
+			if err := e.encodeValue(v.MapIndex(key.v), true); err != nil {
+				return err
+			}
 		}
 		e.indentLevel--
 		e.writeString("}")
 	case reflect.Struct:
-		e.encodeStruct(v)
+		return e.encodeStruct(v)
 	case reflect.Ptr:
+		if v.IsNil() {
+			e.writeString("nil")
+			return nil
+		}
+		leave, err := e.enter(v)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		return e.encodeValue(v.Elem(), isTableValue)
+	case reflect.Interface:
 		if v.IsNil() {
 			e.writeString("nil")
 			return nil
 		}
 		return e.encodeValue(v.Elem(), isTableValue)
 	default:
-		e.writeString("nil")
+		return &UnsupportedTypeError{Type: v.Type()}
 	}
 	return nil
 }
 
+// encodeFloat writes f in a form Lua can read back. Infinities and NaN have
+// no literal syntax, so they are written as the divisions that produce them.
+func (e *Encoder) encodeFloat(f float64) {
+	switch {
+	case math.IsInf(f, 1):
+		e.writeString("1/0")
+	case math.IsInf(f, -1):
+		e.writeString("-1/0")
+	case math.IsNaN(f):
+		e.writeString("0/0")
+	default:
+		e.writeString(fmt.Sprintf("%g", f))
+	}
+}
+
 func (e *Encoder) encodeStruct(v reflect.Value) error {
 	t := v.Type()
+	if hasDoc(t) {
+		return e.encodeStructMultiline(v)
+	}
+
 	e.writeString("{")
 	e.indentLevel++
 
@@ -467,7 +864,9 @@ func (e *Encoder) encodeStruct(v reflect.Value) error {
 
 		e.writeString(tag)
 		e.writeString(" = ")
-		e.encodeValue(fieldVal, true)
+		if err := e.encodeValue(fieldVal, true); err != nil {
+			return err
+		}
 	}
 
 	e.indentLevel--
@@ -475,18 +874,128 @@ func (e *Encoder) encodeStruct(v reflect.Value) error {
 	return nil
 }
 
-func (e *Encoder) getLuaTag(v reflect.Value) string {
-	if v.Kind() != reflect.Struct {
-		return ""
-	}
+// encodeStructMultiline writes a table constructor with one field per line,
+// which leaves room for the fields' documentation comments.
+func (e *Encoder) encodeStructMultiline(v reflect.Value) error {
 	t := v.Type()
+	e.writeString("{\n")
+	e.indentLevel++
+	prefix := strings.Repeat(e.indent, e.indentLevel)
+
 	for i := 0; i < t.NumField(); i++ {
 		field := t.Field(i)
-		return field.Tag.Get("lua")
+		tag := field.Tag.Get("lua")
+		if tag == "" {
+			tag = strings.ToLower(field.Name)
+		}
+
+		e.writeDoc(field, prefix, i == 0)
+		e.writeString(prefix)
+		e.writeString(tag)
+		e.writeString(" = ")
+		if err := e.encodeValue(v.Field(i), true); err != nil {
+			return err
+		}
+		e.writeString(",\n")
 	}
-	return ""
+
+	e.indentLevel--
+	e.writeString(strings.Repeat(e.indent, e.indentLevel))
+	e.writeString("}")
+	return nil
+}
+
+// mapKey is a map key rendered as a table key. numeric is set for integer
+// keys, which sort by value rather than by text.
+type mapKey struct {
+	v       reflect.Value
+	text    string
+	lua     string
+	numeric bool
+}
+
+func (k mapKey) less(o mapKey) bool {
+	if k.numeric && o.numeric {
+		if k.v.CanInt() {
+			return k.v.Int() < o.v.Int()
+		}
+		return k.v.Uint() < o.v.Uint()
+	}
+	return k.text < o.text
+}
+
+// encodeMapKeys renders the keys of the map v as Lua table keys, sorted so
+// that the output is deterministic: integers in order, other keys by text.
+func (e *Encoder) encodeMapKeys(v reflect.Value) ([]mapKey, error) {
+	keys := make([]mapKey, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		var text, lua string
+		numeric := false
+		if m, ok := marshalerFor(k); ok && k.Kind() != reflect.String {
+			tm, ok := m.(encoding.TextMarshaler)
+			if !ok {
+				return nil, &MarshalerError{Type: k.Type(), Err: fmt.Errorf("map key must implement encoding.TextMarshaler")}
+			}
+			b, err := tm.MarshalText()
+			if err != nil {
+				return nil, &MarshalerError{Type: k.Type(), Err: err}
+			}
+			text = string(b)
+			lua = tableKey(text)
+		} else {
+			switch k.Kind() {
+			case reflect.String:
+				text = k.String()
+				lua = tableKey(text)
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				text = strconv.FormatInt(k.Int(), 10)
+				lua = "[" + text + "]"
+				numeric = true
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				text = strconv.FormatUint(k.Uint(), 10)
+				lua = "[" + text + "]"
+				numeric = true
+			case reflect.Bool:
+				text = strconv.FormatBool(k.Bool())
+				lua = "[" + text + "]"
+			default:
+				return nil, fmt.Errorf("luar: unsupported map key type %s", k.Type())
+			}
+		}
+		keys = append(keys, mapKey{v: k, text: text, lua: lua, numeric: numeric})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	return keys, nil
+}
+
+// tableKey renders s as a table constructor key: a bare name when s is a
+// valid Lua identifier, a bracketed string otherwise.
+func tableKey(s string) string {
+	if isIdentifier(s) {
+		return s
+	}
+	return "[" + Quote(s) + "]"
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	if _, ok := keywords[s]; ok {
+		return false
+	}
+	for i, ch := range s {
+		if ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') {
+			continue
+		}
+		if i > 0 && ch >= '0' && ch <= '9' {
+			continue
+		}
+		return false
+	}
+	return true
 }
 
 func (e *Encoder) writeString(s string) {
-	e.w.Write([]byte(s))
+	e.buf.WriteString(s)
 }
@@ -1,6 +1,10 @@
 package luar
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
 	"os"
 	"strings"
 	"testing"
@@ -208,6 +212,36 @@ func TestMarshal_NestedStruct(t *testing.T) {
 	}
 }
 
+func TestMarshal_MapKeyOrder(t *testing.T) {
+	config := struct {
+		Ints  map[int]string  `lua:"ints"`
+		Uints map[uint8]bool  `lua:"uints"`
+		Names map[string]bool `lua:"names"`
+	}{
+		Ints:  map[int]string{10: "c", 2: "b", -1: "a"},
+		Uints: map[uint8]bool{200: true, 30: true},
+		Names: map[string]bool{"b10": true, "b2": true},
+	}
+
+	data, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	output := string(data)
+	for _, order := range [][]string{
+		{"[-1] = ", "[2] = ", "[10] = "},
+		{"[30] = ", "[200] = "},
+		{"b10 = ", "b2 = "},
+	} {
+		for i := 1; i < len(order); i++ {
+			if a, b := strings.Index(output, order[i-1]), strings.Index(output, order[i]); a < 0 || a > b {
+				t.Errorf("expected %q before %q, got: %s", order[i-1], order[i], output)
+			}
+		}
+	}
+}
+
 func TestEncoder(t *testing.T) {
 	config := SimpleConfig{
 		Name: "Test",
@@ -299,3 +333,380 @@ func TestRoundTrip(t *testing.T) {
 		t.Errorf("Port: expected %d, got %d", original.Port, decoded.Port)
 	}
 }
+
+type LogLevel int
+
+const (
+	LevelInfo LogLevel = iota
+	LevelWarn
+)
+
+func (l LogLevel) MarshalLua() ([]byte, error) {
+	switch l {
+	case LevelInfo:
+		return []byte(`"info"`), nil
+	case LevelWarn:
+		return []byte(`"warn"`), nil
+	}
+	return nil, fmt.Errorf("unknown level %d", l)
+}
+
+func (l *LogLevel) UnmarshalLua(v Value) error {
+	switch v {
+	case "info":
+		*l = LevelInfo
+	case "warn":
+		*l = LevelWarn
+	default:
+		return fmt.Errorf("unknown level %v", v)
+	}
+	return nil
+}
+
+type badMarshaler struct{}
+
+func (badMarshaler) MarshalLua() ([]byte, error) { return []byte(`x = 1`), nil }
+
+type rawMarshaler string
+
+func (r rawMarshaler) MarshalLua() ([]byte, error) { return []byte(r), nil }
+
+func TestUnmarshal_Unmarshaler(t *testing.T) {
+	type LogConfig struct {
+		Level  LogLevel             `lua:"level"`
+		Levels []LogLevel           `lua:"levels"`
+		ByName map[string]*LogLevel `lua:"by_name"`
+		Addr   net.IP               `lua:"addr"`
+	}
+
+	data := []byte(`
+level = "warn"
+levels = {"info", "warn"}
+by_name = {db = "warn"}
+addr = "10.0.0.1"
+`)
+	var config LogConfig
+	if err := Unmarshal(data, &config); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if config.Level != LevelWarn {
+		t.Errorf("Level: expected %d, got %d", LevelWarn, config.Level)
+	}
+	if len(config.Levels) != 2 || config.Levels[0] != LevelInfo || config.Levels[1] != LevelWarn {
+		t.Errorf("Levels: got %v", config.Levels)
+	}
+	if lvl := config.ByName["db"]; lvl == nil || *lvl != LevelWarn {
+		t.Errorf("ByName[db]: got %v", lvl)
+	}
+	if !config.Addr.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Addr: expected 10.0.0.1, got %v", config.Addr)
+	}
+
+	if err := Unmarshal([]byte(`level = "trace"`), &config); err == nil {
+		t.Error("expected error from UnmarshalLua")
+	}
+}
+
+func TestMarshal_Marshaler(t *testing.T) {
+	type LogConfig struct {
+		Level  LogLevel            `lua:"level"`
+		Levels map[string]LogLevel `lua:"levels"`
+		Addr   net.IP              `lua:"addr"`
+	}
+
+	config := LogConfig{
+		Level:  LevelWarn,
+		Levels: map[string]LogLevel{"db": LevelInfo, "http-server": LevelWarn},
+		Addr:   net.ParseIP("10.0.0.1"),
+	}
+	data, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	output := string(data)
+	for _, want := range []string{
+		`level = "warn"`,
+		`levels = {db = "info", ["http-server"] = "warn"}`,
+		`addr = "10.0.0.1"`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected '%s' in output, got: %s", want, output)
+		}
+	}
+
+	var decoded LogConfig
+	if err := Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decoded.Levels["http-server"] != LevelWarn {
+		t.Errorf("round trip: got %v", decoded.Levels)
+	}
+}
+
+func TestMarshal_MarshalerError(t *testing.T) {
+	_, err := Marshal(struct {
+		Level LogLevel `lua:"level"`
+	}{Level: 7})
+	var merr *MarshalerError
+	if !errors.As(err, &merr) {
+		t.Fatalf("expected MarshalerError, got %v", err)
+	}
+
+	_, err = Marshal(struct {
+		Bad badMarshaler `lua:"bad"`
+	}{})
+	if !errors.As(err, &merr) {
+		t.Fatalf("expected MarshalerError for invalid expression, got %v", err)
+	}
+
+	for _, raw := range []rawMarshaler{"{1, =, 2}", "{x = 1} + ", rawMarshaler(strings.Repeat("{", 300))} {
+		_, err = Marshal(struct {
+			Raw rawMarshaler `lua:"raw"`
+		}{raw})
+		if !errors.As(err, &merr) {
+			t.Errorf("%.20s: expected MarshalerError, got %v", raw, err)
+		}
+	}
+	var nesting *NestingLimitError
+	if !errors.As(err, &nesting) {
+		t.Errorf("got %v, want a nesting error", err)
+	}
+	if _, err := Marshal(struct {
+		Raw rawMarshaler `lua:"raw"`
+	}{"{x = 1, 2}"}); err != nil {
+		t.Error(err)
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write(p []byte) (int, error) { return 0, w.err }
+
+type recordingWriter struct{ writes int }
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func TestEncoder_Errors(t *testing.T) {
+	type WithChan struct {
+		Name string   `lua:"name"`
+		Ch   chan int `lua:"ch"`
+	}
+
+	w := &recordingWriter{}
+	err := NewEncoder(w).Encode(WithChan{Name: "x", Ch: make(chan int)})
+	var typeErr *UnsupportedTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("expected UnsupportedTypeError, got %v", err)
+	}
+	if w.writes != 0 {
+		t.Errorf("expected no output on failed encode, got %d writes", w.writes)
+	}
+
+	writeErr := errors.New("disk full")
+	if err := NewEncoder(failingWriter{writeErr}).Encode(SimpleConfig{Name: "x"}); !errors.Is(err, writeErr) {
+		t.Errorf("expected writer error, got %v", err)
+	}
+}
+
+func TestEncoder_Cycle(t *testing.T) {
+	type Node struct {
+		Name string `lua:"name"`
+		Next *Node  `lua:"next"`
+	}
+
+	n := &Node{Name: "a"}
+	n.Next = &Node{Name: "b", Next: n}
+	_, err := Marshal(n)
+	var cycleErr *CycleError
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("expected CycleError, got %v", err)
+	}
+
+	m := map[string]interface{}{}
+	m["self"] = m
+	if _, err := Marshal(m); !errors.As(err, &cycleErr) {
+		t.Fatalf("expected CycleError for map, got %v", err)
+	}
+
+	shared := &Node{Name: "shared"}
+	type Pair struct {
+		A *Node `lua:"a"`
+		B *Node `lua:"b"`
+	}
+	if _, err := Marshal(Pair{A: shared, B: shared}); err != nil {
+		t.Errorf("shared pointers are not a cycle: %v", err)
+	}
+}
+
+func TestUnmarshal_Cycle(t *testing.T) {
+	type Node struct {
+		Self *Node `lua:"self"`
+	}
+	src := []byte("local t = {}\nt.self = t\nx = t\nlist = {t}")
+	var cycleErr *CycleError
+	var m map[string]interface{}
+	if err := Unmarshal(src, &m); !errors.As(err, &cycleErr) {
+		t.Errorf("expected CycleError for map, got %v", err)
+	}
+	var s struct {
+		X Node `lua:"x"`
+	}
+	if err := Unmarshal(src, &s); !errors.As(err, &cycleErr) {
+		t.Errorf("expected CycleError for struct, got %v", err)
+	}
+
+	var shared struct {
+		A, B map[string]int
+	}
+	if err := Unmarshal([]byte("local t = {x = 1}\na = t\nb = t"), &shared); err != nil || shared.B["x"] != 1 {
+		t.Errorf("shared tables are not a cycle: %+v, %v", shared, err)
+	}
+}
+
+func TestRoundTrip_Numbers(t *testing.T) {
+	type Numbers struct {
+		Neg   int     `lua:"neg"`
+		Count uint16  `lua:"count"`
+		Inf   float64 `lua:"inf"`
+	}
+
+	original := Numbers{Neg: -5, Count: 7, Inf: math.Inf(-1)}
+	data, err := Marshal(original)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var decoded Numbers
+	if err := Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decoded != original {
+		t.Errorf("expected %+v, got %+v from %s", original, decoded, data)
+	}
+}
+
+func TestEncoder_Modes(t *testing.T) {
+	config := SimpleConfig{Name: "MyApp", Port: 8080}
+
+	tests := []struct {
+		mode Mode
+		want string
+	}{
+		{ModeGlobals, "name = \"MyApp\"\nport = 8080\n"},
+		{ModeReturn, "return {\n    name = \"MyApp\",\n    port = 8080,\n}\n"},
+		{ModeModule, "local M = {\n    name = \"MyApp\",\n    port = 8080,\n}\n\nreturn M\n"},
+	}
+
+	for _, tt := range tests {
+		var buf strings.Builder
+		enc := NewEncoder(&buf)
+		enc.SetMode(tt.mode)
+		if err := enc.Encode(config); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("mode %d: expected %q, got %q", tt.mode, tt.want, buf.String())
+		}
+
+		var decoded SimpleConfig
+		dec := NewDecoder(strings.NewReader(buf.String()))
+		dec.SetMode(tt.mode)
+		if err := dec.Decode(&decoded); err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if decoded != config {
+			t.Errorf("mode %d: expected %+v, got %+v", tt.mode, config, decoded)
+		}
+	}
+
+	// A nil pointer encodes to a chunk without values in every mode.
+	for _, mode := range []Mode{ModeGlobals, ModeReturn, ModeModule} {
+		var buf strings.Builder
+		enc := NewEncoder(&buf)
+		enc.SetMode(mode)
+		if err := enc.Encode((*SimpleConfig)(nil)); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		decoded := &SimpleConfig{Name: "old"}
+		dec := NewDecoder(strings.NewReader(buf.String()))
+		dec.SetMode(mode)
+		if err := dec.Decode(&decoded); err != nil {
+			t.Errorf("mode %d: decoding %q: %v", mode, buf.String(), err)
+		}
+		if mode != ModeGlobals && decoded != nil {
+			t.Errorf("mode %d: expected nil, got %+v", mode, decoded)
+		}
+	}
+}
+
+func TestDecoder_ModeReturnLocals(t *testing.T) {
+	data := `
+local port = 8080
+local M = {name = "app", port = port}
+return M
+`
+	var config SimpleConfig
+	dec := NewDecoder(strings.NewReader(data))
+	dec.SetMode(ModeReturn)
+	if err := dec.Decode(&config); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if config.Name != "app" || config.Port != 8080 {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	dec = NewDecoder(strings.NewReader(`name = "app"`))
+	dec.SetMode(ModeModule)
+	if err := dec.Decode(&config); err == nil {
+		t.Error("expected error for chunk without return")
+	}
+}
+
+func TestMarshal_Doc(t *testing.T) {
+	type DBConfig struct {
+		Host string `lua:"host" luadoc:"Database host name."`
+		Port int    `lua:"port" luadoc:"TCP port.\nDefaults to 5432."`
+	}
+	type DocConfig struct {
+		Name     string   `lua:"name" luadoc:"Application name."`
+		Debug    bool     `lua:"debug"`
+		Database DBConfig `lua:"database" luadoc:"Connection settings."`
+	}
+
+	config := DocConfig{Name: "MyApp", Database: DBConfig{Host: "localhost", Port: 5432}}
+	data, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	want := `-- Application name.
+name = "MyApp"
+debug = false
+
+-- Connection settings.
+database = {
+    -- Database host name.
+    host = "localhost",
+
+    -- TCP port.
+    -- Defaults to 5432.
+    port = 5432,
+}
+`
+	if string(data) != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, data)
+	}
+
+	var decoded DocConfig
+	if err := Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decoded != config {
+		t.Errorf("round trip: expected %+v, got %+v", config, decoded)
+	}
+}
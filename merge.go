@@ -0,0 +1,289 @@
+package luar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// MergeStrategy says how Merge combines a value with the value it overrides.
+type MergeStrategy int
+
+const (
+	// MergeDeep merges a table into the table it overrides key by key. A
+	// non-empty sequence, like any other value, replaces the value it
+	// overrides.
+	MergeDeep MergeStrategy = iota
+	// MergeReplace replaces the value it overrides, tables included.
+	MergeReplace
+	// MergeAppend appends a sequence to the sequence it overrides.
+	MergeAppend
+)
+
+// deletion is the type of Delete, a value that cannot be indexed or changed.
+type deletion int
+
+// Delete is merged to remove a key, since a table cannot hold nil. Files
+// loaded with MergeFiles can use it as the global delete:
+//
+//	cache = delete
+const Delete deletion = 0
+
+// Merge merges src into t, overriding the values of t with those of src.
+// Tables are merged with MergeDeep unless strategies selects another
+// strategy for their path: the keys leading to them joined by dots, such as
+// "services.db.hosts", where a * matches any key. The tables of src are
+// copied, so src can be merged again or changed afterwards.
+func (t *Table) Merge(src *Table, strategies map[string]MergeStrategy) {
+	m := &merger{seen: make(map[[2]*Table]bool), copies: make(map[*Table]*Table)}
+	for path, strategy := range strategies {
+		m.patterns = append(m.patterns, mergePattern{strings.Split(path, "."), strategy})
+	}
+	// Patterns with fewer wildcards are more specific and tried first.
+	sort.Slice(m.patterns, func(i, j int) bool {
+		a, b := m.patterns[i], m.patterns[j]
+		if a.wildcards() != b.wildcards() {
+			return a.wildcards() < b.wildcards()
+		}
+		return strings.Join(a.path, ".") < strings.Join(b.path, ".")
+	})
+	m.merge(t, src, nil)
+}
+
+// mergePattern selects a strategy for the paths it matches.
+type mergePattern struct {
+	path     []string
+	strategy MergeStrategy
+}
+
+func (p mergePattern) wildcards() int {
+	n := 0
+	for _, key := range p.path {
+		if key == "*" {
+			n++
+		}
+	}
+	return n
+}
+
+func (p mergePattern) matches(path []string) bool {
+	if len(p.path) != len(path) {
+		return false
+	}
+	for i, key := range p.path {
+		if key != "*" && key != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// merger holds the state of a call to Merge: seen records the pairs of
+// tables merged so far, so that cycles end, and copies the tables copied.
+type merger struct {
+	patterns []mergePattern
+	seen     map[[2]*Table]bool
+	copies   map[*Table]*Table
+}
+
+func (m *merger) strategy(path []string) MergeStrategy {
+	for _, p := range m.patterns {
+		if p.matches(path) {
+			return p.strategy
+		}
+	}
+	return MergeDeep
+}
+
+func (m *merger) merge(dst, src *Table, path []string) {
+	if m.seen[[2]*Table{dst, src}] {
+		return
+	}
+	m.seen[[2]*Table{dst, src}] = true
+
+	for _, k := range src.Keys() {
+		v := src.Get(k)
+		if v == Delete {
+			dst.Set(k, nil)
+			continue
+		}
+		name, _ := keyString(k)
+		keyPath := append(path[:len(path):len(path)], name)
+		from, _ := v.(*Table)
+		to, _ := dst.Get(k).(*Table)
+		if from != nil && to != nil {
+			switch m.strategy(keyPath) {
+			case MergeDeep:
+				if from.Len() == 0 || !from.IsSequence() {
+					m.merge(to, from, keyPath)
+					continue
+				}
+			case MergeAppend:
+				if to.IsSequence() && from.IsSequence() {
+					for i := 1; i <= from.Len(); i++ {
+						if e := from.Get(int64(i)); e != Delete {
+							to.Append(m.copy(e))
+						}
+					}
+					continue
+				}
+			}
+		}
+		dst.Set(k, m.copy(v))
+	}
+}
+
+// copy returns a copy of v without the Delete values in its tables.
+func (m *merger) copy(v Value) Value {
+	t, ok := v.(*Table)
+	if !ok {
+		return v
+	}
+	if c, ok := m.copies[t]; ok {
+		return c
+	}
+	c := NewTable()
+	m.copies[t] = c
+	for _, k := range t.Keys() {
+		if e := t.Get(k); e != Delete {
+			c.Set(k, m.copy(e))
+		}
+	}
+	return c
+}
+
+// mergeStrategies returns the strategies selected by the luamerge tags of
+// the fields of t and of the structs it holds, by path. The values of maps
+// have a * in their path.
+func mergeStrategies(t reflect.Type) (map[string]MergeStrategy, error) {
+	strategies := make(map[string]MergeStrategy)
+	err := addMergeStrategies(strategies, t, nil, make(map[reflect.Type]bool))
+	return strategies, err
+}
+
+func addMergeStrategies(strategies map[string]MergeStrategy, t reflect.Type, path []string, visiting map[reflect.Type]bool) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if visiting[t] {
+		return nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	switch t.Kind() {
+	case reflect.Map:
+		return addMergeStrategies(strategies, t.Elem(), append(path[:len(path):len(path)], "*"), visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := field.Tag.Get("lua")
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			fieldPath := append(path[:len(path):len(path)], name)
+			if tag, ok := field.Tag.Lookup("luamerge"); ok {
+				strategy, err := parseMergeStrategy(tag)
+				if err != nil {
+					return fmt.Errorf("luar: field %s: %v", field.Name, err)
+				}
+				strategies[strings.Join(fieldPath, ".")] = strategy
+			}
+			if err := addMergeStrategies(strategies, field.Type, fieldPath, visiting); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseMergeStrategy(s string) (MergeStrategy, error) {
+	switch s {
+	case "deep":
+		return MergeDeep, nil
+	case "replace":
+		return MergeReplace, nil
+	case "append":
+		return MergeAppend, nil
+	}
+	return 0, fmt.Errorf("unknown merge strategy %q", s)
+}
+
+// MergeFiles runs each of the named files on its own and merges their
+// globals in order, so that each file overrides parts of the files before
+// it, then decodes the result into v. In ModeReturn and ModeModule the
+// tables the files return are merged instead. A luamerge tag on a field of
+// v selects the strategy for it: "deep", "replace" or "append".
+//
+// Unlike with LoadFiles, a file cannot read the values set by the files
+// before it, but it can remove them by assigning delete.
+func (d *Decoder) MergeFiles(v interface{}, names ...string) error {
+	return d.mergeFiles(context.Background(), v, names, nil)
+}
+
+// mergeFiles is MergeFiles, stopping when ctx is done and recording the
+// files read in src unless it is nil.
+func (d *Decoder) mergeFiles(ctx context.Context, v interface{}, names []string, src *sources) error {
+	rv, err := pointerTo(v)
+	if err != nil {
+		return err
+	}
+	strategies, err := mergeStrategies(rv.Type())
+	if err != nil {
+		return err
+	}
+	merged := NewTable()
+	for _, name := range names {
+		c, err := d.readFile(name, src)
+		if err != nil {
+			return err
+		}
+		t, err := d.layer(ctx, c, src)
+		if err != nil {
+			return err
+		}
+		merged.Merge(t, strategies)
+	}
+	return d.setValue(rv, merged)
+}
+
+// layer runs c on its own until ctx is done and returns its globals, or in
+// ModeReturn and ModeModule the table it returns.
+func (d *Decoder) layer(ctx context.Context, c chunk, src *sources) (*Table, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &CanceledError{Pos: Position{Filename: c.file}, Err: err}
+	}
+	in := d.newInterpreter(ctx, src)
+	if in.globals.Get("delete") == nil {
+		in.globals.Set("delete", Delete)
+	}
+	preloaded := snapshot(in.globals)
+	results, err := in.runChunk(c)
+	if err != nil {
+		return nil, err
+	}
+	if d.mode == ModeGlobals {
+		return assigned(in.globals, preloaded), nil
+	}
+	v, err := returned(c.file, in.ret, results)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := v.(*Table)
+	if !ok {
+		return nil, errors.New(limitMessage(Position{Filename: c.file, Line: in.ret.TokenLine}, fmt.Sprintf("chunk returns a %s value, not a table", typeName(v))))
+	}
+	return t, nil
+}
+
+// MergeFiles merges the globals of the named files in order and decodes
+// the result into v.
+func MergeFiles(v interface{}, names ...string) error {
+	return NewDecoder(nil).MergeFiles(v, names...)
+}
@@ -0,0 +1,224 @@
+package luar
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func evalTable(t *testing.T, src string) *Table {
+	t.Helper()
+	var tbl *Table
+	if err := Unmarshal([]byte(src), &tbl); err != nil {
+		t.Fatal(err)
+	}
+	return tbl
+}
+
+func TestTable_Merge(t *testing.T) {
+	base := `
+name = "web"
+gone = 1
+tags = {"a"}
+db = {host = "h", port = 1, hosts = {"x"}}
+services = {api = {hosts = {"a1"}}, web = {hosts = {"w1"}}}
+`
+	tests := []struct {
+		name       string
+		src        string
+		strategies map[string]MergeStrategy
+		want       string
+	}{
+		{
+			"deep",
+			`db = {port = 2, hosts = {"y"}} tags = {"b"} fresh = {k = 1}`,
+			nil,
+			`name = "web" gone = 1 tags = {"b"} db = {host = "h", port = 2, hosts = {"y"}}
+			services = {api = {hosts = {"a1"}}, web = {hosts = {"w1"}}} fresh = {k = 1}`,
+		},
+		{
+			"replace and append",
+			`db = {port = 2} tags = {"b", "c"} services = {api = {hosts = {"a2"}}}`,
+			map[string]MergeStrategy{"db": MergeReplace, "tags": MergeAppend, "services.*.hosts": MergeAppend},
+			`name = "web" gone = 1 tags = {"a", "b", "c"} db = {port = 2}
+			services = {api = {hosts = {"a1", "a2"}}, web = {hosts = {"w1"}}}`,
+		},
+		{
+			"specific patterns first",
+			`services = {api = {hosts = {"a2"}}, web = {hosts = {"w2"}}}`,
+			map[string]MergeStrategy{"services.*.hosts": MergeAppend, "services.web.hosts": MergeReplace},
+			`name = "web" gone = 1 tags = {"a"} db = {host = "h", port = 1, hosts = {"x"}}
+			services = {api = {hosts = {"a1", "a2"}}, web = {hosts = {"w2"}}}`,
+		},
+		{
+			"empty tables merge",
+			`tags = {} db = {}`,
+			nil,
+			base,
+		},
+	}
+	for _, tt := range tests {
+		dst := evalTable(t, base)
+		dst.Merge(evalTable(t, tt.src), tt.strategies)
+		got, _ := toGo(dst)
+		if want, _ := toGo(evalTable(t, tt.want)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestTable_MergeDelete(t *testing.T) {
+	dst := evalTable(t, `a = 1 b = {c = 2, d = 3} e = {1, 2}`)
+	src := NewTable()
+	src.Set("a", Delete)
+	b := NewTable()
+	b.Set("c", Delete)
+	src.Set("b", b)
+	e := NewTable()
+	e.Set(int64(1), Delete)
+	e.Set(int64(2), int64(9))
+	src.Set("e", e)
+	src.Set("f", Delete)
+	dst.Merge(src, map[string]MergeStrategy{"e": MergeReplace})
+
+	want := map[string]interface{}{"b": map[string]interface{}{"d": int64(3)}, "e": map[string]interface{}{"2": int64(9)}}
+	if got, _ := toGo(dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTable_MergeCopies(t *testing.T) {
+	src := evalTable(t, `db = {host = "h"} list = {1}`)
+	src.Set("self", src)
+	dst := NewTable()
+	dst.Merge(src, nil)
+	dst.Merge(src, map[string]MergeStrategy{"list": MergeAppend})
+
+	src.Get("db").(*Table).Set("host", "changed")
+	if host := dst.Get("db").(*Table).Get("host"); host != "h" {
+		t.Errorf("got host %v, want a copy of src", host)
+	}
+	if self := dst.Get("self").(*Table); self.Get("db") != self.Get("self").(*Table).Get("db") {
+		t.Error("cycle was not copied")
+	}
+	if n := dst.Get("list").(*Table).Len(); n != 2 {
+		t.Errorf("got %d list entries, want 2", n)
+	}
+}
+
+type mergeService struct {
+	Port int      `lua:"port"`
+	Tags []string `lua:"tags" luamerge:"append"`
+}
+
+type mergeConfig struct {
+	Name   string `lua:"name"`
+	Server struct {
+		Host string `lua:"host"`
+		Port int    `lua:"port"`
+	} `lua:"server"`
+	Plugins  []string                `lua:"plugins" luamerge:"append"`
+	Hosts    []string                `lua:"hosts"`
+	Limits   map[string]int          `lua:"limits" luamerge:"replace"`
+	Cache    *struct{ Size int }     `lua:"cache"`
+	Services map[string]mergeService `lua:"services"`
+}
+
+func TestDecoder_MergeFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"defaults.lua": {Data: []byte(`
+name = "app"
+server = {host = "localhost", port = 8080}
+plugins = {"log"}
+hosts = {"a", "b"}
+limits = {cpu = 1, mem = 512}
+cache = {size = 64}
+services = {api = {port = 1, tags = {"x"}}}
+`)},
+		"env/prod.lua": {Data: []byte(`
+server = {host = "prod.example.com"}
+plugins = {"metrics"}
+hosts = {"c"}
+limits = {cpu = 4}
+services = {api = {tags = {"y"}}, web = {port = 2}}
+`)},
+		"local.lua": {Data: []byte("cache = delete\n")},
+		"error.lua": {Data: []byte("\nport = nil + 1\n")},
+		"tag.lua":   {Data: []byte("return 1\n")},
+	}
+	d := NewDecoder(nil)
+	d.SetFS(fsys)
+
+	var cfg mergeConfig
+	if err := d.MergeFiles(&cfg, "defaults.lua", "env/prod.lua", "local.lua"); err != nil {
+		t.Fatal(err)
+	}
+	var want mergeConfig
+	want.Name = "app"
+	want.Server.Host, want.Server.Port = "prod.example.com", 8080
+	want.Plugins = []string{"log", "metrics"}
+	want.Hosts = []string{"c"}
+	want.Limits = map[string]int{"cpu": 4}
+	want.Services = map[string]mergeService{"api": {Port: 1, Tags: []string{"x", "y"}}, "web": {Port: 2}}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v\nwant %+v", cfg, want)
+	}
+
+	if err := d.MergeFiles(&cfg, "defaults.lua", "error.lua"); err == nil || !strings.HasPrefix(err.Error(), "luar: error.lua:2: attempt to perform arithmetic") {
+		t.Errorf("got %v", err)
+	}
+
+	d.SetMode(ModeReturn)
+	if err := d.MergeFiles(&cfg, "tag.lua"); err == nil || err.Error() != "luar: tag.lua:1: chunk returns a number value, not a table" {
+		t.Errorf("got %v", err)
+	}
+
+	var bad struct {
+		Hosts []string `luamerge:"prepend"`
+	}
+	if err := d.MergeFiles(&bad); err == nil || err.Error() != `luar: field Hosts: unknown merge strategy "prepend"` {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDecoder_MergeFilesReturn(t *testing.T) {
+	fsys := fstest.MapFS{
+		"base.lua": {Data: []byte(`return {name = "app", plugins = {"log"}}`)},
+		"prod.lua": {Data: []byte(`local M = {plugins = {"metrics"}, cache = delete} return M`)},
+	}
+	d := NewDecoder(nil)
+	d.SetFS(fsys)
+	d.SetMode(ModeModule)
+
+	var cfg mergeConfig
+	if err := d.MergeFiles(&cfg, "base.lua", "prod.lua"); err != nil || cfg.Name != "app" || !reflect.DeepEqual(cfg.Plugins, []string{"log", "metrics"}) {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestDecoder_MergeFilesGlobals(t *testing.T) {
+	fsys := fstest.MapFS{
+		"base.lua":   {Data: []byte(`name = string.upper("app") cache = {size = 1}`)},
+		"local.lua":  {Data: []byte(`cache = delete port = 1 deleted = tostring(delete)`)},
+		"change.lua": {Data: []byte("\ndelete.x = 1\n")},
+	}
+	d := NewDecoder(nil)
+	d.SetFS(fsys)
+	d.OpenLibs(LibAll)
+	d.RegisterFunc("version", func() string { return "1.0" })
+
+	// Only the globals the files assigned are merged.
+	var v map[string]interface{}
+	if err := d.MergeFiles(&v, "base.lua", "local.lua"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"name": "APP", "port": int64(1), "deleted": "delete"}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("got %#v\nwant %#v", v, want)
+	}
+
+	if err := d.MergeFiles(&v, "change.lua"); err == nil || err.Error() != "luar: change.lua:2: attempt to index a userdata value (global 'delete')" {
+		t.Errorf("got %v", err)
+	}
+}
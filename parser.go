@@ -2,24 +2,223 @@ package luar
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 )
 
+// defaultMaxErrors is the number of syntax errors after which a parser
+// gives up.
+const defaultMaxErrors = 10
+
+// defaultMaxDepth is how deeply blocks and expressions may nest, so that a
+// deeply nested chunk fails with an error instead of exhausting the Go
+// stack.
+const defaultMaxDepth = 200
+
 type Parser struct {
-	lexer  *Lexer
-	tokens []Token
-	pos    int
-	errors []string
+	lexer     *Lexer
+	tokens    []Token
+	pos       int
+	errors    []string
+	lastError int
+	maxErrors int
+	depth     int
+	maxDepth  int
+	scope     *Block
+	spans     map[interface{}]tokenSpan
 }
 
 func NewParser(input string) *Parser {
 	lexer := NewLexer(input)
 	tokens := lexer.Tokens()
 	return &Parser{
-		lexer:  lexer,
-		tokens: tokens,
+		lexer:     lexer,
+		tokens:    tokens,
+		lastError: -1,
+		maxErrors: defaultMaxErrors,
+		maxDepth:  defaultMaxDepth,
+	}
+}
+
+// NewLosslessParser returns a parser that keeps every token together with its
+// trivia, so that the parsed Program can reproduce its source exactly and be
+// edited without disturbing formatting or comments.
+func NewLosslessParser(input string) *Parser {
+	lexer := NewLexer(input)
+	tokens := lexer.LosslessTokens()
+	return &Parser{
+		lexer:     lexer,
+		tokens:    tokens,
+		lastError: -1,
+		maxErrors: defaultMaxErrors,
+		maxDepth:  defaultMaxDepth,
+		spans:     make(map[interface{}]tokenSpan),
+	}
+}
+
+// SetMaxErrors sets the number of syntax errors after which Parse stops and
+// returns what it has parsed so far. The default is 10; n <= 0 removes the
+// limit.
+func (p *Parser) SetMaxErrors(n int) {
+	p.maxErrors = n
+}
+
+// SetMaxDepth sets how deeply blocks and expressions may nest. Parse stops
+// with a *NestingLimitError at the first construct nested deeper. The
+// default is 200; n <= 0 removes the limit.
+func (p *Parser) SetMaxDepth(n int) {
+	p.maxDepth = n
+}
+
+// enter counts a level of nesting at the current token and returns a
+// function that leaves it.
+func (p *Parser) enter() func() {
+	if p.depth++; p.maxDepth > 0 && p.depth > p.maxDepth {
+		tok := p.currentToken()
+		panic(&NestingLimitError{Pos: Position{Offset: tok.Offset, Line: tok.Line, Column: tok.Column}, Max: p.maxDepth})
 	}
+	return func() { p.depth-- }
+}
+
+// bailout abandons the construct being parsed after a syntax error. The
+// nearest recovery point, a statement or table field, catches it and skips
+// to where parsing can resume.
+type bailout struct{}
+
+// tooManyErrors stops the parse once the error limit is reached.
+type tooManyErrors struct{}
+
+// fail records a syntax error at tok and bails out. Only the first error at
+// a given token is reported.
+func (p *Parser) fail(tok Token, format string, args ...interface{}) {
+	if tok.Offset != p.lastError {
+		p.lastError = tok.Offset
+		p.errors = append(p.errors, fmt.Sprintf(format, args...))
+		if p.maxErrors > 0 && len(p.errors) >= p.maxErrors {
+			panic(tooManyErrors{})
+		}
+	}
+	panic(bailout{})
+}
+
+// protect runs parse and reports whether it completed without bailing out.
+func (p *Parser) protect(parse func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isBailout := r.(bailout); !isBailout {
+				panic(r)
+			}
+			ok = false
+		}
+	}()
+	parse()
+	return true
+}
+
+// guard runs parse until it completes, reaches the error limit or nests too
+// deeply, and returns the *NestingLimitError in the last case.
+func (p *Parser) guard(parse func()) (nesting *NestingLimitError) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case tooManyErrors:
+				p.errors = append(p.errors, "too many errors")
+			case *NestingLimitError:
+				nesting = r
+			default:
+				panic(r)
+			}
+		}
+	}()
+	parse()
+	return nil
+}
+
+// synchronize skips the rest of a statement after a syntax error, up to a
+// keyword that starts or ends a statement, or a name or function at the
+// start of a new line. Bracketed groups are skipped whole, and a closing
+// bracket left open by the broken statement is consumed with it.
+func (p *Parser) synchronize() {
+	depth := 0
+	for !p.check(EOF) {
+		tok := p.currentToken()
+		if depth == 0 {
+			switch tok.Type {
+			case LOCAL, IF, WHILE, FOR, REPEAT, RETURN, BREAK, GOTO, LABEL, SEMICOLON, END, ELSE, ELSEIF, UNTIL:
+				return
+			case IDENT, FUNCTION:
+				if p.pos > 0 && tok.Line > p.tokens[p.pos-1].Line {
+					return
+				}
+			}
+		}
+		switch tok.Type {
+		case LPAREN, LBRACE, LBRACKET:
+			depth++
+		case RPAREN, RBRACE, RBRACKET:
+			if depth > 0 {
+				depth--
+			}
+		}
+		p.advance()
+	}
+}
+
+// skipField skips the rest of a table field after a syntax error, up to the
+// next separator or the end of the table.
+func (p *Parser) skipField() {
+	depth := 0
+	for !p.check(EOF) {
+		switch p.currentToken().Type {
+		case LPAREN, LBRACE, LBRACKET:
+			depth++
+		case RPAREN, RBRACKET:
+			if depth > 0 {
+				depth--
+			}
+		case RBRACE:
+			if depth == 0 {
+				return
+			}
+			depth--
+		case COMMA, SEMICOLON:
+			if depth == 0 {
+				return
+			}
+		}
+		p.advance()
+	}
+}
+
+// spanner is implemented by nodes that record their source range.
+type spanner interface {
+	setSpan(first, last Token)
+	hasSpan() bool
+}
+
+// record sets the source range of node to the tokens from start up to the
+// current position. A node keeps the first range recorded for it, so a
+// parenthesized expression does not take in its parentheses.
+func (p *Parser) record(node interface{}, start int) {
+	if p.pos <= start {
+		return
+	}
+	if n, ok := node.(spanner); ok && !n.hasSpan() {
+		n.setSpan(p.tokens[start], p.tokens[p.pos-1])
+	}
+	if p.spans != nil {
+		if _, ok := p.spans[node]; !ok {
+			p.spans[node] = tokenSpan{start: start, end: p.pos}
+		}
+	}
+}
+
+// parseName parses an identifier.
+func (p *Parser) parseName() *Identifier {
+	start := p.pos
+	tok := p.expect(IDENT)
+	ident := &Identifier{Name: tok.Literal, TokenLine: tok.Line}
+	p.record(ident, start)
+	return ident
 }
 
 func (p *Parser) currentToken() Token {
@@ -52,7 +251,7 @@ func (p *Parser) expect(t TokenType) Token {
 		p.advance()
 		return token
 	}
-	p.errors = append(p.errors, fmt.Sprintf("expected %s but got %s at line %d", t, p.currentToken().Type, p.currentToken().Line))
+	p.fail(p.currentToken(), "expected %s but got %s at line %d", t, p.currentToken().Type, p.currentToken().Line)
 	return Token{Type: t}
 }
 
@@ -72,16 +271,24 @@ func (p *Parser) errorsAsString() string {
 	return strings.Join(p.errors, "\n")
 }
 
+// Parse parses the whole input. After a syntax error it skips to the next
+// statement and carries on, so the returned Program holds every statement
+// that could be parsed, with an ErrorNode in place of each broken one, and
+// the error lists each problem once.
 func (p *Parser) Parse() (*Program, error) {
 	program := &Program{
-		Statements: []Statement{},
+		Block: Block{Statements: []Statement{}},
 	}
 
-	for !p.check(EOF) {
-		stmt := p.parseStatement()
-		if stmt != nil {
-			program.Statements = append(program.Statements, stmt)
-		}
+	if nesting := p.guard(func() { p.parseStatements(&program.Block, true) }); nesting != nil {
+		return program, nesting
+	}
+	p.record(&program.Block, 0)
+
+	program.setSpan(p.tokens[0], p.tokens[len(p.tokens)-1])
+	if p.spans != nil {
+		program.Tokens = p.tokens
+		program.spans = p.spans
 	}
 
 	if len(p.errors) > 0 {
@@ -92,6 +299,20 @@ func (p *Parser) Parse() (*Program, error) {
 }
 
 func (p *Parser) parseStatement() Statement {
+	start := p.pos
+	var stmt Statement
+	if !p.protect(func() { stmt = p.parseStatementKind() }) {
+		if p.pos == start {
+			p.advance()
+		}
+		p.synchronize()
+		stmt = &ErrorNode{Message: p.errors[len(p.errors)-1], TokenLine: p.tokens[start].Line}
+	}
+	p.record(stmt, start)
+	return stmt
+}
+
+func (p *Parser) parseStatementKind() Statement {
 	switch p.currentToken().Type {
 	case IF:
 		return p.parseIfStatement()
@@ -108,15 +329,13 @@ func (p *Parser) parseStatement() Statement {
 	case RETURN:
 		return p.parseReturnStatement()
 	case BREAK:
-		p.advance()
-		return &BreakStatement{TokenLine: p.currentToken().Line}
+		return &BreakStatement{TokenLine: p.advance().Line}
 	case GOTO:
 		return p.parseGotoStatement()
 	case LABEL:
 		return p.parseLabelStatement()
 	case SEMICOLON:
-		p.advance()
-		return &SemicolonStatement{TokenLine: p.currentToken().Line}
+		return &SemicolonStatement{TokenLine: p.advance().Line}
 	default:
 		return p.parseAssignmentOrExpression()
 	}
@@ -130,18 +349,21 @@ func (p *Parser) parseIfStatement() *IfStatement {
 	thenBlock := p.parseBlock()
 
 	elseIfs := []ElseIfClause{}
-	elseBlock := []Statement{}
+	var elseBlock *Block
 
 	for p.check(ELSEIF) {
-		p.advance()
+		start := p.pos
+		elseIfToken := p.advance()
 		elseIfCond := p.parseExpression()
 		p.expect(THEN)
 		elseIfBlock := p.parseBlock()
-		elseIfs = append(elseIfs, ElseIfClause{
+		clause := ElseIfClause{
 			Condition: elseIfCond,
 			Then:      elseIfBlock,
-			TokenLine: p.currentToken().Line,
-		})
+			TokenLine: elseIfToken.Line,
+		}
+		p.record(&clause, start)
+		elseIfs = append(elseIfs, clause)
 	}
 
 	if p.check(ELSE) {
@@ -191,42 +413,33 @@ func (p *Parser) parseForStatement() Statement {
 	forToken := p.expect(FOR)
 
 	if p.peekToken(1).Type == ASSIGN {
-		name := &Identifier{Name: p.expect(IDENT).Literal, TokenLine: forToken.Line}
+		name := p.parseName()
 		p.expect(ASSIGN)
-		initVal := p.parseExpression()
+		start := p.parseExpression()
 		p.expect(COMMA)
-		endVal := p.parseExpression()
+		limit := p.parseExpression()
 
 		var step Expression
-		var stepTokenLine int
-		if p.check(COMMA) {
-			p.advance()
+		if p.match(COMMA) {
 			step = p.parseExpression()
-			stepTokenLine = p.currentToken().Line
 		}
 		p.expect(DO)
-		body := p.parseBlock()
+		body := p.parseBlock(name)
 		p.expect(END)
 
-		return &ForStatement{
-			Init: &AssignmentStatement{
-				Names:     []*Identifier{name},
-				Values:    []Expression{initVal},
-				TokenLine: forToken.Line,
-			},
-			Condition: endVal,
-			Post:      &AssignmentStatement{Names: []*Identifier{name}, Values: []Expression{step}, TokenLine: stepTokenLine},
+		return &ForNumericStatement{
+			Var:       name,
+			Start:     start,
+			Limit:     limit,
+			Step:      step,
 			Body:      body,
 			TokenLine: forToken.Line,
 		}
 	}
 
-	name := p.expect(IDENT)
-	names := []*Identifier{{Name: name.Literal, TokenLine: name.Line}}
-
-	if p.check(COMMA) {
-		p.advance()
-		names = append(names, &Identifier{Name: p.expect(IDENT).Literal, TokenLine: p.currentToken().Line})
+	names := []*Identifier{p.parseName()}
+	for p.match(COMMA) {
+		names = append(names, p.parseName())
 	}
 
 	p.expect(IN)
@@ -237,7 +450,7 @@ func (p *Parser) parseForStatement() Statement {
 	}
 
 	p.expect(DO)
-	body := p.parseBlock()
+	body := p.parseBlock(names...)
 	p.expect(END)
 
 	return &ForInStatement{
@@ -251,16 +464,39 @@ func (p *Parser) parseForStatement() Statement {
 func (p *Parser) parseFunctionStatement() *FunctionStatement {
 	funcToken := p.expect(FUNCTION)
 	name := p.parseFunctionName()
+	parameters := p.parseParameters()
+
+	locals := variables(parameters)
+	if name.Method != "" {
+		locals = append([]*Identifier{{Name: "self"}}, locals...)
+	}
+	body := p.parseBlock(locals...)
+	p.expect(END)
+
+	return &FunctionStatement{
+		Name:       name,
+		Parameters: parameters,
+		Body:       body,
+		TokenLine:  funcToken.Line,
+	}
+}
+
+// parseParameters parses a parenthesized parameter list, where a trailing
+// `...` is kept as an Identifier named "...".
+func (p *Parser) parseParameters() []*Identifier {
 	p.expect(LPAREN)
 
 	parameters := []*Identifier{}
 	if !p.check(RPAREN) {
 		for {
 			if p.check(IDENT) {
-				parameters = append(parameters, &Identifier{Name: p.expect(IDENT).Literal, TokenLine: p.currentToken().Line})
+				parameters = append(parameters, p.parseName())
 			} else if p.check(ELLIPSIS) {
-				parameters = append(parameters, &Identifier{Name: "...", TokenLine: p.currentToken().Line})
-				p.advance()
+				start := p.pos
+				tok := p.advance()
+				vararg := &Identifier{Name: "...", TokenLine: tok.Line}
+				p.record(vararg, start)
+				parameters = append(parameters, vararg)
 			}
 			if p.check(COMMA) {
 				p.advance()
@@ -271,39 +507,36 @@ func (p *Parser) parseFunctionStatement() *FunctionStatement {
 	}
 	p.expect(RPAREN)
 
-	body := p.parseBlock()
-	p.expect(END)
-
-	return &FunctionStatement{
-		Name:       name,
-		Parameters: parameters,
-		Body:       body,
-		TokenLine:  funcToken.Line,
-	}
+	return parameters
 }
 
 func (p *Parser) parseFunctionName() *FunctionName {
+	start := p.pos
 	name := &FunctionName{}
 
 	if p.check(IDENT) {
-		name.Name = &Identifier{Name: p.expect(IDENT).Literal, TokenLine: p.currentToken().Line}
+		name.Name = &Identifier{Name: p.expect(IDENT).Literal, TokenLine: p.tokens[start].Line}
 	}
 
-	if p.check(DOT) {
+	for p.check(DOT) {
 		p.advance()
 		if name.Name == nil {
-			name.Name = &Identifier{}
+			name.Name = &Identifier{TokenLine: p.tokens[start].Line}
 		}
 		current := name.Name.Name
 		current += "." + p.expect(IDENT).Literal
 		name.Name.Name = current
 	}
+	if name.Name != nil {
+		p.record(name.Name, start)
+	}
 
 	if p.check(COLON) {
 		p.advance()
 		name.Method = p.expect(IDENT).Literal
 	}
 
+	p.record(name, start)
 	return name
 }
 
@@ -319,28 +552,11 @@ func (p *Parser) parseLocalStatement() Statement {
 
 func (p *Parser) parseLocalFunction(localToken Token) *LocalFunctionStatement {
 	p.expect(FUNCTION)
-	name := &Identifier{Name: p.expect(IDENT).Literal, TokenLine: localToken.Line}
-	p.expect(LPAREN)
-
-	parameters := []*Identifier{}
-	if !p.check(RPAREN) {
-		for {
-			if p.check(IDENT) {
-				parameters = append(parameters, &Identifier{Name: p.expect(IDENT).Literal, TokenLine: p.currentToken().Line})
-			} else if p.check(ELLIPSIS) {
-				parameters = append(parameters, &Identifier{Name: "...", TokenLine: p.currentToken().Line})
-				p.advance()
-			}
-			if p.check(COMMA) {
-				p.advance()
-				continue
-			}
-			break
-		}
-	}
-	p.expect(RPAREN)
+	name := p.parseName()
+	p.declare(name)
+	parameters := p.parseParameters()
 
-	body := p.parseBlock()
+	body := p.parseBlock(variables(parameters)...)
 	p.expect(END)
 
 	return &LocalFunctionStatement{
@@ -352,16 +568,9 @@ func (p *Parser) parseLocalFunction(localToken Token) *LocalFunctionStatement {
 }
 
 func (p *Parser) parseLocalAssignment(localToken Token) *LocalAssignmentStatement {
-	names := []*Identifier{}
-	for {
-		if p.check(IDENT) {
-			names = append(names, &Identifier{Name: p.expect(IDENT).Literal, TokenLine: p.currentToken().Line})
-		}
-		if p.check(COMMA) {
-			p.advance()
-			continue
-		}
-		break
+	names := []*Identifier{p.parseName()}
+	for p.match(COMMA) {
+		names = append(names, p.parseName())
 	}
 
 	values := []Expression{}
@@ -369,6 +578,7 @@ func (p *Parser) parseLocalAssignment(localToken Token) *LocalAssignmentStatemen
 		p.advance()
 		values = p.parseExpressionList()
 	}
+	p.declare(names...)
 
 	return &LocalAssignmentStatement{
 		Names:     names,
@@ -417,41 +627,32 @@ func (p *Parser) parseLabelStatement() *LabelStatement {
 }
 
 func (p *Parser) parseAssignmentOrExpression() Statement {
+	startToken := p.currentToken()
 	expr := p.parseExpression()
 
-	if p.check(ASSIGN) {
-		p.advance()
-
-		if ident, ok := expr.(*Identifier); ok {
-			names := []*Identifier{ident}
-			values := p.parseExpressionList()
-			return &AssignmentStatement{
-				Names:     names,
-				Values:    values,
-				TokenLine: p.currentToken().Line,
-			}
+	if p.check(ASSIGN) || p.check(COMMA) {
+		targets := []Expression{expr}
+		for p.match(COMMA) {
+			targets = append(targets, p.parseExpression())
 		}
+		p.expect(ASSIGN)
 
-		if member, ok := expr.(*MemberExpression); ok {
-			values := p.parseExpressionList()
-			return &AssignmentStatement{
-				Names:     []*Identifier{{Name: member.Object.(*Identifier).Name + "." + member.Member}},
-				Values:    values,
-				TokenLine: p.currentToken().Line,
+		names := make([]*Identifier, len(targets))
+		for i, target := range targets {
+			if ident, ok := target.(*Identifier); ok {
+				names[i] = ident
+				continue
 			}
+			name, _ := dottedName(target)
+			names[i] = &Identifier{Name: name, TokenLine: target.Pos().Line}
+			names[i].nodeSpan = nodeSpan{pos: target.Pos(), end: target.End()}
 		}
 
-		if index, ok := expr.(*IndexExpression); ok {
-			values := p.parseExpressionList()
-			var nameStr string
-			if ident, ok := index.Object.(*Identifier); ok {
-				nameStr = ident.Name
-			}
-			return &AssignmentStatement{
-				Names:     []*Identifier{{Name: nameStr}},
-				Values:    values,
-				TokenLine: p.currentToken().Line,
-			}
+		return &AssignmentStatement{
+			Names:     names,
+			Targets:   targets,
+			Values:    p.parseExpressionList(),
+			TokenLine: startToken.Line,
 		}
 	}
 
@@ -461,195 +662,164 @@ func (p *Parser) parseAssignmentOrExpression() Statement {
 
 	return &AssignmentStatement{
 		Values:    []Expression{expr},
-		TokenLine: p.currentToken().Line,
+		TokenLine: startToken.Line,
 	}
 }
 
-func (p *Parser) parseBlock() []Statement {
-	statements := []Statement{}
-
-	for {
-		if p.check(END) || p.check(ELSE) || p.check(ELSEIF) || p.check(UNTIL) || p.check(EOF) {
-			break
-		}
-
-		stmt := p.parseStatement()
-		if stmt != nil {
-			statements = append(statements, stmt)
+// dottedName returns the name of a chain of member accesses such as a.b.c.
+func dottedName(expr Expression) (string, bool) {
+	switch e := expr.(type) {
+	case *Identifier:
+		return e.Name, true
+	case *MemberExpression:
+		if obj, ok := dottedName(e.Object); ok {
+			return obj + "." + e.Member, true
 		}
 	}
-
-	return statements
+	return "", false
 }
 
-func (p *Parser) parseExpressionList() []Expression {
-	exprs := []Expression{p.parseExpression()}
-
-	for p.check(COMMA) {
-		p.advance()
-		exprs = append(exprs, p.parseExpression())
-	}
-
-	return exprs
+// parseBlock parses a nested block up to the keyword that closes it. locals
+// are declared in the new scope ahead of its statements.
+func (p *Parser) parseBlock(locals ...*Identifier) *Block {
+	defer p.enter()()
+	start := p.pos
+	block := &Block{Statements: []Statement{}, Locals: append([]*Identifier(nil), locals...), Parent: p.scope}
+	p.parseStatements(block, false)
+	p.record(block, start)
+	return block
 }
 
-func (p *Parser) parseExpression() Expression {
-	return p.parseOr()
-}
+// parseStatements parses statements into block until the end of the input
+// or, unless block is a chunk, the keyword that closes it.
+func (p *Parser) parseStatements(block *Block, chunk bool) {
+	outer := p.scope
+	p.scope = block
+	defer func() { p.scope = outer }()
 
-func (p *Parser) parseOr() Expression {
-	left := p.parseAnd()
-
-	for p.check(OR) {
-		op := p.advance()
-		right := p.parseAnd()
-		left = &BinaryExpression{Operator: op.Type, Left: left, Right: right, TokenLine: op.Line}
+	atEnd := func() bool {
+		return p.check(EOF) || !chunk && (p.check(END) || p.check(ELSE) || p.check(ELSEIF) || p.check(UNTIL))
 	}
-
-	return left
-}
-
-func (p *Parser) parseAnd() Expression {
-	left := p.parseComparison()
-
-	for p.check(AND) {
-		op := p.advance()
-		right := p.parseComparison()
-		left = &BinaryExpression{Operator: op.Type, Left: left, Right: right, TokenLine: op.Line}
-	}
-
-	return left
-}
-
-func (p *Parser) parseComparison() Expression {
-	left := p.parseConcat()
-
-	for p.check(EQ) || p.check(NE) || p.check(LT) || p.check(LE) || p.check(GT) || p.check(GE) {
-		op := p.advance()
-		right := p.parseConcat()
-		left = &BinaryExpression{Operator: op.Type, Left: left, Right: right, TokenLine: op.Line}
-	}
-
-	return left
-}
-
-func (p *Parser) parseConcat() Expression {
-	left := p.parseBitwiseOr()
-
-	if p.check(CONCAT) {
-		ops := []Token{p.advance()}
-		rights := []Expression{p.parseBitwiseOr()}
-
-		for p.check(CONCAT) {
-			ops = append(ops, p.advance())
-			rights = append(rights, p.parseBitwiseOr())
+	for !atEnd() {
+		stmt := p.parseStatement()
+		if ret, ok := stmt.(*ReturnStatement); ok && block.Return == nil {
+			block.Return = ret
+			if !atEnd() {
+				tok := p.currentToken()
+				p.protect(func() {
+					p.fail(tok, "expected end of block after return but got %s at line %d", tok.Type, tok.Line)
+				})
+			}
+			continue
 		}
-
-		result := left
-		for i, right := range rights {
-			result = &BinaryExpression{Operator: ops[i].Type, Left: result, Right: right, TokenLine: ops[i].Line}
+		if stmt != nil {
+			block.Statements = append(block.Statements, stmt)
 		}
-		return result
 	}
-
-	return left
-}
-
-func (p *Parser) parseBitwiseOr() Expression {
-	left := p.parseBitwiseXor()
-
-	for p.check(OR) || p.check(LSHIFT) || p.check(RSHIFT) {
-		op := p.advance()
-		right := p.parseBitwiseXor()
-		left = &BinaryExpression{Operator: op.Type, Left: left, Right: right, TokenLine: op.Line}
-	}
-
-	return left
 }
 
-func (p *Parser) parseBitwiseXor() Expression {
-	left := p.parseBitwiseAnd()
-
-	for p.check(POW) {
-		op := p.advance()
-		right := p.parseBitwiseAnd()
-		left = &BinaryExpression{Operator: op.Type, Left: left, Right: right, TokenLine: op.Line}
+// declare adds local variables to the current scope.
+func (p *Parser) declare(names ...*Identifier) {
+	if p.scope != nil {
+		p.scope.Locals = append(p.scope.Locals, names...)
 	}
-
-	return left
 }
 
-func (p *Parser) parseBitwiseAnd() Expression {
-	left := p.parseAddSub()
-
-	for p.check(HASH) || p.check(AND) {
-		op := p.advance()
-		right := p.parseAddSub()
-		left = &BinaryExpression{Operator: op.Type, Left: left, Right: right, TokenLine: op.Line}
+// variables returns params without a trailing vararg.
+func variables(params []*Identifier) []*Identifier {
+	if n := len(params); n > 0 && params[n-1].Name == "..." {
+		return params[:n-1]
 	}
-
-	return left
+	return params
 }
 
-func (p *Parser) parseAddSub() Expression {
-	left := p.parseMulDivMod()
+func (p *Parser) parseExpressionList() []Expression {
+	exprs := []Expression{p.parseExpression()}
 
-	for p.check(PLUS) || p.check(MINUS) {
-		op := p.advance()
-		right := p.parseMulDivMod()
-		left = &BinaryExpression{Operator: op.Type, Left: left, Right: right, TokenLine: op.Line}
+	for p.check(COMMA) {
+		p.advance()
+		exprs = append(exprs, p.parseExpression())
 	}
 
-	return left
+	return exprs
 }
 
-func (p *Parser) parseMulDivMod() Expression {
-	left := p.parseUnary()
-
-	for p.check(STAR) || p.check(SLASH) || p.check(MOD) {
-		op := p.advance()
-		right := p.parseUnary()
-		left = &BinaryExpression{Operator: op.Type, Left: left, Right: right, TokenLine: op.Line}
-	}
-
-	return left
+func (p *Parser) parseExpression() Expression {
+	start := p.pos
+	expr := p.parseSubExpression(0)
+	p.record(expr, start)
+	return expr
 }
 
-func (p *Parser) parseUnary() Expression {
+// binaryPriority holds the left and right binding power of each binary
+// operator, as in the reference Lua parser. Operators whose right priority is
+// lower than their left one (.. and ^) are right associative.
+var binaryPriority = map[TokenType][2]int{
+	OR:     {1, 1},
+	AND:    {2, 2},
+	EQ:     {3, 3},
+	NE:     {3, 3},
+	LT:     {3, 3},
+	LE:     {3, 3},
+	GT:     {3, 3},
+	GE:     {3, 3},
+	LSHIFT: {7, 7},
+	RSHIFT: {7, 7},
+	CONCAT: {9, 8},
+	PLUS:   {10, 10},
+	MINUS:  {10, 10},
+	STAR:   {11, 11},
+	SLASH:  {11, 11},
+	MOD:    {11, 11},
+	POW:    {14, 13},
+}
+
+// unaryPriority is the binding power of not, - and #.
+const unaryPriority = 12
+
+// parseSubExpression parses an expression whose binary operators all bind
+// tighter than limit.
+func (p *Parser) parseSubExpression(limit int) Expression {
+	defer p.enter()()
+	start := p.pos
+	var left Expression
 	if p.check(NOT) || p.check(MINUS) || p.check(HASH) {
 		op := p.advance()
-		right := p.parseUnary()
-		return &UnaryExpression{Operator: op.Type, Right: right, TokenLine: op.Line}
+		right := p.parseSubExpression(unaryPriority)
+		left = &UnaryExpression{Operator: op.Type, Right: right, TokenLine: op.Line}
+	} else {
+		left = p.parsePostfix()
 	}
+	p.record(left, start)
 
-	return p.parsePow()
-}
-
-func (p *Parser) parsePow() Expression {
-	left := p.parsePostfix()
-
-	for p.check(POW) {
+	for {
+		priority, ok := binaryPriority[p.currentToken().Type]
+		if !ok || priority[0] <= limit {
+			return left
+		}
 		op := p.advance()
-		right := p.parseUnary()
+		right := p.parseSubExpression(priority[1])
 		left = &BinaryExpression{Operator: op.Type, Left: left, Right: right, TokenLine: op.Line}
+		p.record(left, start)
 	}
-
-	return left
 }
 
 func (p *Parser) parsePostfix() Expression {
+	start := p.pos
 	expr := p.parsePrimary()
+	p.record(expr, start)
 
 	for {
+		line := p.currentToken().Line
 		if p.check(DOT) {
 			p.advance()
 			member := p.expect(IDENT)
-			expr = &MemberExpression{Object: expr, Member: member.Literal, TokenLine: p.currentToken().Line}
+			expr = &MemberExpression{Object: expr, Member: member.Literal, TokenLine: line}
 		} else if p.check(LBRACKET) {
 			p.advance()
 			index := p.parseExpression()
 			p.expect(RBRACKET)
-			expr = &IndexExpression{Object: expr, Index: index, TokenLine: p.currentToken().Line}
+			expr = &IndexExpression{Object: expr, Index: index, TokenLine: line}
 		} else if p.check(COLON) {
 			p.advance()
 			method := p.expect(IDENT).Literal
@@ -659,7 +829,7 @@ func (p *Parser) parsePostfix() Expression {
 				args = p.parseExpressionList()
 			}
 			p.expect(RPAREN)
-			expr = &FunctionCall{Function: expr, Method: method, Arguments: args, TokenLine: p.currentToken().Line}
+			expr = &FunctionCall{Function: expr, Method: method, Arguments: args, TokenLine: line}
 		} else if p.check(LPAREN) || p.check(STRING) || p.check(LBRACE) {
 			var args []Expression
 			if p.check(LPAREN) {
@@ -671,10 +841,11 @@ func (p *Parser) parsePostfix() Expression {
 			} else if p.check(STRING) || p.check(LBRACE) {
 				args = p.parseExpressionList()
 			}
-			expr = &FunctionCall{Function: expr, Arguments: args, TokenLine: p.currentToken().Line}
+			expr = &FunctionCall{Function: expr, Arguments: args, TokenLine: line}
 		} else {
 			break
 		}
+		p.record(expr, start)
 	}
 
 	return expr
@@ -687,24 +858,24 @@ func (p *Parser) parsePrimary() Expression {
 		return &Identifier{Name: ident.Literal, TokenLine: ident.Line}
 	case INT, FLOAT:
 		lit := p.advance()
-		if lit.Type == INT {
-			val, _ := strconv.ParseInt(lit.Literal, 0, 64)
-			return &NumberLiteral{IntValue: val, IsInt: true, TokenLine: lit.Line}
+		val, _ := parseNumber(lit.Literal)
+		if n, ok := val.(int64); ok {
+			return &NumberLiteral{IntValue: n, IsInt: true, TokenLine: lit.Line}
 		}
-		val, _ := strconv.ParseFloat(lit.Literal, 64)
-		return &NumberLiteral{Value: val, IsInt: false, TokenLine: lit.Line}
+		f, _ := val.(float64)
+		return &NumberLiteral{Value: f, IsInt: false, TokenLine: lit.Line}
 	case STRING:
 		str := p.expect(STRING)
 		return &StringLiteral{Value: str.Literal, TokenLine: str.Line}
 	case TRUE:
-		p.advance()
-		return &BooleanLiteral{Value: true, TokenLine: p.currentToken().Line}
+		return &BooleanLiteral{Value: true, TokenLine: p.advance().Line}
 	case FALSE:
-		p.advance()
-		return &BooleanLiteral{Value: false, TokenLine: p.currentToken().Line}
+		return &BooleanLiteral{Value: false, TokenLine: p.advance().Line}
 	case NIL:
-		p.advance()
-		return &NilLiteral{TokenLine: p.currentToken().Line}
+		return &NilLiteral{TokenLine: p.advance().Line}
+	case ELLIPSIS:
+		tok := p.advance()
+		return &Identifier{Name: "...", TokenLine: tok.Line}
 	case LBRACE:
 		return p.parseTableLiteral()
 	case FUNCTION:
@@ -713,11 +884,17 @@ func (p *Parser) parsePrimary() Expression {
 		p.advance()
 		expr := p.parseExpression()
 		p.expect(RPAREN)
+		switch e := expr.(type) {
+		case *FunctionCall:
+			e.Parenthesized = true
+		case *Identifier:
+			e.Parenthesized = e.Name == "..."
+		}
 		return expr
 	default:
-		p.errors = append(p.errors, fmt.Sprintf("unexpected token: %s at line %d", p.currentToken().Type, p.currentToken().Line))
-		p.advance()
-		return &ErrorNode{Message: "unexpected token", TokenLine: p.currentToken().Line}
+		tok := p.currentToken()
+		p.fail(tok, "unexpected token: %s at line %d", tok.Type, tok.Line)
+		return nil
 	}
 }
 
@@ -727,16 +904,24 @@ func (p *Parser) parseTableLiteral() *TableLiteral {
 
 	if !p.check(RBRACE) {
 		for {
-			field := p.parseTableField()
-			if field != nil {
+			start := p.pos
+			var field *TableField
+			if p.protect(func() { field = p.parseTableField() }) {
 				fields = append(fields, field)
+			} else {
+				if p.pos == start {
+					p.advance()
+				}
+				p.skipField()
 			}
 
-			if p.check(RBRACE) {
+			if !p.match(COMMA) && !p.match(SEMICOLON) {
 				break
 			}
 
-			p.expect(COMMA)
+			if p.check(RBRACE) {
+				break
+			}
 		}
 	}
 
@@ -749,40 +934,42 @@ func (p *Parser) parseTableLiteral() *TableLiteral {
 }
 
 func (p *Parser) parseTableField() *TableField {
+	start := p.pos
+	field := p.parseTableFieldKind()
+	p.record(field, start)
+	return field
+}
+
+func (p *Parser) parseTableFieldKind() *TableField {
+	if p.check(LBRACKET) {
+		start := p.pos
+		bracketToken := p.advance()
+		key := p.parseExpression()
+		p.expect(RBRACKET)
+		index := &TableIndex{Key: key, TokenLine: bracketToken.Line}
+		p.record(index, start)
+		p.expect(ASSIGN)
+		value := p.parseExpression()
+		return &TableField{Key: index, Value: value, TokenLine: bracketToken.Line}
+	}
+
+	line := p.currentToken().Line
 	key := p.parseExpression()
 
 	if p.check(ASSIGN) {
 		p.advance()
 		value := p.parseExpression()
-		return &TableField{Key: key, Value: value, TokenLine: p.currentToken().Line}
+		return &TableField{Key: key, Value: value, TokenLine: line}
 	}
 
-	return &TableField{Value: key, TokenLine: p.currentToken().Line}
+	return &TableField{Value: key, TokenLine: line}
 }
 
 func (p *Parser) parseFunctionLiteral() *FunctionLiteral {
 	funcToken := p.expect(FUNCTION)
-	p.expect(LPAREN)
-
-	parameters := []*Identifier{}
-	if !p.check(RPAREN) {
-		for {
-			if p.check(IDENT) {
-				parameters = append(parameters, &Identifier{Name: p.expect(IDENT).Literal, TokenLine: p.currentToken().Line})
-			} else if p.check(ELLIPSIS) {
-				parameters = append(parameters, &Identifier{Name: "...", TokenLine: p.currentToken().Line})
-				p.advance()
-			}
-			if p.check(COMMA) {
-				p.advance()
-				continue
-			}
-			break
-		}
-	}
-	p.expect(RPAREN)
+	parameters := p.parseParameters()
 
-	body := p.parseBlock()
+	body := p.parseBlock(variables(parameters)...)
 	p.expect(END)
 
 	return &FunctionLiteral{
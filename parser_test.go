@@ -1,6 +1,8 @@
 package luar
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -204,12 +206,12 @@ end
 		t.Errorf("expected 1 elseif, got %d", len(ifStmt.ElseIfs))
 	}
 
-	if len(ifStmt.Then) != 1 {
-		t.Errorf("expected 1 statement in then block, got %d", len(ifStmt.Then))
+	if ifStmt.Then.Len() != 1 {
+		t.Errorf("expected 1 statement in then block, got %d", ifStmt.Then.Len())
 	}
 
-	if len(ifStmt.Else) != 1 {
-		t.Errorf("expected 1 statement in else block, got %d", len(ifStmt.Else))
+	if ifStmt.Else.Len() != 1 {
+		t.Errorf("expected 1 statement in else block, got %d", ifStmt.Else.Len())
 	}
 }
 
@@ -230,8 +232,8 @@ end
 		t.Fatal("expected WhileStatement")
 	}
 
-	if len(whileStmt.Body) != 1 {
-		t.Errorf("expected 1 statement in body, got %d", len(whileStmt.Body))
+	if whileStmt.Body.Len() != 1 {
+		t.Errorf("expected 1 statement in body, got %d", whileStmt.Body.Len())
 	}
 }
 
@@ -246,9 +248,28 @@ end
 		t.Fatalf("Parse failed: %v", err)
 	}
 
-	_, ok := p.Statements[0].(*ForStatement)
+	forStmt, ok := p.Statements[0].(*ForNumericStatement)
 	if !ok {
-		t.Error("expected ForStatement")
+		t.Fatalf("expected ForNumericStatement, got %T", p.Statements[0])
+	}
+	if forStmt.Var.Name != "i" {
+		t.Errorf("expected loop variable i, got %s", forStmt.Var.Name)
+	}
+	for _, tt := range []struct {
+		expr Expression
+		want int64
+	}{{forStmt.Start, 1}, {forStmt.Limit, 10}, {forStmt.Step, 2}} {
+		if n, ok := tt.expr.(*NumberLiteral); !ok || n.IntValue != tt.want {
+			t.Errorf("expected %d, got %v", tt.want, tt.expr)
+		}
+	}
+
+	p, err = NewParser("for i = 1, 3 do end").Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if step := p.Statements[0].(*ForNumericStatement).Step; step != nil {
+		t.Errorf("expected no step, got %v", step)
 	}
 }
 
@@ -334,7 +355,7 @@ end
 	}
 
 	funcStmt := p.Statements[0].(*FunctionStatement)
-	returnStmt := funcStmt.Body[0].(*ReturnStatement)
+	returnStmt := funcStmt.Body.Return
 
 	if len(returnStmt.Results) != 2 {
 		t.Errorf("expected 2 return values, got %d", len(returnStmt.Results))
@@ -449,3 +470,274 @@ func TestParser_Errors(t *testing.T) {
 		})
 	}
 }
+
+func TestParser_LosslessSource(t *testing.T) {
+	inputs := []string{
+		"",
+		"x = 1",
+		"-- only a comment",
+		`-- Application settings
+app_name = "MyApp"   -- shown in logs
+
+--[[ database
+     settings ]]
+database = {
+    host = 'localhost', -- primary
+    port = 5432;
+
+    -- trailing comment inside table
+}
+list = { [[long
+string]], 2, 3, }
+`,
+		"a = 1\r\nb = 2\r\n-- crlf\r\n",
+	}
+
+	for _, input := range inputs {
+		program, err := NewLosslessParser(input).Parse()
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		if got := string(program.Source()); got != input {
+			t.Errorf("round trip mismatch:\nwant %q\ngot  %q", input, got)
+		}
+	}
+
+	program, _ := NewParser("x = 1").Parse()
+	if program.Source() != nil {
+		t.Error("expected nil source from a regular parser")
+	}
+}
+
+func TestParser_Precedence(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"x = 1 + 2 * 3", "(1 + (2 * 3))"},
+		{"x = a .. b .. c", "(a .. (b .. c))"},
+		{"x = 2 ^ 3 ^ 2", "(2 ^ (3 ^ 2))"},
+		{"x = -x ^ 2", "(-(x ^ 2))"},
+		{"x = a << 1 .. b", "(a << (1 .. b))"},
+		{"x = not a == b", "((not a) == b)"},
+		{"x = a or b and c", "(a or (b and c))"},
+	}
+
+	var show func(Expression) string
+	show = func(e Expression) string {
+		switch e := e.(type) {
+		case *BinaryExpression:
+			return "(" + show(e.Left) + " " + string(e.Operator) + " " + show(e.Right) + ")"
+		case *UnaryExpression:
+			if e.Operator == NOT {
+				return "(not " + show(e.Right) + ")"
+			}
+			return "(" + string(e.Operator) + show(e.Right) + ")"
+		case *Identifier:
+			return e.Name
+		case *NumberLiteral:
+			return fmt.Sprint(e.IntValue)
+		}
+		return "?"
+	}
+
+	for _, tt := range tests {
+		p, err := NewParser(tt.input).Parse()
+		if err != nil {
+			t.Fatalf("%s: Parse failed: %v", tt.input, err)
+		}
+		got := show(p.Statements[0].(*AssignmentStatement).Values[0])
+		if got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.input, tt.want, got)
+		}
+	}
+}
+
+func TestParser_AssignmentTargets(t *testing.T) {
+	p, err := NewParser("a, t.x.y, t[1] = 1, 2, 3\nfunction a.b.c() end").Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	stmt := p.Statements[0].(*AssignmentStatement)
+	if len(stmt.Targets) != 3 || len(stmt.Values) != 3 {
+		t.Fatalf("expected 3 targets and values, got %d and %d", len(stmt.Targets), len(stmt.Values))
+	}
+	if stmt.Names[1].Name != "t.x.y" || stmt.Names[2].Name != "" {
+		t.Errorf("unexpected names %q, %q", stmt.Names[1].Name, stmt.Names[2].Name)
+	}
+	if _, ok := stmt.Targets[2].(*IndexExpression); !ok {
+		t.Errorf("expected IndexExpression target, got %T", stmt.Targets[2])
+	}
+
+	fn := p.Statements[1].(*FunctionStatement)
+	if fn.Name.Name.Name != "a.b.c" {
+		t.Errorf("expected function name a.b.c, got %s", fn.Name.Name.Name)
+	}
+}
+
+func TestParser_Positions(t *testing.T) {
+	src := "local x = 1\nname = \"héllo\" .. t.k\ns = [[a\nbc]]\nif x then\n  break\nend\n"
+	p, err := NewParser(src).Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	span := func(n Node) string {
+		return fmt.Sprintf("%d-%d %s-%s", n.Pos().Offset, n.End().Offset, n.Pos(), n.End())
+	}
+	assign := p.Statements[1].(*AssignmentStatement)
+	concat := assign.Values[0].(*BinaryExpression)
+	member := concat.Right.(*MemberExpression)
+	long := p.Statements[2].(*AssignmentStatement).Values[0]
+	ifStmt := p.Statements[3].(*IfStatement)
+
+	tests := []struct {
+		node Node
+		want string
+	}{
+		{p.Statements[0], "0-11 1:1-1:12"},
+		{assign, "12-34 2:1-2:22"},
+		{assign.Targets[0], "12-16 2:1-2:5"},
+		{concat.Left, "19-27 2:8-2:15"},
+		{member, "31-34 2:19-2:22"},
+		{long, "39-47 3:5-4:5"},
+		{ifStmt, "48-69 5:1-7:4"},
+		{ifStmt.Then.Statements[0], "60-65 6:3-6:8"},
+		{p, "0-70 1:1-8:1"},
+	}
+	for _, tt := range tests {
+		if got := span(tt.node); got != tt.want {
+			t.Errorf("%s: expected span %s, got %s", tt.node.NodeType(), tt.want, got)
+		}
+	}
+
+	if member.TokenLine != 2 || ifStmt.Then.Statements[0].(*BreakStatement).TokenLine != 6 {
+		t.Errorf("unexpected token lines %d, %d", member.TokenLine, ifStmt.Then.Statements[0].(*BreakStatement).TokenLine)
+	}
+}
+
+func TestParser_PositionsNested(t *testing.T) {
+	src := "cfg = {a = (1 + 2), [\"k\"] = f(x):m(y), fn = function(...) return ... end}\nfor k, v in pairs(cfg) do t.x = v end"
+	p, err := NewParser(src).Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	Inspect(p, func(n Node) bool {
+		if n == nil {
+			return false
+		}
+		if !n.Pos().IsValid() || n.End().Offset <= n.Pos().Offset {
+			t.Errorf("%s has invalid span %v-%v", n.NodeType(), n.Pos(), n.End())
+			return true
+		}
+		text := src[n.Pos().Offset:n.End().Offset]
+		Inspect(n, func(child Node) bool {
+			if child != nil && child != n && (child.Pos().Offset < n.Pos().Offset || child.End().Offset > n.End().Offset) {
+				t.Errorf("%s %q does not contain %s at %v", n.NodeType(), text, child.NodeType(), child.Pos())
+			}
+			return child == n
+		})
+		if bin, ok := n.(*BinaryExpression); ok && text != "1 + 2" {
+			t.Errorf("parenthesized %s spans %q", bin.NodeType(), text)
+		}
+		return true
+	})
+}
+
+func TestParser_ErrorRecovery(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		errors int
+		kinds  []string
+	}{
+		{
+			name:   "statement boundaries",
+			input:  "x = = 1\ny = 2\nz = )\nw = 3",
+			errors: 2,
+			kinds:  []string{"ErrorNode", "AssignmentStatement", "ErrorNode", "AssignmentStatement"},
+		},
+		{
+			name:   "missing separator",
+			input:  "t = {1, 2 3, 4, {5}}\nu = 1",
+			errors: 1,
+			kinds:  []string{"ErrorNode", "AssignmentStatement"},
+		},
+		{
+			name:   "inside block",
+			input:  "if x then\n  y = = 1\n  z = 2\nend\nw = f(1,, 2)\nv = 1",
+			errors: 2,
+			kinds:  []string{"IfStatement", "ErrorNode", "AssignmentStatement"},
+		},
+		{
+			name:   "unclosed call",
+			input:  "print(\"a\"\nlocal x = 1",
+			errors: 1,
+			kinds:  []string{"ErrorNode", "LocalAssignmentStatement"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewParser(tt.input).Parse()
+			if err == nil {
+				t.Fatal("expected a syntax error")
+			}
+			if n := len(strings.Split(err.Error(), "\n")); n != tt.errors {
+				t.Errorf("expected %d errors, got %d:\n%v", tt.errors, n, err)
+			}
+			var kinds []string
+			for _, stmt := range p.Statements {
+				kinds = append(kinds, stmt.NodeType())
+			}
+			if strings.Join(kinds, " ") != strings.Join(tt.kinds, " ") {
+				t.Errorf("expected statements %v, got %v", tt.kinds, kinds)
+			}
+		})
+	}
+}
+
+func TestParser_ErrorRecoveryTable(t *testing.T) {
+	p, err := NewParser("t = {a = 1, b = , c = 3, d = (}").Parse()
+	if err == nil {
+		t.Fatal("expected a syntax error")
+	}
+	if n := len(strings.Split(err.Error(), "\n")); n != 2 {
+		t.Errorf("expected 2 errors, got %d:\n%v", n, err)
+	}
+	table := p.Statements[0].(*AssignmentStatement).Values[0].(*TableLiteral)
+	if len(table.Fields) != 2 {
+		t.Fatalf("expected the 2 valid fields to be kept, got %d", len(table.Fields))
+	}
+	if key := table.Fields[1].Key.(*Identifier).Name; key != "c" {
+		t.Errorf("expected field c, got %s", key)
+	}
+}
+
+func TestParser_MaxErrors(t *testing.T) {
+	input := strings.Repeat("x = = 1\n", 20)
+
+	_, err := NewParser(input).Parse()
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != defaultMaxErrors+1 || lines[len(lines)-1] != "too many errors" {
+		t.Errorf("expected %d errors and a final note, got:\n%v", defaultMaxErrors, err)
+	}
+
+	p := NewParser(input)
+	p.SetMaxErrors(3)
+	program, err := p.Parse()
+	if n := len(strings.Split(err.Error(), "\n")); n != 4 {
+		t.Errorf("expected 3 errors and a final note, got:\n%v", err)
+	}
+	if len(program.Statements) != 2 {
+		t.Errorf("expected the statements before the limit, got %d", len(program.Statements))
+	}
+
+	p = NewParser(input)
+	p.SetMaxErrors(0)
+	if _, err := p.Parse(); len(strings.Split(err.Error(), "\n")) != 20 {
+		t.Errorf("expected all 20 errors without a limit, got:\n%v", err)
+	}
+}
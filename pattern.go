@@ -0,0 +1,686 @@
+package luar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pattern is a compiled Lua 5.4 pattern, as used by string.find,
+// string.match, string.gmatch and string.gsub. It supports character classes
+// such as %a and [%w_], the quantifiers *, +, - and ?, anchors, captures,
+// position captures (), back references %1-%9, balanced matches %bxy and
+// frontiers %f[set].
+type Pattern struct {
+	pat    string
+	anchor bool
+
+	// step, if set, is called at each step of a match, which it aborts by
+	// returning an error, and fits with the size of the string a replace is
+	// building, which it stops the same way.
+	step func() error
+	fits func(size int64) error
+}
+
+// Capture is the byte range of a pattern capture in the subject. A position
+// capture, (), has Position set and Start == End.
+type Capture struct {
+	Start, End int
+	Position   bool
+}
+
+// Match is a match of a pattern: the byte range of the whole match and its
+// captures in order.
+type Match struct {
+	Start, End int
+	Captures   []Capture
+
+	src string
+}
+
+// String returns the matched text.
+func (m *Match) String() string {
+	return m.src[m.Start:m.End]
+}
+
+// Capture returns the text of capture i, counting from 0, or the empty
+// string for a position capture.
+func (m *Match) Capture(i int) string {
+	c := m.Captures[i]
+	return m.src[c.Start:c.End]
+}
+
+// values returns the captures as Lua values, or the whole match if the
+// pattern has no captures. Position captures are 1-based integers.
+func (m *Match) values() []Value {
+	if len(m.Captures) == 0 {
+		return []Value{m.String()}
+	}
+	values := make([]Value, len(m.Captures))
+	for i, c := range m.Captures {
+		if c.Position {
+			values[i] = int64(c.Start + 1)
+		} else {
+			values[i] = m.src[c.Start:c.End]
+		}
+	}
+	return values
+}
+
+const (
+	maxCaptures   = 32
+	maxMatchDepth = 200
+
+	capUnfinished = -1
+	capPosition   = -2
+)
+
+// CompilePattern checks that pattern is a well-formed Lua pattern and
+// returns it compiled.
+func CompilePattern(pattern string) (*Pattern, error) {
+	if strings.HasPrefix(pattern, "^") {
+		return compilePattern(pattern[1:], true)
+	}
+	return compilePattern(pattern, false)
+}
+
+// compilePattern compiles pat as is, so a leading '^' matches itself, as it
+// does in string.gmatch.
+func compilePattern(pat string, anchor bool) (*Pattern, error) {
+	p := &Pattern{pat: pat, anchor: anchor}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// MustCompilePattern is like CompilePattern but panics if the pattern is
+// malformed.
+func MustCompilePattern(pattern string) *Pattern {
+	p, err := CompilePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// String returns the source of the pattern.
+func (p *Pattern) String() string {
+	if p.anchor {
+		return "^" + p.pat
+	}
+	return p.pat
+}
+
+// check validates the syntax of the pattern: escapes, sets, %b and %f
+// arguments, balanced captures and back references to closed captures.
+func (p *Pattern) check() error {
+	pat := p.pat
+	var open []int // capture numbers not yet closed
+	closed := map[int]bool{}
+	captures := 0
+	for i := 0; i < len(pat); {
+		switch pat[i] {
+		case '(':
+			if captures++; captures > maxCaptures {
+				return fmt.Errorf("too many captures")
+			}
+			open = append(open, captures)
+			i++
+			continue
+		case ')':
+			if len(open) == 0 {
+				return fmt.Errorf("invalid pattern capture")
+			}
+			closed[open[len(open)-1]] = true
+			open = open[:len(open)-1]
+			i++
+			continue
+		case '%':
+			if i+1 < len(pat) {
+				switch c := pat[i+1]; {
+				case c == 'b':
+					if i+3 >= len(pat) {
+						return fmt.Errorf("malformed pattern (missing arguments to '%%b')")
+					}
+					i += 4
+					continue
+				case c == 'f':
+					i += 2
+					if i >= len(pat) || pat[i] != '[' {
+						return fmt.Errorf("missing '[' after '%%f' in pattern")
+					}
+					end, err := classEnd(pat, i)
+					if err != nil {
+						return err
+					}
+					i = end
+					continue
+				case c >= '0' && c <= '9':
+					if n := int(c - '0'); n == 0 || !closed[n] {
+						return fmt.Errorf("invalid capture index %%%d", n)
+					}
+					i += 2
+					continue
+				}
+			}
+		}
+		end, err := classEnd(pat, i)
+		if err != nil {
+			return err
+		}
+		i = end
+		if i < len(pat) && strings.IndexByte("*+-?", pat[i]) >= 0 {
+			i++
+		}
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("unfinished capture")
+	}
+	return nil
+}
+
+// classEnd returns the end of the single-character class starting at
+// pat[i].
+func classEnd(pat string, i int) (int, error) {
+	c := pat[i]
+	i++
+	switch c {
+	case '%':
+		if i >= len(pat) {
+			return 0, fmt.Errorf("malformed pattern (ends with '%%')")
+		}
+		return i + 1, nil
+	case '[':
+		if i < len(pat) && pat[i] == '^' {
+			i++
+		}
+		// The first character of a set is never its end, so []] is a
+		// set holding ']'.
+		for {
+			if i >= len(pat) {
+				return 0, fmt.Errorf("malformed pattern (missing ']')")
+			}
+			c := pat[i]
+			i++
+			if c == '%' && i < len(pat) {
+				i++
+			}
+			if i < len(pat) && pat[i] == ']' {
+				return i + 1, nil
+			}
+		}
+	}
+	return i, nil
+}
+
+// matcher holds the state of one attempt to match a pattern.
+type matcher struct {
+	src, pat string
+	level    int
+	capture  [maxCaptures]struct{ init, len int }
+	depth    int
+	step     func() error
+}
+
+// errTooComplex aborts a match that recurses too deeply.
+type errTooComplex struct{}
+
+// errAborted aborts a match with the error of its step function.
+type errAborted struct{ err error }
+
+// tick counts a step of the match.
+func (m *matcher) tick() {
+	if m.step != nil {
+		if err := m.step(); err != nil {
+			panic(errAborted{err})
+		}
+	}
+}
+
+func (m *matcher) match(s, p int) int {
+	if m.depth++; m.depth > maxMatchDepth {
+		panic(errTooComplex{})
+	}
+	defer func() { m.depth-- }()
+
+	for p < len(m.pat) {
+		m.tick()
+		switch m.pat[p] {
+		case '(':
+			if p+1 < len(m.pat) && m.pat[p+1] == ')' {
+				return m.startCapture(s, p+2, capPosition)
+			}
+			return m.startCapture(s, p+1, capUnfinished)
+		case ')':
+			return m.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(m.pat) {
+				if s == len(m.src) {
+					return s
+				}
+				return -1
+			}
+		case '%':
+			switch c := m.pat[p+1]; {
+			case c == 'b':
+				if s = m.matchBalance(s, p+2); s < 0 {
+					return -1
+				}
+				p += 4
+				continue
+			case c == 'f':
+				p += 2
+				ep, _ := classEnd(m.pat, p)
+				var prev, cur byte
+				if s > 0 {
+					prev = m.src[s-1]
+				}
+				if s < len(m.src) {
+					cur = m.src[s]
+				}
+				if matchBracketClass(prev, m.pat, p, ep-1) || !matchBracketClass(cur, m.pat, p, ep-1) {
+					return -1
+				}
+				p = ep
+				continue
+			case c >= '0' && c <= '9':
+				if s = m.matchCapture(s, int(c-'1')); s < 0 {
+					return -1
+				}
+				p += 2
+				continue
+			}
+		}
+
+		ep, _ := classEnd(m.pat, p)
+		var op byte
+		if ep < len(m.pat) {
+			op = m.pat[ep]
+		}
+		if !m.singleMatch(s, p, ep) {
+			if op == '*' || op == '?' || op == '-' {
+				p = ep + 1
+				continue
+			}
+			return -1
+		}
+		switch op {
+		case '?':
+			if res := m.match(s+1, ep+1); res >= 0 {
+				return res
+			}
+			p = ep + 1
+		case '+':
+			return m.maxExpand(s+1, p, ep)
+		case '*':
+			return m.maxExpand(s, p, ep)
+		case '-':
+			return m.minExpand(s, p, ep)
+		default:
+			s++
+			p = ep
+		}
+	}
+	return s
+}
+
+func (m *matcher) maxExpand(s, p, ep int) int {
+	i := 0
+	for m.singleMatch(s+i, p, ep) {
+		m.tick()
+		i++
+	}
+	for ; i >= 0; i-- {
+		if res := m.match(s+i, ep+1); res >= 0 {
+			return res
+		}
+	}
+	return -1
+}
+
+func (m *matcher) minExpand(s, p, ep int) int {
+	for {
+		if res := m.match(s, ep+1); res >= 0 {
+			return res
+		}
+		if !m.singleMatch(s, p, ep) {
+			return -1
+		}
+		s++
+	}
+}
+
+func (m *matcher) startCapture(s, p, what int) int {
+	m.capture[m.level].init = s
+	m.capture[m.level].len = what
+	m.level++
+	res := m.match(s, p)
+	if res < 0 {
+		m.level--
+	}
+	return res
+}
+
+func (m *matcher) endCapture(s, p int) int {
+	l := m.level - 1
+	for ; l >= 0; l-- {
+		if m.capture[l].len == capUnfinished {
+			break
+		}
+	}
+	m.capture[l].len = s - m.capture[l].init
+	res := m.match(s, p)
+	if res < 0 {
+		m.capture[l].len = capUnfinished
+	}
+	return res
+}
+
+func (m *matcher) matchBalance(s, p int) int {
+	if s >= len(m.src) || m.src[s] != m.pat[p] {
+		return -1
+	}
+	open, close := m.pat[p], m.pat[p+1]
+	depth := 1
+	for s++; s < len(m.src); s++ {
+		switch m.src[s] {
+		case close:
+			if depth--; depth == 0 {
+				return s + 1
+			}
+		case open:
+			depth++
+		}
+	}
+	return -1
+}
+
+func (m *matcher) matchCapture(s, l int) int {
+	n := m.capture[l].len
+	if n < 0 || len(m.src)-s < n || m.src[s:s+n] != m.src[m.capture[l].init:m.capture[l].init+n] {
+		return -1
+	}
+	return s + n
+}
+
+func (m *matcher) singleMatch(s, p, ep int) bool {
+	if s >= len(m.src) {
+		return false
+	}
+	c := m.src[s]
+	switch m.pat[p] {
+	case '.':
+		return true
+	case '%':
+		return matchClass(c, m.pat[p+1])
+	case '[':
+		return matchBracketClass(c, m.pat, p, ep-1)
+	}
+	return m.pat[p] == c
+}
+
+// matchBracketClass matches c against the set pat[p:ec+1], where pat[p] is
+// '[' and pat[ec] is ']'.
+func matchBracketClass(c byte, pat string, p, ec int) bool {
+	sig := true
+	if pat[p+1] == '^' {
+		sig = false
+		p++
+	}
+	for p++; p < ec; p++ {
+		switch {
+		case pat[p] == '%':
+			p++
+			if matchClass(c, pat[p]) {
+				return sig
+			}
+		case pat[p+1] == '-' && p+2 < ec:
+			p += 2
+			if pat[p-2] <= c && c <= pat[p] {
+				return sig
+			}
+		case pat[p] == c:
+			return sig
+		}
+	}
+	return !sig
+}
+
+// matchClass matches c against the class %cl in the C locale.
+func matchClass(c, cl byte) bool {
+	var res bool
+	switch cl | 0x20 {
+	case 'a':
+		res = isAlpha(c)
+	case 'c':
+		res = c < 0x20 || c == 0x7f
+	case 'd':
+		res = c >= '0' && c <= '9'
+	case 'g':
+		res = c > 0x20 && c < 0x7f
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = c > 0x20 && c < 0x7f && !isAlpha(c) && !(c >= '0' && c <= '9')
+	case 's':
+		res = c == ' ' || (c >= '\t' && c <= '\r')
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = isAlpha(c) || (c >= '0' && c <= '9')
+	case 'x':
+		res = (c >= '0' && c <= '9') || (c|0x20 >= 'a' && c|0x20 <= 'f')
+	default:
+		return cl == c
+	}
+	if cl >= 'A' && cl <= 'Z' {
+		return !res
+	}
+	return res
+}
+
+func isAlpha(c byte) bool {
+	return c|0x20 >= 'a' && c|0x20 <= 'z'
+}
+
+// matchAt tries to match the pattern at byte offset s of src and returns
+// the match or nil.
+func (p *Pattern) matchAt(src string, s int) (match *Match, err error) {
+	m := &matcher{src: src, pat: p.pat, step: p.step}
+	defer func() {
+		switch r := recover().(type) {
+		case nil:
+		case errTooComplex:
+			match, err = nil, fmt.Errorf("pattern too complex")
+		case errAborted:
+			match, err = nil, r.err
+		default:
+			panic(r)
+		}
+	}()
+	e := m.match(s, 0)
+	if e < 0 {
+		return nil, nil
+	}
+	match = &Match{Start: s, End: e, src: src}
+	for i := 0; i < m.level; i++ {
+		c := m.capture[i]
+		if c.len == capPosition {
+			match.Captures = append(match.Captures, Capture{Start: c.init, End: c.init, Position: true})
+		} else {
+			match.Captures = append(match.Captures, Capture{Start: c.init, End: c.init + c.len})
+		}
+	}
+	return match, nil
+}
+
+// Find returns the first match of the pattern in s that starts at or after
+// the byte offset init, or nil if there is none.
+func (p *Pattern) Find(s string, init int) (*Match, error) {
+	if init < 0 {
+		init = 0
+	}
+	for i := init; i <= len(s); i++ {
+		m, err := p.matchAt(s, i)
+		if m != nil || err != nil || p.anchor {
+			return m, err
+		}
+	}
+	return nil, nil
+}
+
+// FindAll returns the successive matches of the pattern in s from the byte
+// offset init, up to n matches if n is not negative. An empty match right
+// after the previous match is skipped. Unlike string.gmatch, an anchored
+// pattern matches at most once, at init.
+func (p *Pattern) FindAll(s string, init, n int) ([]*Match, error) {
+	var matches []*Match
+	err := p.each(s, init, n, func(m *Match) error {
+		matches = append(matches, m)
+		return nil
+	})
+	return matches, err
+}
+
+// each calls fn for the successive matches of the pattern in s, as FindAll
+// returns them. An anchored pattern matches at most once.
+func (p *Pattern) each(s string, init, n int, fn func(*Match) error) error {
+	last := -1
+	for src := init; src <= len(s) && n != 0; src++ {
+		m, err := p.matchAt(s, src)
+		if err != nil {
+			return err
+		}
+		if m != nil && m.End != last {
+			if err := fn(m); err != nil {
+				return err
+			}
+			n--
+			src, last = m.End-1, m.End
+		}
+		if p.anchor {
+			break
+		}
+	}
+	return nil
+}
+
+// Replace returns a copy of s with up to n matches of the pattern replaced
+// by repl, or all of them if n is negative, and the number of matches. In
+// repl, %0 stands for the whole match, %1 to %9 for captures and %% for a
+// percent sign.
+func (p *Pattern) Replace(s, repl string, n int) (string, int, error) {
+	return p.replace(s, n, func(m *Match) (string, bool, error) {
+		r, err := expandReplacement(m, repl)
+		return r, true, err
+	})
+}
+
+// ReplaceFunc is like Replace but replaces each match by the result of fn.
+func (p *Pattern) ReplaceFunc(s string, n int, fn func(*Match) string) (string, int, error) {
+	return p.replace(s, n, func(m *Match) (string, bool, error) {
+		return fn(m), true, nil
+	})
+}
+
+// replace implements string.gsub. fn returns the replacement for a match,
+// or false to keep the match unchanged.
+func (p *Pattern) replace(s string, n int, fn func(*Match) (string, bool, error)) (string, int, error) {
+	var b strings.Builder
+	count, last := 0, -1
+	src := 0
+	for n < 0 || count < n {
+		m, err := p.matchAt(s, src)
+		if err != nil {
+			return "", 0, err
+		}
+		if m != nil && m.End != last {
+			count++
+			r, ok, err := fn(m)
+			if err != nil {
+				return "", 0, err
+			}
+			if !ok {
+				r = m.String()
+			}
+			b.WriteString(r)
+			src, last = m.End, m.End
+		} else if src < len(s) {
+			b.WriteByte(s[src])
+			src++
+		} else {
+			break
+		}
+		if err := p.grown(b.Len()); err != nil {
+			return "", 0, err
+		}
+		if p.anchor {
+			break
+		}
+	}
+	b.WriteString(s[src:])
+	if err := p.grown(b.Len()); err != nil {
+		return "", 0, err
+	}
+	return b.String(), count, nil
+}
+
+// grown checks the size of the string a replace is building.
+func (p *Pattern) grown(size int) error {
+	if size > maxStringSize {
+		return fmt.Errorf("resulting string too large")
+	}
+	if p.fits != nil {
+		return p.fits(int64(size))
+	}
+	return nil
+}
+
+// expandReplacement expands the %-escapes of a gsub replacement string for
+// match m.
+func expandReplacement(m *Match, repl string) (string, error) {
+	if strings.IndexByte(repl, '%') < 0 {
+		return repl, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch {
+		case i < len(repl) && repl[i] == '%':
+			b.WriteByte('%')
+		case i < len(repl) && repl[i] >= '0' && repl[i] <= '9':
+			v, err := m.capture(int(repl[i] - '0'))
+			if err != nil {
+				return "", err
+			}
+			s, _ := toStr(v)
+			b.WriteString(s)
+		default:
+			return "", fmt.Errorf("invalid use of '%%' in replacement string")
+		}
+	}
+	return b.String(), nil
+}
+
+// capture returns capture n as a Lua value, where 0 and, for a pattern
+// without captures, 1 stand for the whole match.
+func (m *Match) capture(n int) (Value, error) {
+	if n == 0 || (n == 1 && len(m.Captures) == 0) {
+		return m.String(), nil
+	}
+	if n > len(m.Captures) {
+		return nil, fmt.Errorf("invalid capture index %%%d in replacement string", n)
+	}
+	return m.values()[n-1], nil
+}
+
+// hasSpecials reports whether pattern uses any pattern syntax, so that a
+// plain search is not enough.
+func hasSpecials(pattern string) bool {
+	return strings.ContainsAny(pattern, "^$*+?.([%-")
+}
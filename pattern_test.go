@@ -0,0 +1,222 @@
+package luar
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPattern_Find(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		init       int
+		want       []string // whole match followed by captures, nil for no match
+	}{
+		{"^(%w+)%.", "web01.example.com", 0, []string{"web01.", "web01"}},
+		{"%d+", "port 8080 and 9090", 0, []string{"8080"}},
+		{"%d+", "port 8080 and 9090", 9, []string{"9090"}},
+		{"^%d", "a1", 0, nil},
+		{"a-b", "aaab", 0, []string{"aaab"}},
+		{"a*", "baaa", 0, []string{""}},
+		{"ba*", "baaa", 0, []string{"baaa"}},
+		{"ba-$", "baaa", 0, []string{"baaa"}},
+		{"x?y", "y", 0, []string{"y"}},
+		{"[%a_][%w_]*", "  _id9 = 1", 0, []string{"_id9"}},
+		{"[^%s=]+", "key = value", 0, []string{"key"}},
+		{"[a-c]+", "xxabcabd", 0, []string{"abcab"}},
+		{"[]]", "a]", 0, []string{"]"}},
+		{"[%]]+", "a]]", 0, []string{"]]"}},
+		{"[a-]+", "-a-b", 0, []string{"-a-"}},
+		{"%b()", "f(a(b)c) d", 0, []string{"(a(b)c)"}},
+		{"%f[%w]%w+", "THE (quick) fox", 4, []string{"quick"}},
+		{"%f[%a]%a+%f[%A]", "hello world", 1, []string{"world"}},
+		{"(h)(e)(l)", "hello", 0, []string{"hel", "h", "e", "l"}},
+		{"(%a+)=%1", "x=y ab=ab", 0, []string{"ab=ab", "ab"}},
+		{"()ll()", "hello", 0, []string{"ll", "", ""}},
+		{"(a(b)c)", "xabcx", 0, []string{"abc", "abc", "b"}},
+		{"%s*$", "abc  ", 0, []string{"  "}},
+		{"$", "abc", 0, []string{""}},
+		{"a$b", "a$b", 0, []string{"a$b"}},
+		{"%u%l+", "hello World", 0, []string{"World"}},
+		{"%x+", "zz1fF", 0, []string{"1fF"}},
+		{"%p", "a,b", 0, []string{","}},
+		{"%c", "a\tb", 0, []string{"\t"}},
+		{"%S+", "  abc ", 0, []string{"abc"}},
+		{".-b", "aaab", 0, []string{"aaab"}},
+	}
+	for _, tt := range tests {
+		p, err := CompilePattern(tt.pattern)
+		if err != nil {
+			t.Errorf("CompilePattern(%q): %v", tt.pattern, err)
+			continue
+		}
+		m, err := p.Find(tt.s, tt.init)
+		if err != nil {
+			t.Errorf("%q in %q: %v", tt.pattern, tt.s, err)
+			continue
+		}
+		var got []string
+		if m != nil {
+			got = append(got, m.String())
+			for i := range m.Captures {
+				got = append(got, m.Capture(i))
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q in %q: got %q, want %q", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestPattern_PositionCapture(t *testing.T) {
+	m, err := MustCompilePattern("()ll()").Find("hello", 0)
+	if err != nil || m == nil {
+		t.Fatalf("got %v, %v", m, err)
+	}
+	want := []Capture{{2, 2, true}, {4, 4, true}}
+	if !reflect.DeepEqual(m.Captures, want) {
+		t.Errorf("got %+v, want %+v", m.Captures, want)
+	}
+	if got := m.values(); !reflect.DeepEqual(got, []Value{int64(3), int64(5)}) {
+		t.Errorf("values %v", got)
+	}
+}
+
+func TestPattern_FindAllAndReplace(t *testing.T) {
+	p := MustCompilePattern("%a+")
+	ms, err := p.FindAll("one two  three", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var words []string
+	for _, m := range ms {
+		words = append(words, m.String())
+	}
+	if strings.Join(words, ",") != "one,two,three" {
+		t.Errorf("got %v", words)
+	}
+	if ms, _ := p.FindAll("one two three", 0, 2); len(ms) != 2 {
+		t.Errorf("got %d matches with n = 2", len(ms))
+	}
+
+	tests := []struct {
+		pattern, s, repl string
+		n                int
+		want             string
+		count            int
+	}{
+		{"(%w+)", "hello world", "%1 %1", -1, "hello hello world world", 2},
+		{"%w+", "hello world", "<%0>", 1, "<hello> world", 1},
+		{"(%w+)=(%w+)", "a=b, c=d", "%2=%1", -1, "b=a, d=c", 2},
+		{"", "abc", "-", -1, "-a-b-c-", 4},
+		{"x*", "abc", "-", -1, "-a-b-c-", 4},
+		{"^%s+", "  trim  ", "", -1, "trim  ", 1},
+		{"%%", "100%", "%% off", -1, "100% off", 1},
+	}
+	for _, tt := range tests {
+		got, count, err := MustCompilePattern(tt.pattern).Replace(tt.s, tt.repl, tt.n)
+		if err != nil || got != tt.want || count != tt.count {
+			t.Errorf("gsub(%q, %q, %q) = %q, %d, %v, want %q, %d", tt.s, tt.pattern, tt.repl, got, count, err, tt.want, tt.count)
+		}
+	}
+
+	got, _, _ := MustCompilePattern("%d+").ReplaceFunc("a1b22", -1, func(m *Match) string {
+		return strings.Repeat("#", len(m.String()))
+	})
+	if got != "a#b##" {
+		t.Errorf("ReplaceFunc got %q", got)
+	}
+	if _, _, err := MustCompilePattern("a").Replace("a", "%2", -1); err == nil {
+		t.Error("expected an invalid capture index error")
+	}
+
+	// The size of the result is checked while it is built.
+	p = MustCompilePattern("x")
+	largest := 0
+	p.fits = func(size int64) error {
+		if largest = int(size); size > 100 {
+			return errors.New("too large")
+		}
+		return nil
+	}
+	if _, _, err := p.Replace(strings.Repeat("x", 1000), "yy", -1); err == nil || err.Error() != "too large" || largest > 102 {
+		t.Errorf("got %v after %d bytes", err, largest)
+	}
+}
+
+func TestPattern_Errors(t *testing.T) {
+	tests := map[string]string{
+		"%":     "malformed pattern (ends with '%')",
+		"[a":    "malformed pattern (missing ']')",
+		"[]":    "malformed pattern (missing ']')",
+		"%b(":   "malformed pattern (missing arguments to '%b')",
+		"%fa":   "missing '[' after '%f' in pattern",
+		"(a":    "unfinished capture",
+		"a)":    "invalid pattern capture",
+		"(a)%2": "invalid capture index %2",
+		"(a%1)": "invalid capture index %1",
+		"%0":    "invalid capture index %0",
+		"(((((((((((((((((((((((((((((((((a)))))))))))))))))))))))))))))))))": "too many captures",
+	}
+	for pattern, want := range tests {
+		if _, err := CompilePattern(pattern); err == nil || err.Error() != want {
+			t.Errorf("CompilePattern(%q) = %v, want %q", pattern, err, want)
+		}
+	}
+
+	p := MustCompilePattern(strings.Repeat("a?", 300))
+	if _, err := p.Find(strings.Repeat("a", 300), 0); err == nil || err.Error() != "pattern too complex" {
+		t.Errorf("got %v, want pattern too complex", err)
+	}
+}
+
+func TestLib_Patterns(t *testing.T) {
+	tests := []struct {
+		src  string
+		want Value
+	}{
+		{`x = string.match("web01.example.com", "^(%w+)%.")`, "web01"},
+		{`local k, v = ("key = value"):match("(%w+)%s*=%s*(%w+)") x = k .. ":" .. v`, "key:value"},
+		{`x = string.match("hello", "()ll")`, int64(3)},
+		{`x = string.match("hello", "xyz")`, nil},
+		{`local s, e = string.find("hello world", "wor") x = s * 100 + e`, int64(709)},
+		{`local s, e = string.find("a.b", ".", 1, true) x = s * 100 + e`, int64(202)},
+		{`local s, e, c = string.find("k=v", "(%w)=") x = s .. e .. c`, "12k"},
+		{`x = string.find("abc", "b", -1)`, nil},
+		{`x = string.find("abc", "", 10)`, nil},
+		{`x = string.find("abc", "", 4)`, int64(4)},
+		{`x = "" for w in string.gmatch("one two three", "%a+") do x = x .. w .. ";" end`, "one;two;three;"},
+		{`x = "" for k, v in ("a=1, b=2"):gmatch("(%w+)=(%w+)") do x = x .. v .. k end`, "1a2b"},
+		{`x = "" for w in string.gmatch("hello world", "^%a+") do x = x .. w .. ";" end`, ""},
+		{`x = "" for w in string.gmatch("^a^b c^", "^%a") do x = x .. w .. ";" end`, "^a;^b;"},
+		{`x = "" for d in ("^1 2 ^3"):gmatch("^(%d)") do x = x .. d end`, "13"},
+		{`x = select(2, string.gsub("hello world", "o", "0"))`, int64(2)},
+		{`x = string.gsub("hello world", "(%w+)", "<%1>")`, "<hello> <world>"},
+		{`x = string.gsub("$name is $age", "%$(%w+)", {name = "Bob", age = 42})`, "Bob is 42"},
+		{`x = string.gsub("$name $unknown", "%$(%w+)", {name = "Bob"})`, "Bob $unknown"},
+		{`x = string.gsub("abc", "%w", function(c) return c:upper() .. "." end)`, "A.B.C."},
+		{`x = string.gsub("abc", "%w", function(c) if c == "b" then return false end return "-" end)`, "-b-"},
+		{`x = string.gsub("abc", "", "-", 2)`, "-a-bc"},
+	}
+	for _, tt := range tests {
+		got, err := runLib(t, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+
+	for src, want := range map[string]string{
+		`x = string.find("a", "%")`:                           "malformed pattern (ends with '%')",
+		`x = string.gsub("a", "a", true)`:                     "bad argument #3 to 'gsub' (string/function/table expected, got boolean)",
+		`x = string.gsub("a", "a", function() return {} end)`: "invalid replacement value (a table)",
+	} {
+		if _, err := runLib(t, src); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", src, err, want)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package luar
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Sprintf formats args like Lua's string.format. It supports the %d, %i, %u,
+// %c, %x, %X, %o, %e, %E, %f, %F, %g, %G, %a, %A, %q, %s and %% conversions
+// with the flags, width and precision Lua allows for each. Go values in args
+// are converted to Lua values like the results of registered functions.
+func Sprintf(format string, args ...interface{}) (string, error) {
+	vals := make([]Value, len(args)+1)
+	vals[0] = format
+	d := NewDecoder(nil)
+	for i, arg := range args {
+		v, err := d.fromGo(reflect.ValueOf(arg))
+		if err != nil {
+			return "", err
+		}
+		vals[i+1] = v
+	}
+	return strformat(&libArgs{name: "format", vals: vals})
+}
+
+// Quote returns s as a double-quoted Lua string literal that reads back as s,
+// as string.format("%q", s) does. Bytes that are not valid UTF-8 are kept
+// as is.
+func Quote(s string) string {
+	var b strings.Builder
+	quote(&b, s)
+	return b.String()
+}
+
+func quote(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\' || c == '\n':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			// A short decimal escape must not run into a following digit.
+			if i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9' {
+				fmt.Fprintf(b, "\\%03d", c)
+			} else {
+				fmt.Fprintf(b, "\\%d", c)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+}
+
+// literal writes v as a Lua literal for %q.
+func literal(b *strings.Builder, a *libArgs, arg int) error {
+	switch v := a.get(arg).(type) {
+	case string:
+		quote(b, v)
+	case int64:
+		if v == math.MinInt64 {
+			// -9223372036854775808 would read back as a float.
+			b.WriteString("0x8000000000000000")
+		} else {
+			b.WriteString(strconv.FormatInt(v, 10))
+		}
+	case float64:
+		switch {
+		case math.IsInf(v, 1):
+			b.WriteString("1e9999")
+		case math.IsInf(v, -1):
+			b.WriteString("-1e9999")
+		case math.IsNaN(v):
+			b.WriteString("(0/0)")
+		default:
+			b.WriteString(trimExponent(strconv.FormatFloat(v, 'x', -1, 64)))
+		}
+	case nil, bool:
+		b.WriteString(tostring(v))
+	default:
+		return a.errorf(arg, "value has no literal form")
+	}
+	return nil
+}
+
+// conversion is a parsed format specifier.
+type conversion struct {
+	form  string // the whole specifier, e.g. %-5.2f
+	flags string
+	width int
+	prec  int // -1 without a precision
+}
+
+// parseConversion splits the flags, width and precision of spec, which is
+// form without the leading % and trailing conversion character. It reports
+// the flags and the precision that are not valid for the conversion as Lua
+// does: widths and precisions have at most two digits.
+func parseConversion(form, spec, flags string, prec bool) (conversion, error) {
+	c := conversion{form: form, prec: -1}
+	i := 0
+	for i < len(spec) && strings.IndexByte(flags, spec[i]) >= 0 {
+		i++
+	}
+	c.flags = spec[:i]
+	digits := func() int {
+		n := 0
+		for j := 0; j < 2 && i < len(spec) && spec[i] >= '0' && spec[i] <= '9'; j++ {
+			n = n*10 + int(spec[i]-'0')
+			i++
+		}
+		return n
+	}
+	if i < len(spec) && spec[i] != '0' {
+		c.width = digits()
+		if i < len(spec) && spec[i] == '.' && prec {
+			i++
+			c.prec = digits()
+		}
+	}
+	if i < len(spec) {
+		return c, fmt.Errorf("invalid conversion specification: '%s'", form)
+	}
+	return c, nil
+}
+
+func (c conversion) has(flag byte) bool {
+	return strings.IndexByte(c.flags, flag) >= 0
+}
+
+// goFormat returns the Go format for c with the verb conv, which matches C's
+// for the numeric conversions.
+func (c conversion) goFormat(conv byte, width bool) string {
+	f := "%" + c.flags
+	if width && c.width > 0 {
+		f += strconv.Itoa(c.width)
+	}
+	if c.prec >= 0 {
+		f += "." + strconv.Itoa(c.prec)
+	}
+	return f + string(conv)
+}
+
+// pad pads s to the width of c with spaces, or with zeros after the sign and
+// the 0x prefix of hexadecimal floats. Unlike Go's widths it counts bytes.
+func (c conversion) pad(s string) string {
+	n := c.width - len(s)
+	switch {
+	case n <= 0:
+		return s
+	case c.has('-'):
+		return s + strings.Repeat(" ", n)
+	case c.has('0'):
+		i := 0
+		if i < len(s) && (s[i] == '-' || s[i] == '+' || s[i] == ' ') {
+			i++
+		}
+		if strings.HasPrefix(strings.ToLower(s[i:]), "0x") {
+			i += 2
+		}
+		return s[:i] + strings.Repeat("0", n) + s[i:]
+	}
+	return strings.Repeat(" ", n) + s
+}
+
+// strformat implements string.format.
+func strformat(a *libArgs) (string, error) {
+	f, err := a.str(0)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	arg := 0
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			b.WriteByte(f[i])
+			continue
+		}
+		i++
+		if i < len(f) && f[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+
+		start := i
+		for i < len(f) && strings.IndexByte("-+ #0123456789.", f[i]) >= 0 {
+			i++
+		}
+		if i-start >= 21 {
+			return "", fmt.Errorf("invalid format string to 'format'")
+		}
+		arg++
+		if arg >= len(a.vals) {
+			return "", a.errorf(arg, "no value")
+		}
+		if i >= len(f) {
+			return "", fmt.Errorf("invalid conversion '%%%s' to 'format'", f[start:])
+		}
+		spec, conv, form := f[start:i], f[i], "%"+f[start:i+1]
+
+		var c conversion
+		switch conv {
+		case 'c':
+			c, err = parseConversion(form, spec, "-", false)
+		case 'd', 'i':
+			c, err = parseConversion(form, spec, "-+0 ", true)
+		case 'u':
+			c, err = parseConversion(form, spec, "-0", true)
+		case 'o', 'x', 'X':
+			c, err = parseConversion(form, spec, "-#0", true)
+		case 'a', 'A', 'e', 'E', 'f', 'F', 'g', 'G':
+			c, err = parseConversion(form, spec, "-+ #0", true)
+		case 's':
+			c, err = parseConversion(form, spec, "-", true)
+		case 'q':
+			if spec != "" {
+				return "", fmt.Errorf("specifier '%%q' cannot have modifiers")
+			}
+		default:
+			return "", fmt.Errorf("invalid conversion '%s' to 'format'", form)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch conv {
+		case 'c':
+			n, err := a.integer(arg)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(c.pad(string([]byte{byte(n)})))
+		case 'd', 'i':
+			n, err := a.integer(arg)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, c.goFormat('d', true), n)
+		case 'u', 'o', 'x', 'X':
+			n, err := a.integer(arg)
+			if err != nil {
+				return "", err
+			}
+			verb := conv
+			if verb == 'u' {
+				verb = 'd'
+			}
+			fmt.Fprintf(&b, c.goFormat(verb, true), uint64(n))
+		case 'a', 'A':
+			n, err := a.float(arg)
+			if err != nil {
+				return "", err
+			}
+			s := trimExponent(fmt.Sprintf(c.goFormat('x', false), n))
+			if conv == 'A' {
+				s = strings.ToUpper(s)
+			}
+			b.WriteString(c.pad(s))
+		case 'e', 'E', 'f', 'F', 'g', 'G':
+			n, err := a.float(arg)
+			if err != nil {
+				return "", err
+			}
+			if math.IsInf(n, 0) || math.IsNaN(n) {
+				// C pads infinities and NaNs with spaces only.
+				s := "inf"
+				if math.IsNaN(n) {
+					s = "nan"
+				}
+				switch {
+				case n < 0:
+					s = "-" + s
+				case c.has('+'):
+					s = "+" + s
+				case c.has(' '):
+					s = " " + s
+				}
+				if conv >= 'A' && conv <= 'Z' {
+					s = strings.ToUpper(s)
+				}
+				c.flags = strings.Replace(c.flags, "0", "", -1)
+				b.WriteString(c.pad(s))
+				break
+			}
+			if (conv == 'g' || conv == 'G') && c.prec < 0 {
+				// C's %g defaults to 6 significant digits, Go's to
+				// the shortest representation.
+				c.prec = 6
+			}
+			fmt.Fprintf(&b, c.goFormat(conv, true), n)
+		case 'q':
+			if err := literal(&b, a, arg); err != nil {
+				return "", err
+			}
+		case 's':
+			s := tostring(a.get(arg))
+			switch {
+			case spec == "":
+				b.WriteString(s)
+			case strings.IndexByte(s, 0) >= 0:
+				return "", a.errorf(arg, "string contains zeros")
+			case c.prec < 0 && len(s) >= 100:
+				// Like Lua, long strings are added as they are.
+				b.WriteString(s)
+			default:
+				if c.prec >= 0 && len(s) > c.prec {
+					s = s[:c.prec]
+				}
+				b.WriteString(c.pad(s))
+			}
+		}
+		if b.Len() > maxStringSize {
+			return "", fmt.Errorf("resulting string too large")
+		}
+	}
+	return b.String(), nil
+}
+
+// trimExponent removes leading zeros from the exponent of a hexadecimal
+// float, which C prints as p+1 where Go prints p+01.
+func trimExponent(s string) string {
+	i := strings.LastIndexAny(s, "pP")
+	if i < 0 || i+2 >= len(s) {
+		return s
+	}
+	exp := strings.TrimLeft(s[i+2:], "0")
+	if exp == "" {
+		exp = "0"
+	}
+	return s[:i+2] + exp
+}
@@ -0,0 +1,164 @@
+package luar
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSprintf(t *testing.T) {
+	tests := []struct {
+		format string
+		args   []interface{}
+		want   string
+	}{
+		{"%5.1f|%-4d|%04x", []interface{}{3.14159, 7, 255}, "  3.1|7   |00ff"},
+		{"%i %u", []interface{}{42, -1}, "42 18446744073709551615"},
+		{"%#x %#o %X", []interface{}{255, 8, 3054}, "0xff 010 BEE"},
+		{"%5c|%-3c|", []interface{}{65, 'b'}, "    A|b  |"},
+		{"%e %E", []interface{}{12345.678, 0.5}, "1.234568e+04 5.000000E-01"},
+		{"%.3g %G %g", []interface{}{0.0001234, 1e-10, 2}, "0.000123 1E-10 2"},
+		{"%+.2f % d %+d", []interface{}{1, 5, 0}, "+1.00  5 +0"},
+		{"%#g %#.0f", []interface{}{1, 2}, "1.00000 2."},
+		{"%10.3s|%-6s|%.0s|", []interface{}{"abcdef", "ab", "x"}, "       abc|ab    ||"},
+		{"%s %s %s %s", []interface{}{nil, true, 1, 2.5}, "nil true 1 2.5"},
+		{"%a %A %.2a", []interface{}{1.5, 0.5, 1}, "0x1.8p+0 0X1P-1 0x1.00p+0"},
+		{"%10a|%-9a|%010a", []interface{}{1, 1, 1}, "    0x1p+0|0x1p+0   |0x00001p+0"},
+		{"%f %5.1f %+f %F %05f", []interface{}{math.Inf(1), math.Inf(-1), math.Inf(1), math.NaN(), math.Inf(1)}, "inf  -inf +inf NAN   inf"},
+		{"%.3d|%.0d|%5.3d", []interface{}{7, 0, -7}, "007|| -007"},
+		{"100%%", nil, "100%"},
+		{"%5s", []interface{}{strings.Repeat("x", 100)}, strings.Repeat("x", 100)},
+	}
+	for _, tt := range tests {
+		got, err := Sprintf(tt.format, tt.args...)
+		if err != nil {
+			t.Errorf("Sprintf(%q): %v", tt.format, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Sprintf(%q) = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestSprintf_Quote(t *testing.T) {
+	tests := []struct {
+		arg  interface{}
+		want string
+	}{
+		{"plain", `"plain"`},
+		{"a\nb\"c\\", "\"a\\\nb\\\"c\\\\\""},
+		{"\x001\r\t\x7f", `"\0001\13\9\127"`},
+		{"héllo \xff", "\"héllo \xff\""},
+		{int64(42), "42"},
+		{int64(math.MinInt64), "0x8000000000000000"},
+		{1.5, "0x1.8p+0"},
+		{0.1, "0x1.999999999999ap-4"},
+		{-2.0, "-0x1p+1"},
+		{math.Inf(1), "1e9999"},
+		{math.Inf(-1), "-1e9999"},
+		{math.NaN(), "(0/0)"},
+		{nil, "nil"},
+		{false, "false"},
+	}
+	for _, tt := range tests {
+		got, err := Sprintf("%q", tt.arg)
+		if err != nil {
+			t.Errorf("%%q of %#v: %v", tt.arg, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%%q of %#v = %s, want %s", tt.arg, got, tt.want)
+		}
+		if s, ok := tt.arg.(string); ok && Quote(s) != got {
+			t.Errorf("Quote(%q) = %s, want %s", s, Quote(s), got)
+		}
+	}
+}
+
+// TestSprintf_QuoteRoundTrip checks that %q output reads back as the value
+// it was made from.
+func TestSprintf_QuoteRoundTrip(t *testing.T) {
+	var all []byte
+	for i := 0; i < 256; i++ {
+		all = append(all, byte(i), '7')
+	}
+	values := []Value{
+		string(all), "", "tab\there", "\r\n", "€ and  ",
+		int64(0), int64(-1), int64(math.MaxInt64), int64(math.MinInt64),
+		0.1, -1e-300, 5e-324, math.MaxFloat64, math.Inf(1), math.Inf(-1), 3.0,
+		true, nil,
+	}
+	for _, v := range values {
+		q, err := Sprintf("%q", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := runLib(t, "x = "+q)
+		if err != nil {
+			t.Errorf("%s: %v", q, err)
+			continue
+		}
+		if got != v {
+			t.Errorf("%s read back as %#v, want %#v", q, got, v)
+		}
+	}
+
+	got, err := runLib(t, `x = string.format("%q", 0/0)`)
+	if err != nil || got != "(0/0)" {
+		t.Errorf("got %#v, %v", got, err)
+	}
+	got, err = runLib(t, `local s = "a\0b\n\"" x = string.format("return %q", s)`)
+	if err != nil || got != "return \"a\\0b\\\n\\\"\"" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestSprintf_Errors(t *testing.T) {
+	tests := []struct {
+		format string
+		args   []interface{}
+		want   string
+	}{
+		{"%5q", []interface{}{"x"}, "specifier '%q' cannot have modifiers"},
+		{"%#d", []interface{}{1}, "invalid conversion specification: '%#d'"},
+		{"%123d", []interface{}{1}, "invalid conversion specification: '%123d'"},
+		{"%.3c", []interface{}{65}, "invalid conversion specification: '%.3c'"},
+		{"%+s", []interface{}{"x"}, "invalid conversion specification: '%+s'"},
+		{"%y", []interface{}{1}, "invalid conversion '%y' to 'format'"},
+		{"%", []interface{}{1}, "invalid conversion '%' to 'format'"},
+		{"%-----------------------d", []interface{}{1}, "invalid format string to 'format'"},
+		{"%d", nil, "bad argument #2 to 'format' (no value)"},
+		{"%d %d", []interface{}{1, 2.5}, "bad argument #3 to 'format' (number has no integer representation)"},
+		{"%f", []interface{}{"x"}, "bad argument #2 to 'format' (number expected, got string)"},
+		{"%q", []interface{}{NewTable()}, "bad argument #2 to 'format' (value has no literal form)"},
+		{"%5s", []interface{}{"a\x00b"}, "bad argument #2 to 'format' (string contains zeros)"},
+	}
+	for _, tt := range tests {
+		if _, err := Sprintf(tt.format, tt.args...); err == nil || err.Error() != tt.want {
+			t.Errorf("Sprintf(%q) = %v, want %q", tt.format, err, tt.want)
+		}
+	}
+}
+
+func TestEncoder_QuotesStrings(t *testing.T) {
+	type config struct {
+		Motd string            `lua:"motd"`
+		Tags map[string]string `lua:"tags"`
+	}
+	in := config{Motd: "line 1\nline \"2\"\x01\xff", Tags: map[string]string{"a-b": "\t"}}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out config
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", data, err)
+	}
+	if out.Motd != in.Motd || out.Tags["a-b"] != "\t" {
+		t.Errorf("round trip of %s: got %+v", data, out)
+	}
+	if !strings.Contains(string(data), `["a-b"] = "\9"`) {
+		t.Errorf("expected a quoted key in %s", data)
+	}
+}
@@ -0,0 +1,104 @@
+package luar
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// SetDurationUnit sets the unit applied to plain numbers decoded into a
+// time.Duration, so that with the default of time.Second `timeout = 30` means
+// thirty seconds. Strings are always parsed with time.ParseDuration.
+func (d *Decoder) SetDurationUnit(unit time.Duration) {
+	d.durationUnit = unit
+}
+
+func (d *Decoder) setDuration(field reflect.Value, val Value) error {
+	switch v := val.(type) {
+	case nil:
+		field.SetInt(0)
+	case string:
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("luar: %v", err)
+		}
+		field.SetInt(int64(dur))
+	case int64:
+		unit := int64(d.durationUnit)
+		if unit > 0 && (v > math.MaxInt64/unit || v < math.MinInt64/unit) {
+			return fmt.Errorf("luar: duration %d out of range", v)
+		}
+		field.SetInt(v * unit)
+	case float64:
+		f := math.Round(v * float64(d.durationUnit))
+		// float64(math.MaxInt64) rounds up to 2^63, which is out of range.
+		if math.IsNaN(f) || f >= math.MaxInt64 || f < math.MinInt64 {
+			return fmt.Errorf("luar: duration %v out of range", v)
+		}
+		field.SetInt(int64(f))
+	}
+	return nil
+}
+
+// setTime decodes a time.Time from an RFC 3339 string, a Unix timestamp in
+// seconds, or an os.time-style table. Like os.time, a table must have year,
+// month and day fields; hour defaults to 12 and min and sec to 0. Tables are
+// interpreted in UTC.
+func (d *Decoder) setTime(field reflect.Value, val Value) error {
+	switch v := val.(type) {
+	case nil:
+		field.Set(reflect.Zero(timeType))
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return fmt.Errorf("luar: %v", err)
+		}
+		field.Set(reflect.ValueOf(t))
+	case int64:
+		field.Set(reflect.ValueOf(time.Unix(v, 0).UTC()))
+	case float64:
+		sec, frac := math.Modf(v)
+		field.Set(reflect.ValueOf(time.Unix(int64(sec), int64(frac*1e9)).UTC()))
+	case *Table:
+		t, err := dateTable(v)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(t))
+	}
+	return nil
+}
+
+func dateTable(t *Table) (time.Time, error) {
+	fields := map[string]int{"hour": 12, "min": 0, "sec": 0}
+	for _, name := range []string{"year", "month", "day", "hour", "min", "sec"} {
+		v := t.Get(name)
+		if v == nil {
+			if _, ok := fields[name]; !ok {
+				return time.Time{}, fmt.Errorf("luar: field '%s' missing in date table", name)
+			}
+			continue
+		}
+		n, ok := v.(int64)
+		if !ok {
+			f, isFloat := v.(float64)
+			if !isFloat || f != math.Trunc(f) {
+				return time.Time{}, fmt.Errorf("luar: field '%s' is not an integer", name)
+			}
+			n = int64(f)
+		}
+		fields[name] = int(n)
+	}
+	return time.Date(fields["year"], time.Month(fields["month"]), fields["day"],
+		fields["hour"], fields["min"], fields["sec"], 0, time.UTC), nil
+}
+
+func (e *Encoder) encodeDuration(v reflect.Value) {
+	e.writeString(Quote(time.Duration(v.Int()).String()))
+}
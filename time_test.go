@@ -0,0 +1,115 @@
+package luar
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type TimeConfig struct {
+	Timeout  time.Duration  `lua:"timeout"`
+	Interval time.Duration  `lua:"interval"`
+	Retry    *time.Duration `lua:"retry"`
+	Start    time.Time      `lua:"start"`
+	End      *time.Time     `lua:"end_at"`
+	Epoch    time.Time      `lua:"epoch"`
+}
+
+func TestUnmarshal_Duration(t *testing.T) {
+	data := []byte(`
+timeout = "1m30s"
+interval = 30
+retry = 1.5
+`)
+	var config TimeConfig
+	if err := Unmarshal(data, &config); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if config.Timeout != 90*time.Second {
+		t.Errorf("Timeout: expected 1m30s, got %v", config.Timeout)
+	}
+	if config.Interval != 30*time.Second {
+		t.Errorf("Interval: expected 30s, got %v", config.Interval)
+	}
+	if config.Retry == nil || *config.Retry != 1500*time.Millisecond {
+		t.Errorf("Retry: expected 1.5s, got %v", config.Retry)
+	}
+
+	if err := Unmarshal([]byte(`timeout = "soon"`), &config); err == nil {
+		t.Error("expected error for invalid duration")
+	}
+	for _, src := range []string{"timeout = 10000000000", "timeout = -10000000000", "timeout = 1e10", "timeout = 0/0"} {
+		if err := Unmarshal([]byte(src), &config); err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("%s: got %v, want an out of range error", src, err)
+		}
+	}
+	if err := Unmarshal([]byte("timeout = 9223372036"), &config); err != nil || config.Timeout != 9223372036*time.Second {
+		t.Errorf("got %v, %v", config.Timeout, err)
+	}
+}
+
+func TestUnmarshal_DurationUnit(t *testing.T) {
+	var config TimeConfig
+	dec := NewDecoder(strings.NewReader(`interval = 250`))
+	dec.SetDurationUnit(time.Millisecond)
+	if err := dec.Decode(&config); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	if config.Interval != 250*time.Millisecond {
+		t.Errorf("Interval: expected 250ms, got %v", config.Interval)
+	}
+}
+
+func TestUnmarshal_Time(t *testing.T) {
+	data := []byte(`
+start = "2024-03-01T08:30:00Z"
+end_at = {year = 2024, month = 3, day = 2, hour = 18, min = 15}
+epoch = 86400
+`)
+	var config TimeConfig
+	if err := Unmarshal(data, &config); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if want := time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC); !config.Start.Equal(want) {
+		t.Errorf("Start: expected %v, got %v", want, config.Start)
+	}
+	if want := time.Date(2024, 3, 2, 18, 15, 0, 0, time.UTC); config.End == nil || !config.End.Equal(want) {
+		t.Errorf("End: expected %v, got %v", want, config.End)
+	}
+	if want := time.Date(1970, 1, 2, 0, 0, 0, 0, time.UTC); !config.Epoch.Equal(want) {
+		t.Errorf("Epoch: expected %v, got %v", want, config.Epoch)
+	}
+
+	if err := Unmarshal([]byte(`start = {year = 2024, month = 3}`), &config); err == nil {
+		t.Error("expected error for date table without day")
+	}
+}
+
+func TestMarshal_Time(t *testing.T) {
+	original := TimeConfig{
+		Timeout: 90 * time.Second,
+		Start:   time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC),
+	}
+	data, err := Marshal(original)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	output := string(data)
+	for _, want := range []string{`timeout = "1m30s"`, `start = "2024-03-01T08:30:00Z"`} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected '%s' in output, got: %s", want, output)
+		}
+	}
+
+	var decoded TimeConfig
+	if err := Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decoded.Timeout != original.Timeout || !decoded.Start.Equal(original.Start) {
+		t.Errorf("round trip: expected %+v, got %+v", original, decoded)
+	}
+}
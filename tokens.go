@@ -101,6 +101,26 @@ type Token struct {
 	Literal string
 	Line    int
 	Column  int
+	Offset  int
+	Raw     string
+
+	Leading  []Trivia
+	Trailing []Trivia
+}
+
+type TriviaKind int
+
+const (
+	TriviaWhitespace TriviaKind = iota
+	TriviaNewline
+	TriviaComment
+)
+
+// Trivia is source text between tokens that does not affect the program:
+// whitespace, line breaks and comments.
+type Trivia struct {
+	Kind TriviaKind
+	Text string
 }
 
 func (t Token) String() string {
@@ -0,0 +1,167 @@
+package luar
+
+import (
+	"math"
+	"strconv"
+)
+
+// Value is a Lua value produced by evaluating config source. It holds one of
+// nil, bool, int64, float64, string or *Table.
+type Value = interface{}
+
+// Table is a Lua table. Keys keep their insertion order so that iteration and
+// encoding are deterministic.
+type Table struct {
+	keys   []Value
+	values map[Value]Value
+
+	// border is the length of the sequence part: keys 1..border are all
+	// present and border+1 is not.
+	border int
+}
+
+func NewTable() *Table {
+	return &Table{values: make(map[Value]Value)}
+}
+
+func normalizeKey(key Value) Value {
+	switch k := key.(type) {
+	case int:
+		return int64(k)
+	case float64:
+		if k == math.Trunc(k) && !math.IsInf(k, 0) && k >= math.MinInt64 && k < math.MaxInt64 {
+			return int64(k)
+		}
+	}
+	return key
+}
+
+func (t *Table) Get(key Value) Value {
+	if key == nil {
+		return nil
+	}
+	return t.values[normalizeKey(key)]
+}
+
+// Set stores val under key. Assigning nil removes the key.
+func (t *Table) Set(key Value, val Value) {
+	if key == nil {
+		return
+	}
+	key = normalizeKey(key)
+	if _, ok := t.values[key]; ok {
+		if val == nil {
+			delete(t.values, key)
+			if i, ok := key.(int64); ok && i >= 1 && i <= int64(t.border) {
+				t.border = int(i) - 1
+			}
+			for i, k := range t.keys {
+				if k == key {
+					t.keys = append(t.keys[:i], t.keys[i+1:]...)
+					break
+				}
+			}
+			return
+		}
+		t.values[key] = val
+		return
+	}
+	if val == nil {
+		return
+	}
+	t.keys = append(t.keys, key)
+	t.values[key] = val
+	if key == int64(t.border+1) {
+		for {
+			t.border++
+			if _, ok := t.values[int64(t.border+1)]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// Append stores val at index Len()+1.
+func (t *Table) Append(val Value) {
+	t.Set(int64(t.Len()+1), val)
+}
+
+// Len returns the length of the sequence part of the table, i.e. the largest
+// n such that keys 1..n are all present.
+func (t *Table) Len() int {
+	return t.border
+}
+
+// Keys returns the keys of the table in insertion order.
+func (t *Table) Keys() []Value {
+	keys := make([]Value, len(t.keys))
+	copy(keys, t.keys)
+	return keys
+}
+
+// IsSequence reports whether every key of the table is part of its sequence.
+func (t *Table) IsSequence() bool {
+	return len(t.keys) == t.Len()
+}
+
+// keyString returns the string form used when a table key is matched against
+// a struct field or a map[string]T key.
+func keyString(key Value) (string, bool) {
+	switch k := key.(type) {
+	case string:
+		return k, true
+	case int64:
+		return strconv.FormatInt(k, 10), true
+	case float64:
+		return strconv.FormatFloat(k, 'g', -1, 64), true
+	case bool:
+		return strconv.FormatBool(k), true
+	}
+	return "", false
+}
+
+// toGo converts a Value into plain Go values: tables that are sequences become
+// []interface{}, every other table becomes map[string]interface{}. Functions
+// are left out of maps and become nil elsewhere. A table that contains itself
+// fails with a *CycleError.
+func toGo(v Value) (interface{}, error) {
+	return goValue(v, make(map[*Table]bool))
+}
+
+func goValue(v Value, visiting map[*Table]bool) (interface{}, error) {
+	if isFunction(v) {
+		return nil, nil
+	}
+	t, ok := v.(*Table)
+	if !ok {
+		return v, nil
+	}
+	if visiting[t] {
+		return nil, &CycleError{Type: tableType}
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	if t.IsSequence() && t.Len() > 0 {
+		s := make([]interface{}, t.Len())
+		for i := range s {
+			e, err := goValue(t.Get(int64(i+1)), visiting)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = e
+		}
+		return s, nil
+	}
+	m := make(map[string]interface{}, len(t.keys))
+	for _, k := range t.keys {
+		if ks, ok := keyString(k); ok && !isFunction(t.values[k]) {
+			e, err := goValue(t.values[k], visiting)
+			if err != nil {
+				return nil, err
+			}
+			m[ks] = e
+		}
+	}
+	return m, nil
+}
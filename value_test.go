@@ -0,0 +1,98 @@
+package luar
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTable_SetGet(t *testing.T) {
+	tbl := NewTable()
+	tbl.Set("name", "app")
+	tbl.Set(1, "a")
+	tbl.Set(2.0, "b")
+	tbl.Set(int64(3), "c")
+
+	if tbl.Get("name") != "app" {
+		t.Errorf("expected 'app', got %v", tbl.Get("name"))
+	}
+	if tbl.Get(int64(2)) != "b" {
+		t.Errorf("expected float key 2.0 to normalize to 2, got %v", tbl.Get(int64(2)))
+	}
+	if tbl.Len() != 3 {
+		t.Errorf("expected length 3, got %d", tbl.Len())
+	}
+
+	tbl.Set("name", nil)
+	if tbl.Get("name") != nil {
+		t.Error("expected nil after deleting key")
+	}
+	if got := tbl.Keys(); !reflect.DeepEqual(got, []Value{int64(1), int64(2), int64(3)}) {
+		t.Errorf("unexpected keys %v", got)
+	}
+	if !tbl.IsSequence() {
+		t.Error("expected table to be a sequence")
+	}
+}
+
+func TestTable_Len(t *testing.T) {
+	tbl := NewTable()
+	steps := []struct {
+		key, val Value
+		want     int
+	}{
+		{int64(2), "b", 0},
+		{int64(4), "d", 0},
+		{int64(1), "a", 2},
+		{int64(3), "c", 4},
+		{int64(2), nil, 1},
+		{int64(4), nil, 1},
+		{2.0, "b", 3},
+		{int64(1), nil, 0},
+		{int64(1), "a", 3},
+		{int64(3), "C", 3},
+	}
+	for i, s := range steps {
+		tbl.Set(s.key, s.val)
+		if got := tbl.Len(); got != s.want {
+			t.Errorf("step %d: got length %d, want %d", i, got, s.want)
+		}
+	}
+
+	// Append takes constant time, so long sequences build quickly.
+	tbl = NewTable()
+	for i := 0; i < 100000; i++ {
+		tbl.Append(int64(i))
+	}
+	if tbl.Len() != 100000 || tbl.Get(int64(100000)) != int64(99999) {
+		t.Errorf("got length %d", tbl.Len())
+	}
+}
+
+func TestTable_ToGo(t *testing.T) {
+	inner := NewTable()
+	inner.Append("x")
+	inner.Append("y")
+	tbl := NewTable()
+	tbl.Set("list", inner)
+	tbl.Set("n", int64(1))
+
+	want := map[string]interface{}{
+		"list": []interface{}{"x", "y"},
+		"n":    int64(1),
+	}
+	if got, err := toGo(tbl); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v, %v", want, got, err)
+	}
+
+	// A table may appear twice, but not inside itself.
+	tbl.Set("again", inner)
+	if _, err := toGo(tbl); err != nil {
+		t.Errorf("shared table: %v", err)
+	}
+	inner.Append(tbl)
+	var cycleErr *CycleError
+	if _, err := toGo(tbl); !errors.As(err, &cycleErr) {
+		t.Errorf("expected CycleError, got %v", err)
+	}
+}
@@ -0,0 +1,500 @@
+package luar
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A Visitor's Visit method is invoked for each node encountered by Walk. If
+// the result visitor w is not nil, Walk visits each of the children of node
+// with w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order: it starts by calling
+// v.Visit(node); node must not be nil. If the visitor returned by
+// v.Visit(node) is not nil, Walk is invoked recursively with it for each of
+// the non-nil children of node, followed by a call of w.Visit(nil).
+//
+// Children are visited in source order. Assignment targets are visited
+// through Targets when present and through Names otherwise. The Locals and
+// Parent of a Block are not children: locals are visited where they are
+// declared.
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		Walk(v, &n.Block)
+	case *Block:
+		walkStatements(v, n.Statements)
+		if n.Return != nil {
+			Walk(v, n.Return)
+		}
+	case *AssignmentStatement:
+		if len(n.Targets) > 0 {
+			walkExpressions(v, n.Targets)
+		} else {
+			walkIdentifiers(v, n.Names)
+		}
+		walkExpressions(v, n.Values)
+	case *LocalAssignmentStatement:
+		walkIdentifiers(v, n.Names)
+		walkExpressions(v, n.Values)
+	case *FunctionCallStatement:
+		if n.Function != nil {
+			Walk(v, n.Function)
+		}
+	case *IfStatement:
+		walkExpression(v, n.Condition)
+		walkBlock(v, n.Then)
+		for i := range n.ElseIfs {
+			Walk(v, &n.ElseIfs[i])
+		}
+		walkBlock(v, n.Else)
+	case *ElseIfClause:
+		walkExpression(v, n.Condition)
+		walkBlock(v, n.Then)
+	case *WhileStatement:
+		walkExpression(v, n.Condition)
+		walkBlock(v, n.Body)
+	case *RepeatStatement:
+		walkBlock(v, n.Body)
+		walkExpression(v, n.Condition)
+	case *ForNumericStatement:
+		if n.Var != nil {
+			Walk(v, n.Var)
+		}
+		walkExpression(v, n.Start)
+		walkExpression(v, n.Limit)
+		walkExpression(v, n.Step)
+		walkBlock(v, n.Body)
+	case *ForInStatement:
+		walkIdentifiers(v, n.Names)
+		walkExpressions(v, n.Values)
+		walkBlock(v, n.Body)
+	case *FunctionStatement:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		walkIdentifiers(v, n.Parameters)
+		walkBlock(v, n.Body)
+	case *FunctionName:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		if n.Table != nil {
+			Walk(v, n.Table)
+		}
+	case *LocalFunctionStatement:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		walkIdentifiers(v, n.Parameters)
+		walkBlock(v, n.Body)
+	case *ReturnStatement:
+		walkExpressions(v, n.Results)
+	case *TableLiteral:
+		for _, field := range n.Fields {
+			if field != nil {
+				Walk(v, field)
+			}
+		}
+	case *TableField:
+		walkExpression(v, n.Key)
+		walkExpression(v, n.Value)
+	case *FunctionLiteral:
+		walkIdentifiers(v, n.Parameters)
+		walkBlock(v, n.Body)
+	case *BinaryExpression:
+		walkExpression(v, n.Left)
+		walkExpression(v, n.Right)
+	case *UnaryExpression:
+		walkExpression(v, n.Right)
+	case *IndexExpression:
+		walkExpression(v, n.Object)
+		walkExpression(v, n.Index)
+	case *MemberExpression:
+		walkExpression(v, n.Object)
+	case *FunctionCall:
+		walkExpression(v, n.Function)
+		walkExpressions(v, n.Arguments)
+	case *TableIndex:
+		walkExpression(v, n.Key)
+	case *BreakStatement, *LabelStatement, *GotoStatement, *SemicolonStatement,
+		*Identifier, *NumberLiteral, *StringLiteral, *BooleanLiteral, *NilLiteral, *ErrorNode:
+		// no children
+	default:
+		panic(fmt.Sprintf("luar.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+func walkExpression(v Visitor, expr Expression) {
+	if expr != nil {
+		Walk(v, expr)
+	}
+}
+
+func walkExpressions(v Visitor, list []Expression) {
+	for _, expr := range list {
+		walkExpression(v, expr)
+	}
+}
+
+func walkBlock(v Visitor, block *Block) {
+	if block != nil {
+		Walk(v, block)
+	}
+}
+
+func walkStatements(v Visitor, list []Statement) {
+	for _, stmt := range list {
+		if stmt != nil {
+			Walk(v, stmt)
+		}
+	}
+}
+
+func walkIdentifiers(v Visitor, list []*Identifier) {
+	for _, ident := range list {
+		if ident != nil {
+			Walk(v, ident)
+		}
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: it starts by calling
+// f(node); node must not be nil. If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of node, followed by a call
+// of f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// An ApplyFunc is invoked by Apply for each non-nil node n, before and/or
+// after the node's children, using a Cursor describing the current
+// node and providing operations on it.
+//
+// The return value of ApplyFunc controls the syntax tree traversal.
+// See Apply for details.
+type ApplyFunc func(*Cursor) bool
+
+// Apply traverses a syntax tree recursively, starting with root, and calling
+// pre and post for each node:
+//
+//   - If pre is not nil, it is called for each node before the node's
+//     children are traversed (pre-order). If pre returns false, no children
+//     are traversed, and post is not called for that node.
+//   - If post is not nil, and a prior call of pre didn't return false, post
+//     is called for each node after its children are traversed (post-order).
+//     If post returns false, traversal is terminated and Apply returns
+//     immediately.
+//
+// Only fields that refer to AST nodes are considered children; nil children
+// are skipped. Apply visits the same children as Walk.
+//
+// Children of a node may be modified through the Cursor: Replace swaps the
+// current node, and in lists of statements, expressions, identifiers, table
+// fields and elseif clauses Delete, InsertBefore and InsertAfter edit the
+// list. Inserted nodes are not traversed. Apply returns the possibly
+// replaced root.
+func Apply(root Node, pre, post ApplyFunc) (result Node) {
+	parent := &struct{ Node }{root}
+	defer func() {
+		if r := recover(); r != nil && r != abort {
+			panic(r)
+		}
+		result = parent.Node
+	}()
+	a := &application{pre: pre, post: post}
+	a.apply(parent, "Node", nil, root)
+	return
+}
+
+var abort = new(int) // singleton, to signal termination of Apply
+
+// A Cursor describes a node encountered during Apply.
+// Information about the node and its parent is available
+// from the Node, Parent, Name, and Index methods.
+type Cursor struct {
+	parent Node
+	name   string
+	iter   *iterator // valid if non-nil
+	node   Node
+}
+
+// Node returns the current Node.
+func (c *Cursor) Node() Node { return c.node }
+
+// Parent returns the parent of the current Node.
+func (c *Cursor) Parent() Node { return c.parent }
+
+// Name returns the name of the parent Node field that contains the current
+// Node. If the parent is a *Program and the current Node is a Statement,
+// for instance, Name returns "Statements".
+func (c *Cursor) Name() string { return c.name }
+
+// Index reports the index >= 0 of the current Node in the slice of Nodes
+// that contains it, or a value < 0 if the current Node is not part of a
+// slice. The index of the current node changes if InsertBefore is called
+// while processing the current node.
+func (c *Cursor) Index() int {
+	if c.iter != nil {
+		return c.iter.index
+	}
+	return -1
+}
+
+// field returns the current node's parent field value.
+func (c *Cursor) field() reflect.Value {
+	return reflect.Indirect(reflect.ValueOf(c.parent)).FieldByName(c.name)
+}
+
+// Replace replaces the current Node with n.
+// The replacement node is not walked by Apply.
+func (c *Cursor) Replace(n Node) {
+	v := c.field()
+	if i := c.Index(); i >= 0 {
+		v = v.Index(i)
+	}
+	if v.Kind() == reflect.Struct {
+		// Elements of []ElseIfClause are stored by value.
+		v.Set(reflect.ValueOf(n).Elem())
+		return
+	}
+	v.Set(reflect.ValueOf(n))
+}
+
+// Delete deletes the current Node from its containing slice.
+// If the current Node is not part of a slice, Delete panics.
+func (c *Cursor) Delete() {
+	i := c.Index()
+	if i < 0 {
+		panic("Delete node not contained in slice")
+	}
+	v := c.field()
+	l := v.Len()
+	reflect.Copy(v.Slice(i, l), v.Slice(i+1, l))
+	v.Index(l - 1).Set(reflect.Zero(v.Type().Elem()))
+	v.SetLen(l - 1)
+	c.iter.step--
+}
+
+// InsertAfter inserts n after the current Node in its containing slice.
+// If the current Node is not part of a slice, InsertAfter panics.
+// Apply does not walk n.
+func (c *Cursor) InsertAfter(n Node) {
+	i := c.Index()
+	if i < 0 {
+		panic("InsertAfter node not contained in slice")
+	}
+	v := c.field()
+	v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+	l := v.Len()
+	reflect.Copy(v.Slice(i+2, l), v.Slice(i+1, l))
+	setElem(v.Index(i+1), n)
+	c.iter.step++
+}
+
+// InsertBefore inserts n before the current Node in its containing slice.
+// If the current Node is not part of a slice, InsertBefore panics.
+// Apply will not walk n.
+func (c *Cursor) InsertBefore(n Node) {
+	i := c.Index()
+	if i < 0 {
+		panic("InsertBefore node not contained in slice")
+	}
+	v := c.field()
+	v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+	l := v.Len()
+	reflect.Copy(v.Slice(i+1, l), v.Slice(i, l))
+	setElem(v.Index(i), n)
+	c.iter.index++
+}
+
+func setElem(v reflect.Value, n Node) {
+	if v.Kind() == reflect.Struct {
+		v.Set(reflect.ValueOf(n).Elem())
+		return
+	}
+	v.Set(reflect.ValueOf(n))
+}
+
+type application struct {
+	pre, post ApplyFunc
+	cursor    Cursor
+	iter      iterator
+}
+
+type iterator struct {
+	index, step int
+}
+
+func (a *application) apply(parent Node, name string, iter *iterator, n Node) {
+	// avoid heap-allocating a new cursor for each apply call; reuse a.cursor instead
+	saved := a.cursor
+	a.cursor.parent = parent
+	a.cursor.name = name
+	a.cursor.iter = iter
+	a.cursor.node = n
+
+	if a.pre != nil && !a.pre(&a.cursor) {
+		a.cursor = saved
+		return
+	}
+
+	// walk children
+	// (the order of the cases matches the order of the corresponding node types in Walk)
+	switch n := n.(type) {
+	case *Program:
+		a.apply(n, "Block", nil, &n.Block)
+	case *Block:
+		a.applyList(n, "Statements")
+		if n.Return != nil {
+			a.apply(n, "Return", nil, n.Return)
+		}
+	case *AssignmentStatement:
+		if len(n.Targets) > 0 {
+			a.applyList(n, "Targets")
+		} else {
+			a.applyList(n, "Names")
+		}
+		a.applyList(n, "Values")
+	case *LocalAssignmentStatement:
+		a.applyList(n, "Names")
+		a.applyList(n, "Values")
+	case *FunctionCallStatement:
+		if n.Function != nil {
+			a.apply(n, "Function", nil, n.Function)
+		}
+	case *IfStatement:
+		a.applyExpression(n, "Condition", n.Condition)
+		a.applyBlock(n, "Then", n.Then)
+		a.applyList(n, "ElseIfs")
+		a.applyBlock(n, "Else", n.Else)
+	case *ElseIfClause:
+		a.applyExpression(n, "Condition", n.Condition)
+		a.applyBlock(n, "Then", n.Then)
+	case *WhileStatement:
+		a.applyExpression(n, "Condition", n.Condition)
+		a.applyBlock(n, "Body", n.Body)
+	case *RepeatStatement:
+		a.applyBlock(n, "Body", n.Body)
+		a.applyExpression(n, "Condition", n.Condition)
+	case *ForNumericStatement:
+		if n.Var != nil {
+			a.apply(n, "Var", nil, n.Var)
+		}
+		a.applyExpression(n, "Start", n.Start)
+		a.applyExpression(n, "Limit", n.Limit)
+		a.applyExpression(n, "Step", n.Step)
+		a.applyBlock(n, "Body", n.Body)
+	case *ForInStatement:
+		a.applyList(n, "Names")
+		a.applyList(n, "Values")
+		a.applyBlock(n, "Body", n.Body)
+	case *FunctionStatement:
+		if n.Name != nil {
+			a.apply(n, "Name", nil, n.Name)
+		}
+		a.applyList(n, "Parameters")
+		a.applyBlock(n, "Body", n.Body)
+	case *FunctionName:
+		if n.Name != nil {
+			a.apply(n, "Name", nil, n.Name)
+		}
+		if n.Table != nil {
+			a.apply(n, "Table", nil, n.Table)
+		}
+	case *LocalFunctionStatement:
+		if n.Name != nil {
+			a.apply(n, "Name", nil, n.Name)
+		}
+		a.applyList(n, "Parameters")
+		a.applyBlock(n, "Body", n.Body)
+	case *ReturnStatement:
+		a.applyList(n, "Results")
+	case *TableLiteral:
+		a.applyList(n, "Fields")
+	case *TableField:
+		a.applyExpression(n, "Key", n.Key)
+		a.applyExpression(n, "Value", n.Value)
+	case *FunctionLiteral:
+		a.applyList(n, "Parameters")
+		a.applyBlock(n, "Body", n.Body)
+	case *BinaryExpression:
+		a.applyExpression(n, "Left", n.Left)
+		a.applyExpression(n, "Right", n.Right)
+	case *UnaryExpression:
+		a.applyExpression(n, "Right", n.Right)
+	case *IndexExpression:
+		a.applyExpression(n, "Object", n.Object)
+		a.applyExpression(n, "Index", n.Index)
+	case *MemberExpression:
+		a.applyExpression(n, "Object", n.Object)
+	case *FunctionCall:
+		a.applyExpression(n, "Function", n.Function)
+		a.applyList(n, "Arguments")
+	case *TableIndex:
+		a.applyExpression(n, "Key", n.Key)
+	case *BreakStatement, *LabelStatement, *GotoStatement, *SemicolonStatement,
+		*Identifier, *NumberLiteral, *StringLiteral, *BooleanLiteral, *NilLiteral, *ErrorNode:
+		// no children
+	default:
+		panic(fmt.Sprintf("luar.Apply: unexpected node type %T", n))
+	}
+
+	if a.post != nil && !a.post(&a.cursor) {
+		panic(abort)
+	}
+
+	a.cursor = saved
+}
+
+func (a *application) applyExpression(parent Node, name string, expr Expression) {
+	if expr != nil {
+		a.apply(parent, name, nil, expr)
+	}
+}
+
+func (a *application) applyBlock(parent Node, name string, block *Block) {
+	if block != nil {
+		a.apply(parent, name, nil, block)
+	}
+}
+
+func (a *application) applyList(parent Node, name string) {
+	// avoid heap-allocating a new iterator for each applyList call; reuse a.iter instead
+	saved := a.iter
+	a.iter.index = 0
+	for {
+		// must reload parent.name each time, since cursor modifications might change it
+		v := reflect.Indirect(reflect.ValueOf(parent)).FieldByName(name)
+		if a.iter.index >= v.Len() {
+			break
+		}
+
+		a.iter.step = 1
+		if x := v.Index(a.iter.index); x.Kind() == reflect.Struct {
+			a.apply(parent, name, &a.iter, x.Addr().Interface().(Node))
+		} else if !x.IsNil() {
+			a.apply(parent, name, &a.iter, x.Interface().(Node))
+		}
+		a.iter.index += a.iter.step
+	}
+	a.iter = saved
+}
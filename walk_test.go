@@ -0,0 +1,160 @@
+package luar
+
+import (
+	"reflect"
+	"testing"
+)
+
+const walkSource = `
+local x = 1
+function M.f:m(a, ...) return a end
+if x then y = -x elseif z then t[1] = {k = "v", [2] = f(x)} else s.a = nil end
+for i = 1, 2 do end
+for k, v in pairs(t) do break end
+while false do goto done end
+repeat x = x .. "a" until true
+::done::
+`
+
+func parseWalkSource(t *testing.T) *Program {
+	t.Helper()
+	program, err := NewParser(walkSource).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program
+}
+
+func TestInspect_AllNodes(t *testing.T) {
+	seen := map[string]bool{}
+	Inspect(parseWalkSource(t), func(n Node) bool {
+		if n != nil {
+			seen[n.NodeType()] = true
+		}
+		return true
+	})
+
+	for _, want := range []string{
+		"Program", "Block", "LocalAssignmentStatement", "FunctionStatement", "FunctionName",
+		"ReturnStatement", "IfStatement", "ElseIfClause", "AssignmentStatement",
+		"UnaryExpression", "IndexExpression", "TableLiteral", "TableField", "TableIndex",
+		"StringLiteral", "FunctionCall", "MemberExpression", "NilLiteral", "ForNumericStatement",
+		"ForInStatement", "BreakStatement", "WhileStatement", "BooleanLiteral",
+		"GotoStatement", "RepeatStatement", "BinaryExpression", "LabelStatement",
+		"NumberLiteral", "Identifier",
+	} {
+		if !seen[want] {
+			t.Errorf("Inspect did not visit a %s", want)
+		}
+	}
+}
+
+type countingVisitor struct {
+	enter, leave *int
+}
+
+func (v countingVisitor) Visit(n Node) Visitor {
+	if n == nil {
+		*v.leave++
+		return nil
+	}
+	*v.enter++
+	if _, ok := n.(*FunctionLiteral); ok {
+		return nil
+	}
+	return v
+}
+
+func TestWalk_VisitNil(t *testing.T) {
+	var enter, leave int
+	program, err := NewParser("x = {1, function() return 2 end}").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Walk(countingVisitor{&enter, &leave}, program)
+
+	// Program, its block, assignment, x, table, two fields, 1 and the
+	// function, whose body is skipped.
+	if enter != 9 {
+		t.Errorf("visited %d nodes, want 9", enter)
+	}
+	// Every node with a non-nil visitor is closed except the function.
+	if leave != enter-1 {
+		t.Errorf("got %d Visit(nil) calls, want %d", leave, enter-1)
+	}
+}
+
+func TestApply_Replace(t *testing.T) {
+	program, err := NewParser("a = b + a\nlocal c = a").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Apply(program, func(c *Cursor) bool {
+		if id, ok := c.Node().(*Identifier); ok && id.Name == "a" {
+			c.Replace(&Identifier{Name: "z"})
+		}
+		return true
+	}, nil)
+
+	want := "z = b + z\nlocal c = z\n"
+	if got := FormatProgram(program); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestApply_EditLists(t *testing.T) {
+	program, err := NewParser("a = 1\nb = 2\nc = 3\nif x then y = 1 elseif z then w = 2 end").Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	Apply(program, func(c *Cursor) bool {
+		switch n := c.Node().(type) {
+		case *AssignmentStatement:
+			switch n.Names[0].Name {
+			case "a":
+				c.InsertBefore(&LocalAssignmentStatement{Names: []*Identifier{{Name: "before"}}})
+			case "b":
+				c.Delete()
+			case "c":
+				c.InsertAfter(&BreakStatement{})
+			}
+			names = append(names, n.Names[0].Name)
+		case *ElseIfClause:
+			if c.Name() != "ElseIfs" || c.Index() != 0 {
+				t.Errorf("elseif cursor at %s[%d]", c.Name(), c.Index())
+			}
+			c.Delete()
+			return false
+		}
+		return true
+	}, nil)
+
+	want := "local before\na = 1\nc = 3\nbreak\nif x then\n    y = 1\nend\n"
+	if got := FormatProgram(program); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b", "c", "y"}) {
+		t.Errorf("visited assignments %v", names)
+	}
+}
+
+func TestApply_AbortAndRoot(t *testing.T) {
+	program := parseWalkSource(t)
+	count := 0
+	Apply(program, nil, func(c *Cursor) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Errorf("post called %d times after returning false, want 3", count)
+	}
+
+	root := Apply(&Identifier{Name: "a"}, func(c *Cursor) bool {
+		c.Replace(&Identifier{Name: "b"})
+		return false
+	}, nil)
+	if id, ok := root.(*Identifier); !ok || id.Name != "b" {
+		t.Errorf("Apply returned %#v, want the replaced root", root)
+	}
+}
@@ -0,0 +1,239 @@
+package luar
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sources records the files a decode read, with a hash of their contents,
+// and the include patterns it expanded, so that a Watcher can tell when
+// they change.
+type sources struct {
+	// files holds the hash of each file, empty if it could not be read,
+	// and globs the files each pattern matched, separated by newlines.
+	files map[string]string
+	globs map[string]string
+}
+
+func newSources() *sources {
+	return &sources{files: make(map[string]string), globs: make(map[string]string)}
+}
+
+func (s *sources) addFile(name string, data []byte, err error) {
+	if s != nil {
+		s.files[name] = contentHash(data, err)
+	}
+}
+
+func (s *sources) addGlob(pattern string, matches []string) {
+	if s != nil {
+		s.globs[pattern] = strings.Join(matches, "\n")
+	}
+}
+
+func contentHash(data []byte, err error) string {
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return string(sum[:])
+}
+
+// WatchOptions configures a Watcher.
+type WatchOptions struct {
+	// Interval is the time between checks of the files. It defaults to
+	// one second.
+	Interval time.Duration
+
+	// Merge loads the files with MergeFiles instead of LoadFiles.
+	Merge bool
+
+	// Validate checks a newly decoded config before it is published. An
+	// error keeps the last good config current.
+	Validate func(v interface{}) error
+
+	// OnUpdate is called with each config published after the first, in
+	// order and one at a time, so it must not call Reload. A config that
+	// was replaced before OnUpdate could be called with it is skipped.
+	// OnError is called with each error from a reload started by Run.
+	OnUpdate func(v interface{})
+	OnError  func(err error)
+}
+
+// Watcher reloads config files when they or the files they load with
+// require, dofile and include change, so that a long-running program can
+// pick up a new config without restarting. It checks the files by polling.
+//
+// Each reload decodes into a fresh value, which replaces the current config
+// only if it decodes and passes validation. Published values are shared
+// between goroutines and must not be modified. The decoder must not be
+// changed while the watcher uses it.
+type Watcher struct {
+	dec   *Decoder
+	typ   reflect.Type
+	names []string
+	opts  WatchOptions
+
+	// mu serializes reloads and guards sources and published, the number
+	// of configs published.
+	mu        sync.Mutex
+	sources   *sources
+	published int
+	current   atomic.Value
+
+	// notify serializes the calls to OnUpdate, and notified is the number
+	// of the last config passed to it.
+	notify   sync.Mutex
+	notified int
+}
+
+// NewWatcher loads the named files with d and returns a watcher for them.
+// v is a pointer to the config type, such as (*Config)(nil), and Current
+// returns values of that pointer type. It fails if the files cannot be
+// loaded.
+func NewWatcher(d *Decoder, v interface{}, opts WatchOptions, names ...string) (*Watcher, error) {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("luar: expected pointer, got %T", v)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	w := &Watcher{dec: d, typ: t.Elem(), names: names, opts: opts, sources: newSources()}
+	if _, _, err := w.reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Current returns the last config that loaded and passed validation.
+func (w *Watcher) Current() interface{} {
+	return w.current.Load()
+}
+
+// Files returns the files the watcher checks, in order.
+func (w *Watcher) Files() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	files := make([]string, 0, len(w.sources.files))
+	for name := range w.sources.files {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Reload loads the files now and publishes the new config. On error the
+// last good config stays current.
+func (w *Watcher) Reload() error {
+	return w.ReloadContext(context.Background())
+}
+
+// ReloadContext is like Reload but stops the evaluation of the files with a
+// *CanceledError when ctx is done.
+func (w *Watcher) ReloadContext(ctx context.Context) error {
+	v, n, err := w.reload(ctx)
+	if err != nil || w.opts.OnUpdate == nil {
+		return err
+	}
+	w.notify.Lock()
+	defer w.notify.Unlock()
+	if n > w.notified {
+		w.notified = n
+		w.opts.OnUpdate(v)
+	}
+	return nil
+}
+
+// reload loads and publishes a new config, and returns it with its number.
+func (w *Watcher) reload(ctx context.Context) (interface{}, int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	src := newSources()
+	v := reflect.New(w.typ).Interface()
+	var err error
+	if w.opts.Merge {
+		err = w.dec.mergeFiles(ctx, v, w.names, src)
+	} else {
+		err = w.dec.loadFiles(ctx, v, w.names, src)
+	}
+	if err == nil && w.opts.Validate != nil {
+		err = w.opts.Validate(v)
+	}
+	if err != nil {
+		// Keep checking the files of the last good config too, so that
+		// fixing whichever file broke it reloads. The maps are replaced,
+		// not changed, as changed reads them without the lock.
+		merged := newSources()
+		for _, s := range []*sources{w.sources, src} {
+			for name, hash := range s.files {
+				merged.files[name] = hash
+			}
+			for pattern, matches := range s.globs {
+				merged.globs[pattern] = matches
+			}
+		}
+		w.sources = merged
+		return nil, 0, err
+	}
+	w.sources = src
+	w.published++
+	w.current.Store(v)
+	return v, w.published, nil
+}
+
+// Run checks the files every Interval and reloads them when they change,
+// until ctx is done, which also stops a reload in progress. It returns
+// ctx.Err().
+func (w *Watcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if !w.changed() {
+			continue
+		}
+		err := w.ReloadContext(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && w.opts.OnError != nil {
+			w.opts.OnError(err)
+		}
+	}
+}
+
+// changed reports whether a file or the matches of a pattern changed since
+// they were last loaded.
+func (w *Watcher) changed() bool {
+	w.mu.Lock()
+	files, globs := w.sources.files, w.sources.globs
+	w.mu.Unlock()
+
+	for name, hash := range files {
+		if contentHash(w.dec.readData(name)) != hash {
+			return true
+		}
+	}
+	for pattern, matches := range globs {
+		found, err := fs.Glob(w.dec.fsys, pattern)
+		sort.Strings(found)
+		if err != nil || strings.Join(found, "\n") != matches {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,254 @@
+package luar
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type watchConfig struct {
+	Name    string   `lua:"name"`
+	Port    int      `lua:"port"`
+	Plugins []string `lua:"plugins"`
+}
+
+// replaceFile writes a file atomically, so that a poll never sees it half
+// written.
+func replaceFile(t *testing.T, dir, name, src string) {
+	t.Helper()
+	tmp := filepath.Join(dir, ".tmp")
+	if err := os.WriteFile(tmp, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	replaceFile(t, dir, "main.lua", "local db = require('db')\nport = db.port\nplugins = {}\ninclude('plugins/*.lua')\n")
+	replaceFile(t, dir, "db.lua", "return {port = 5432}\n")
+	replaceFile(t, dir, "app.lua", "name = 'app'\n")
+	replaceFile(t, dir, "plugins/log.lua", "plugins[#plugins + 1] = 'log'\n")
+
+	d := NewDecoder(nil)
+	d.SetFS(os.DirFS(dir))
+	updates := make(chan *watchConfig, 100)
+	errs := make(chan error, 100)
+	w, err := NewWatcher(d, (*watchConfig)(nil), WatchOptions{
+		Interval: 5 * time.Millisecond,
+		Validate: func(v interface{}) error {
+			if v.(*watchConfig).Port == 0 {
+				return errors.New("port is required")
+			}
+			return nil
+		},
+		OnUpdate: func(v interface{}) { updates <- v.(*watchConfig) },
+		OnError:  func(err error) { errs <- err },
+	}, "main.lua", "app.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &watchConfig{Name: "app", Port: 5432, Plugins: []string{"log"}}
+	if got := w.Current(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if files := w.Files(); !reflect.DeepEqual(files, []string{"app.lua", "db.lua", "main.lua", "plugins/log.lua"}) {
+		t.Errorf("got files %v", files)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("Run returned %v", err)
+		}
+	}()
+
+	waitUpdate := func(want *watchConfig) {
+		t.Helper()
+		for {
+			select {
+			case got := <-updates:
+				if reflect.DeepEqual(got, want) {
+					if current := w.Current(); current != got {
+						t.Errorf("Current is %+v, want the published %+v", current, got)
+					}
+					return
+				}
+			case err := <-errs:
+				t.Fatalf("unexpected error %v", err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no update to %+v", want)
+			}
+		}
+	}
+	waitError := func(msg string) {
+		t.Helper()
+		select {
+		case err := <-errs:
+			if !strings.Contains(err.Error(), msg) {
+				t.Errorf("got %v, want %q", err, msg)
+			}
+		case got := <-updates:
+			t.Fatalf("unexpected update %+v", got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no error %q", msg)
+		}
+	}
+
+	// A required dependency changes.
+	replaceFile(t, dir, "db.lua", "return {port = 6432}\n")
+	want = &watchConfig{Name: "app", Port: 6432, Plugins: []string{"log"}}
+	waitUpdate(want)
+
+	// A file matching an include pattern appears.
+	replaceFile(t, dir, "plugins/metrics.lua", "plugins[#plugins + 1] = 'metrics'\n")
+	want = &watchConfig{Name: "app", Port: 6432, Plugins: []string{"log", "metrics"}}
+	waitUpdate(want)
+
+	// Broken and invalid configs keep the last good one.
+	replaceFile(t, dir, "db.lua", "return {port = }\n")
+	waitError("db.lua: unexpected token")
+	replaceFile(t, dir, "db.lua", "return {port = 0}\n")
+	waitError("port is required")
+	if got := w.Current(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want the last good %+v", got, want)
+	}
+
+	// Fixing the file publishes again.
+	replaceFile(t, dir, "db.lua", "return {port = 7432}\n")
+	waitUpdate(&watchConfig{Name: "app", Port: 7432, Plugins: []string{"log", "metrics"}})
+}
+
+func TestWatcher_Merge(t *testing.T) {
+	dir := t.TempDir()
+	base, local := filepath.Join(dir, "base.lua"), filepath.Join(dir, "local.lua")
+	replaceFile(t, dir, "base.lua", "name = 'app'\nport = 80\n")
+	replaceFile(t, dir, "local.lua", "port = 8080\n")
+
+	w, err := NewWatcher(NewDecoder(nil), &watchConfig{}, WatchOptions{Merge: true}, base, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Current().(*watchConfig); got.Name != "app" || got.Port != 8080 {
+		t.Errorf("got %+v", got)
+	}
+
+	replaceFile(t, dir, "local.lua", "port = 9090\n")
+	if !w.changed() {
+		t.Error("change not detected")
+	}
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Current().(*watchConfig); got.Port != 9090 || w.changed() {
+		t.Errorf("got %+v", got)
+	}
+
+	if err := os.Remove(local); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Reload(); err == nil || w.Current().(*watchConfig).Port != 9090 {
+		t.Errorf("got %v, %+v", err, w.Current())
+	}
+}
+
+func TestWatcher_UpdateOrder(t *testing.T) {
+	dir := t.TempDir()
+	replaceFile(t, dir, "main.lua", "port = next()\n")
+
+	var n int64
+	d := NewDecoder(nil)
+	d.RegisterFunc("next", func() int64 { return atomic.AddInt64(&n, 1) })
+	var ports []int
+	w, err := NewWatcher(d, (*watchConfig)(nil), WatchOptions{
+		OnUpdate: func(v interface{}) { ports = append(ports, v.(*watchConfig).Port) },
+	}, filepath.Join(dir, "main.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent reloads deliver their configs in the order they were
+	// published, skipping those already replaced.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := w.Reload(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if !sort.IntsAreSorted(ports) || len(ports) == 0 || ports[len(ports)-1] != w.Current().(*watchConfig).Port {
+		t.Errorf("got updates %v, current %+v", ports, w.Current())
+	}
+}
+
+func TestWatcher_RunCancel(t *testing.T) {
+	dir := t.TempDir()
+	replaceFile(t, dir, "main.lua", "port = 1\n")
+	reloads := make(chan struct{}, 1)
+	d := NewDecoder(nil)
+	d.RegisterFunc("started", func() {
+		select {
+		case reloads <- struct{}{}:
+		default:
+		}
+	})
+	w, err := NewWatcher(d, (*watchConfig)(nil), WatchOptions{Interval: 5 * time.Millisecond}, filepath.Join(dir, "main.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Canceling Run stops a reload that never ends.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+	replaceFile(t, dir, "main.lua", "started()\nwhile true do end\n")
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload")
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Run returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop the reload")
+	}
+	if got := w.Current().(*watchConfig); got.Port != 1 {
+		t.Errorf("got %+v, want the last good config", got)
+	}
+}
+
+func TestNewWatcher_Errors(t *testing.T) {
+	d := NewDecoder(nil)
+	if _, err := NewWatcher(d, watchConfig{}, WatchOptions{}, "main.lua"); err == nil || err.Error() != "luar: expected pointer, got luar.watchConfig" {
+		t.Errorf("got %v", err)
+	}
+	if _, err := NewWatcher(d, (*watchConfig)(nil), WatchOptions{}, filepath.Join(t.TempDir(), "missing.lua")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want os.ErrNotExist", err)
+	}
+}